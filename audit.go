@@ -0,0 +1,213 @@
+package dvara
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// auditRecord describes a single mutating operation. Document contents are
+// intentionally not recorded.
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Op     string    `json:"op"`
+	NS     string    `json:"ns"`
+}
+
+// auditBuffer is the number of records queued for writing before proxying
+// waits on the writer.
+const auditBuffer = 1024
+
+// auditor writes audit records as JSON lines in the background.
+type auditor struct {
+	log     Logger
+	records chan auditRecord
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newAuditor(w io.Writer, log Logger) *auditor {
+	a := &auditor{
+		log:     log,
+		records: make(chan auditRecord, auditBuffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go a.writeLoop(w)
+	return a
+}
+
+func (a *auditor) writeLoop(w io.Writer) {
+	defer close(a.done)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	write := func(r auditRecord) {
+		if err := enc.Encode(r); err != nil {
+			a.log.Errorf("error writing audit record: %s", err)
+		}
+	}
+	flush := func() {
+		if err := bw.Flush(); err != nil {
+			a.log.Errorf("error flushing audit records: %s", err)
+		}
+	}
+	for {
+		select {
+		case r := <-a.records:
+			write(r)
+			if len(a.records) == 0 {
+				flush()
+			}
+		case <-a.stop:
+			for {
+				select {
+				case r := <-a.records:
+					write(r)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// record queues a record for writing. Records made after close are dropped.
+func (a *auditor) record(r auditRecord) {
+	select {
+	case a.records <- r:
+	case <-a.stop:
+	}
+}
+
+// close writes the queued records and stops the auditor.
+func (a *auditor) close() {
+	close(a.stop)
+	<-a.done
+}
+
+// auditWriteCommands are the commands recorded when sent as an OpQuery or
+// OpMsg.
+var auditWriteCommands = []string{
+	"insert",
+	"update",
+	"delete",
+	"findAndModify",
+}
+
+// audit records the message if it is a mutating operation. The namespace is
+// read from the client and the returned connection will replay it.
+func (p *Proxy) audit(h *messageHeader, c net.Conn) (net.Conn, error) {
+	if h.OpCode != OpQuery && !h.OpCode.IsMutation() {
+		return c, nil
+	}
+
+	// All of these start with an int32 followed by the full collection name.
+	var read bytes.Buffer
+	body := io.TeeReader(io.LimitReader(c, int64(h.MessageLength-headerLen)), &read)
+	replay := func() net.Conn {
+		return &prefixConn{Conn: c, prefix: bytes.NewReader(read.Bytes())}
+	}
+	var prefix [4]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, err
+	}
+	fullCollectionName, err := readCString(body)
+	if err != nil {
+		return nil, err
+	}
+	ns := string(fullCollectionName[:len(fullCollectionName)-1])
+	op := h.OpCode.String()
+
+	if h.OpCode == OpQuery {
+		if !bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
+			return replay(), nil
+		}
+		var twoInt32 [8]byte
+		if _, err := io.ReadFull(body, twoInt32[:]); err != nil {
+			return nil, err
+		}
+		// The document size isn't trusted, it must fit in the rest of the
+		// message.
+		var sizeRaw [4]byte
+		if _, err := io.ReadFull(body, sizeRaw[:]); err != nil {
+			return nil, err
+		}
+		size := int(getInt32(sizeRaw[:], 0))
+		if size < 5 || size > int(h.MessageLength-headerLen)-read.Len()+len(sizeRaw) {
+			// Leave reporting the malformed query to ProxyQuery.
+			return replay(), nil
+		}
+		queryDoc, err := readDocumentInto(io.MultiReader(bytes.NewReader(sizeRaw[:]), body), nil)
+		if err != nil {
+			return nil, err
+		}
+		var q bson.D
+		if err := bson.Unmarshal(queryDoc, &q); err != nil || len(q) == 0 {
+			// Leave reporting the malformed query to ProxyQuery.
+			return replay(), nil
+		}
+		op = ""
+		for _, cmd := range auditWriteCommands {
+			if strings.EqualFold(q[0].Name, cmd) {
+				op = cmd
+			}
+		}
+		if op == "" {
+			return replay(), nil
+		}
+		collection, _ := q[0].Value.(string)
+		ns = databaseName(fullCollectionName) + "." + collection
+	}
+
+	p.recordAudit(c, op, ns)
+	return replay(), nil
+}
+
+// auditMsg records the OpMsg if its command is a write.
+func (p *Proxy) auditMsg(head *opMsgHead, c net.Conn) {
+	var op string
+	cmd := commandName(head.Body)
+	for _, write := range auditWriteCommands {
+		if strings.EqualFold(cmd, write) {
+			op = write
+		}
+	}
+	if op == "" {
+		return
+	}
+	var q bson.D
+	if err := bson.Unmarshal(head.Body, &q); err != nil || len(q) == 0 {
+		// Leave reporting the malformed command to the server.
+		return
+	}
+	collection, _ := q[0].Value.(string)
+	var db string
+	for _, e := range q {
+		if e.Name == "$db" {
+			db, _ = e.Value.(string)
+		}
+	}
+	p.recordAudit(c, op, db+"."+collection)
+}
+
+// recordAudit records the operation by the client.
+func (p *Proxy) recordAudit(c net.Conn, op, ns string) {
+	client := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	p.auditor.record(auditRecord{
+		Time:   p.ReplicaSet.clock().Now(),
+		Client: client,
+		Op:     op,
+		NS:     ns,
+	})
+}
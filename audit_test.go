@@ -0,0 +1,147 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// recordingConn is a deadlineConn that keeps what's written to it.
+type recordingConn struct {
+	deadlineConn
+	written bytes.Buffer
+	addr    net.Addr
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) { return c.written.Write(b) }
+func (c *recordingConn) RemoteAddr() net.Addr        { return c.addr }
+
+func TestAuditMutations(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	var out bytes.Buffer
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			ProxyQuery:     &ProxyQuery{Log: log},
+			MessageTimeout: time.Minute,
+		},
+		auditor: newAuditor(&out, log),
+	}
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	doc, err := bson.Marshal(bson.M{"_id": 1, "secret": "hunter2"})
+	ensure.Nil(t, err)
+	insert := append([]byte{0, 0, 0, 0}, "test.c\x00"...)
+	insert = append(insert, doc...)
+	insertH := &messageHeader{
+		MessageLength: int32(headerLen + len(insert)),
+		RequestID:     1,
+		OpCode:        OpInsert,
+	}
+	server := &recordingConn{}
+	client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(insert)}, addr: addr}
+	ensure.Nil(t, p.proxyMessage(insertH, client, server, &LastError{}))
+	if expected := append(insertH.ToWire(), insert...); !bytes.Equal(server.written.Bytes(), expected) {
+		t.Fatalf("expected insert %v to be proxied got %v", expected, server.written.Bytes())
+	}
+
+	for _, q := range []bson.D{
+		{{Name: "find", Value: "c"}},
+		{{Name: "update", Value: "c"}, {Name: "updates", Value: []bson.M{{"q": bson.M{}}}}},
+	} {
+		h, query := fakeQuery("test.$cmd", q)
+		body, err := ioutil.ReadAll(query)
+		ensure.Nil(t, err)
+		server := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(reply)}}
+		client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}, addr: addr}
+		ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+		if expected := append(h.ToWire(), body...); !bytes.Equal(server.written.Bytes(), expected) {
+			t.Fatalf("expected query %v to be proxied got %v", expected, server.written.Bytes())
+		}
+	}
+
+	msgReply := fakeOpMsg(t, 0, bson.M{"ok": 1})
+	for _, msg := range [][]byte{
+		fakeOpMsg(t, 0, bson.D{{Name: "find", Value: "c"}, {Name: "$db", Value: "app"}}),
+		fakeOpMsg(
+			t,
+			0,
+			bson.D{{Name: "insert", Value: "c"}, {Name: "$db", Value: "app"}},
+			bson.M{"_id": 1, "secret": "hunter2"},
+		),
+	} {
+		r := bytes.NewReader(msg)
+		h, err := readHeader(r)
+		ensure.Nil(t, err)
+		server := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(msgReply)}}
+		client := &recordingConn{deadlineConn: deadlineConn{r: r}, addr: addr}
+		ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+		if !bytes.Equal(server.written.Bytes(), msg) {
+			t.Fatalf("expected command %v to be proxied got %v", msg, server.written.Bytes())
+		}
+	}
+
+	p.auditor.close()
+	if bytes.Contains(out.Bytes(), []byte("hunter2")) {
+		t.Fatalf("document contents were audited: %s", out.Bytes())
+	}
+	dec := json.NewDecoder(&out)
+	for _, expected := range []auditRecord{
+		{Client: "10.0.0.1", Op: "INSERT", NS: "test.c"},
+		{Client: "10.0.0.1", Op: "update", NS: "test.c"},
+		{Client: "10.0.0.1", Op: "insert", NS: "app.c"},
+	} {
+		var actual auditRecord
+		ensure.Nil(t, dec.Decode(&actual))
+		if actual.Time.IsZero() {
+			t.Fatalf("missing time in %+v", actual)
+		}
+		actual.Time = time.Time{}
+		if actual != expected {
+			t.Fatalf("expected %+v got %+v", expected, actual)
+		}
+	}
+	if dec.More() {
+		t.Fatal("unexpected audit records")
+	}
+}
+
+func TestAuditMalformedQuery(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	var out bytes.Buffer
+	p := &Proxy{Log: log, auditor: newAuditor(&out, log)}
+	for _, size := range []int32{-1, 0, 4, 1 << 30} {
+		body := append([]byte{0, 0, 0, 0}, "test.$cmd\x00"...)
+		body = append(body, make([]byte, 8)...)
+		doc := make([]byte, 12)
+		setInt32(doc, 0, size)
+		body = append(body, doc...)
+		h := &messageHeader{
+			MessageLength: int32(headerLen + len(body)),
+			RequestID:     1,
+			OpCode:        OpQuery,
+		}
+		client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}}
+		c, err := p.audit(h, client)
+		ensure.Nil(t, err)
+		replayed, err := ioutil.ReadAll(c)
+		ensure.Nil(t, err)
+		if !bytes.Equal(replayed, body) {
+			t.Fatalf("size %d: expected %v replayed got %v", size, body, replayed)
+		}
+	}
+	p.auditor.close()
+	if out.Len() != 0 {
+		t.Fatalf("unexpected audit records: %s", out.Bytes())
+	}
+}
@@ -1,16 +1,91 @@
 package main
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// logLevel is the least severe level of the messages that are logged.
+type logLevel int32
+
+const (
+	logLevelDebug logLevel = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+// parseLogLevel parses one of debug, info, warn or error.
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "debug":
+		return logLevelDebug, nil
+	case "info":
+		return logLevelInfo, nil
+	case "warn":
+		return logLevelWarn, nil
+	case "error":
+		return logLevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
 
 // stdLogger provides a logger backed by the standard library logger. This is a
 // placeholder until we can open source our logger.
-type stdLogger struct{}
-
-func (l *stdLogger) Error(args ...interface{})                 { log.Print(args...) }
-func (l *stdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
-func (l *stdLogger) Warn(args ...interface{})                  { log.Print(args...) }
-func (l *stdLogger) Warnf(format string, args ...interface{})  { log.Printf(format, args...) }
-func (l *stdLogger) Info(args ...interface{})                  { log.Print(args...) }
-func (l *stdLogger) Infof(format string, args ...interface{})  { log.Printf(format, args...) }
-func (l *stdLogger) Debug(args ...interface{})                 { log.Print(args...) }
-func (l *stdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+type stdLogger struct {
+	level int32 // accessed atomically
+}
+
+// SetLevel changes the least severe level that is logged.
+func (l *stdLogger) SetLevel(level logLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *stdLogger) enabled(level logLevel) bool {
+	return logLevel(atomic.LoadInt32(&l.level)) <= level
+}
+
+func (l *stdLogger) print(level logLevel, args ...interface{}) {
+	if l.enabled(level) {
+		log.Print(args...)
+	}
+}
+
+func (l *stdLogger) printf(level logLevel, format string, args ...interface{}) {
+	if l.enabled(level) {
+		log.Printf(format, args...)
+	}
+}
+
+func (l *stdLogger) Error(args ...interface{}) {
+	l.print(logLevelError, args...)
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.printf(logLevelError, format, args...)
+}
+
+func (l *stdLogger) Warn(args ...interface{}) {
+	l.print(logLevelWarn, args...)
+}
+
+func (l *stdLogger) Warnf(format string, args ...interface{}) {
+	l.printf(logLevelWarn, format, args...)
+}
+
+func (l *stdLogger) Info(args ...interface{}) {
+	l.print(logLevelInfo, args...)
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.printf(logLevelInfo, format, args...)
+}
+
+func (l *stdLogger) Debug(args ...interface{}) {
+	l.print(logLevelDebug, args...)
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	l.printf(logLevelDebug, format, args...)
+}
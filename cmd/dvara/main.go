@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -25,53 +29,360 @@ func Main() error {
 	messageTimeout := flag.Duration("message_timeout", 2*time.Minute, "timeout for one message to be proxied")
 	clientIdleTimeout := flag.Duration("client_idle_timeout", 60*time.Minute, "idle timeout for client connections")
 	serverIdleTimeout := flag.Duration("server_idle_timeout", 1*time.Hour, "idle timeout for  server connections")
+	serverConnMaxLifetime := flag.Duration("server_conn_max_lifetime", 0, "how long a server connection is reused for before it's replaced, 0 for no limit")
+	noTimeoutCursorLifetime := flag.Duration("no_timeout_cursor_lifetime", 0, "how long cursors opened with noCursorTimeout live before they're killed, 0 for no limit")
 	serverClosePoolSize := flag.Uint("server_close_pool_size", 100, "number of goroutines that will handle closing server connections")
+	serverKeepAliveInterval := flag.Duration("server_keep_alive_interval", 0, "how long server connections may be idle before they are pinged, 0 to disable")
+	maxMessageReadTime := flag.Duration("max_message_read_time", 0, "total time a client sending a message slowly but steadily is allowed, 0 to use message_timeout")
+	clientWriteTimeout := flag.Duration("client_write_timeout", 0, "timeout for writing each reply to a client, 0 to use message_timeout")
+	slowMessageThreshold := flag.Duration("slow_message_threshold", 0, "log messages that take longer than this to proxy, 0 to disable")
 	getLastErrorTimeout := flag.Duration("get_last_error_timeout", time.Minute, "timeout for getLastError pinning")
+	disableGetLastErrorCache := flag.Bool("disable_get_last_error_cache", false, "send every getLastError to the server instead of replaying a cached response")
+	maxConnectionsPerSecond := flag.Uint("max_connections_per_second", 0, "maximum rate of new client connections across all proxies, 0 for no limit")
+	clientKeepAliveInterval := flag.Duration("client_keep_alive_interval", 0, "time between TCP keep-alive probes of idle clients, 0 for the system default")
+	clientKeepAliveCount := flag.Int("client_keep_alive_count", 0, "unanswered TCP keep-alive probes before a client is considered gone, 0 for the system default")
+	clientLinger := flag.Duration("client_linger", 0, "SO_LINGER for closed client connections, negative to reset them right away, 0 for the system default")
+	acceptConcurrency := flag.Uint("accept_concurrency", 1, "number of goroutines accepting client connections per proxy")
+	acceptDrainTimeout := flag.Duration("accept_drain_timeout", 0, "how long to keep answering queued client connections with an error when stopping, 0 to close the listeners right away")
 	maxPerClientConnections := flag.Uint("max_per_client_connections", 100, "maximum number of connections per client")
+	stickyClientSessions := flag.Bool("sticky_client_sessions", false, "keep each client on one server connection until it disconnects, needs max_connections close to the number of clients")
 	maxConnections := flag.Uint("max_connections", 100, "maximum number of connections per mongo")
+	maxConcurrentGetMore := flag.Uint("max_concurrent_get_more", 0, "maximum number of getMore operations in flight at the same time, 0 for no limit")
+	maxConcurrentDials := flag.Uint("max_concurrent_dials", 0, "maximum number of server connections dialed at the same time, 0 for no limit")
+	maxMembers := flag.Uint("max_members", 12, "maximum number of replica set members to proxy")
 	portStart := flag.Int("port_start", 6000, "start of port range")
 	portEnd := flag.Int("port_end", 6010, "end of port range")
+	resolveInterval := flag.Duration("resolve_interval", 0, "how often to resolve member hostnames again, 0 to disable")
+	buildInfoOverride := flag.String("build_info_override", "", "if set the version reported to clients in buildInfo responses")
+	databaseMaxConnections := flag.String("database_max_connections", "", "comma separated list of database=count pairs giving databases their own server connection pools")
+	proxyMap := flag.String("proxy_map", "", "comma separated list of mongo=proxy address pairs to use instead of the discovered mapping")
+	tunablesFile := flag.String("tunables_file", "", "JSON file with message_timeout, client_idle_timeout, get_last_error_timeout, wire_dump, max_per_client_connections and log_level to apply on SIGHUP")
+	deniedCommands := flag.String("denied_commands", "", "comma separated list of commands that will be rejected instead of proxied")
+	maxReplyDocs := flag.Int("max_reply_docs", 0, "most documents relayed in one query or getMore reply, larger replies are truncated, 0 for no limit")
+	maxReplyBytes := flag.Int("max_reply_bytes", 0, "most bytes of documents relayed in one query or getMore reply, larger replies are truncated, 0 for no limit")
+	directConnection := flag.Bool("direct_connection", false, "proxy exactly the one given address without replica set discovery or rewriting")
+	readOnly := flag.Bool("read_only", false, "reject inserts, updates, deletes and any command not known to only read instead of proxying them")
+	restartOnStaleTopology := flag.Bool("restart_on_stale_topology", false, "rediscover the replica set when a command reply says the member is not master or recovering")
+	tagAppName := flag.Bool("tag_app_name", false, "append the client IP to the application name in client handshakes")
+	maxQueryDocSize := flag.Int("max_query_doc_size", 0, "largest query or command document in bytes to proxy, 0 for no limit")
+	disableCompressionNegotiation := flag.Bool("disable_compression_negotiation", false, "strip the compression field from client handshakes to keep traffic uncompressed")
+	tailableCursorTimeout := flag.Duration("tailable_cursor_timeout", 0, "timeout for tailable and awaitData queries, 0 to use message_timeout")
+	allowedDatabases := flag.String("allowed_databases", "", "comma separated list of databases clients may query, empty for all")
+	excludeDelayedMembers := flag.Bool("exclude_delayed_members", false, "if true delayed secondaries are not proxied")
+	excludeNonVotingMembers := flag.Bool("exclude_non_voting_members", false, "if true non voting members are not proxied")
+	maxConcurrentProbes := flag.Uint("max_concurrent_probes", 8, "number of seed addresses to probe at the same time during discovery")
+	maxConcurrentDiscoveries := flag.Uint("max_concurrent_discoveries", 0, "maximum number of replica set discoveries in progress at the same time, 0 for no limit")
+	wireDump := flag.String("wire_dump", "", "dump client connection data to stdout for debugging, either raw or hex")
+	hostnameFallback := flag.String("hostname_fallback", "loopback", "when the hostname doesn't resolve locally either loopback, fail or advertise-anyway")
+	startupTimeout := flag.Duration("startup_timeout", 0, "how long to wait for startup, including probing the seed addresses, 0 to wait indefinitely")
+	auditLog := flag.String("audit_log", "", "file to append a record of each write operation to")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 0, "how long to wait for clients to finish on SIGTERM or SIGINT before disconnecting them, 0 to wait indefinitely")
+	runtimeStatsInterval := flag.Duration("runtime_stats_interval", 0, "how often to record goroutine and memory stats, 0 to disable")
+	probeOnStart := flag.Bool("probe_on_start", false, "if true connect to each member once before serving")
+	logLevel := flag.String("log_level", "debug", "least severe level logged, either debug, info, warn or error")
 	addrs := flag.String("addrs", "localhost:27017", "comma separated list of mongo addresses")
 
 	flag.Parse()
 
 	replicaSet := dvara.ReplicaSet{
-		Addrs:                   *addrs,
-		PortStart:               *portStart,
-		PortEnd:                 *portEnd,
-		MessageTimeout:          *messageTimeout,
-		ClientIdleTimeout:       *clientIdleTimeout,
-		ServerIdleTimeout:       *serverIdleTimeout,
-		ServerClosePoolSize:     *serverClosePoolSize,
-		GetLastErrorTimeout:     *getLastErrorTimeout,
-		MaxConnections:          *maxConnections,
-		MaxPerClientConnections: *maxPerClientConnections,
+		Addrs:                    *addrs,
+		MaxMembers:               *maxMembers,
+		ProbeOnStart:             *probeOnStart,
+		ExcludeDelayedMembers:    *excludeDelayedMembers,
+		ExcludeNonVotingMembers:  *excludeNonVotingMembers,
+		PortStart:                *portStart,
+		PortEnd:                  *portEnd,
+		MessageTimeout:           *messageTimeout,
+		ClientIdleTimeout:        *clientIdleTimeout,
+		ServerIdleTimeout:        *serverIdleTimeout,
+		ServerConnMaxLifetime:    *serverConnMaxLifetime,
+		NoTimeoutCursorLifetime:  *noTimeoutCursorLifetime,
+		ServerClosePoolSize:      *serverClosePoolSize,
+		GetLastErrorTimeout:      *getLastErrorTimeout,
+		DisableGetLastErrorCache: *disableGetLastErrorCache,
+		ReadOnly:                 *readOnly,
+		DirectConnection:         *directConnection,
+		SlowMessageThreshold:     *slowMessageThreshold,
+		MaxMessageReadTime:       *maxMessageReadTime,
+		ClientWriteTimeout:       *clientWriteTimeout,
+		ServerKeepAliveInterval:  *serverKeepAliveInterval,
+		MaxConnections:           *maxConnections,
+		MaxConcurrentDials:       *maxConcurrentDials,
+		MaxConcurrentGetMore:     *maxConcurrentGetMore,
+		MaxPerClientConnections:  *maxPerClientConnections,
+		StickyClientSessions:     *stickyClientSessions,
+		AcceptConcurrency:        *acceptConcurrency,
+		AcceptDrainTimeout:       *acceptDrainTimeout,
+		ClientLinger:             *clientLinger,
+		ClientKeepAliveInterval:  *clientKeepAliveInterval,
+		ClientKeepAliveCount:     *clientKeepAliveCount,
+		MaxConnectionsPerSecond:  *maxConnectionsPerSecond,
+		ResolveInterval:          *resolveInterval,
+		StartupTimeout:           *startupTimeout,
+		RuntimeStatsInterval:     *runtimeStatsInterval,
+		WireDump:                 dvara.WireDump(*wireDump),
+		HostnameFallback:         dvara.HostnameFallback(*hostnameFallback),
+	}
+
+	if *databaseMaxConnections != "" {
+		limits, err := parseDatabaseMaxConnections(*databaseMaxConnections)
+		if err != nil {
+			return err
+		}
+		replicaSet.DatabaseMaxConnections = limits
+	}
+
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		replicaSet.AuditWriter = f
+	}
+
+	buildInfoRewriter := dvara.BuildInfoResponseRewriter{
+		BuildInfoOverride: *buildInfoOverride,
+	}
+
+	proxyQuery := dvara.ProxyQuery{
+		TailableCursorTimeout:         *tailableCursorTimeout,
+		DisableCompressionNegotiation: *disableCompressionNegotiation,
+		MaxQueryDocSize:               *maxQueryDocSize,
+		TagAppName:                    *tagAppName,
+		RestartOnStaleTopology:        *restartOnStaleTopology,
+		DirectConnection:              *directConnection,
+		MaxReplyDocs:                  *maxReplyDocs,
+		MaxReplyBytes:                 *maxReplyBytes,
+	}
+	if *deniedCommands != "" {
+		proxyQuery.DeniedCommands = strings.Split(*deniedCommands, ",")
+	}
+	if *allowedDatabases != "" {
+		proxyQuery.AllowedDatabases = strings.Split(*allowedDatabases, ",")
 	}
 
 	var statsClient stats.HookClient
 	var log stdLogger
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
 	var graph inject.Graph
-	err := graph.Provide(
+	err = graph.Provide(
 		&inject.Object{Value: &log},
 		&inject.Object{Value: &replicaSet},
+		&inject.Object{Value: &buildInfoRewriter},
+		&inject.Object{Value: &proxyQuery},
+		&inject.Object{
+			Value: &dvara.ReplicaSetStateCreator{
+				MaxConcurrentProbes:      *maxConcurrentProbes,
+				MaxConcurrentDiscoveries: *maxConcurrentDiscoveries,
+			},
+		},
 		&inject.Object{Value: &statsClient},
 	)
 	if err != nil {
 		return err
 	}
+
+	// A static mapping replaces the ReplicaSet as the ProxyMapper for the
+	// rewriters.
+	if *proxyMap != "" {
+		mapper, err := parseProxyMap(*proxyMap)
+		if err != nil {
+			return err
+		}
+		err = graph.Provide(
+			&inject.Object{Value: &dvara.IsMasterResponseRewriter{ProxyMapper: mapper}},
+			&inject.Object{Value: &dvara.ReplSetGetStatusResponseRewriter{ProxyMapper: mapper}},
+		)
+		if err != nil {
+			return err
+		}
+	}
 	if err := graph.Populate(); err != nil {
 		return err
 	}
 	objects := graph.Objects()
 
-	if err := startstop.Start(objects, &log); err != nil {
+	if err := startWithTimeout(objects, &log, *startupTimeout); err != nil {
 		return err
 	}
-	defer startstop.Stop(objects, &log)
+	if config, err := json.Marshal(replicaSet.Config()); err == nil {
+		log.Infof("started with config: %s", config)
+	}
+	var stopped bool
+	defer func() {
+		if !stopped {
+			startstop.Stop(objects, &log)
+		}
+	}()
 
 	ch := make(chan os.Signal, 2)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
-	<-ch
-	signal.Stop(ch)
+	signal.Notify(
+		ch,
+		syscall.SIGTERM,
+		syscall.SIGINT,
+		syscall.SIGHUP,
+		syscall.SIGUSR1,
+		syscall.SIGUSR2,
+	)
+	defer signal.Stop(ch)
+	handler := signalHandler{
+		ReplicaSet:      &replicaSet,
+		Log:             &log,
+		TunablesFile:    *tunablesFile,
+		ShutdownTimeout: *shutdownTimeout,
+	}
+	stopped, err = handler.loop(ch)
+	return err
+}
+
+// signalHandler applies the signals dvara receives while running.
+type signalHandler struct {
+	ReplicaSet      *dvara.ReplicaSet
+	Log             *stdLogger
+	TunablesFile    string
+	ShutdownTimeout time.Duration
+}
+
+// loop handles the signals until one asks dvara to exit. It returns true if it
+// stopped the ReplicaSet, along with the error stopping it.
+func (h *signalHandler) loop(ch <-chan os.Signal) (bool, error) {
+	for sig := range ch {
+		switch sig {
+		case syscall.SIGHUP:
+			if h.TunablesFile == "" {
+				h.Log.Info("ignoring SIGHUP since no tunables_file was given")
+				continue
+			}
+			if err := reloadTunables(h.ReplicaSet, h.Log, h.TunablesFile); err != nil {
+				h.Log.Errorf("failed to reload tunables: %s", err)
+			}
+		case syscall.SIGUSR1:
+			h.ReplicaSet.SetMaintenanceMode(true)
+		case syscall.SIGUSR2:
+			h.ReplicaSet.SetMaintenanceMode(false)
+		default:
+			if h.ShutdownTimeout > 0 {
+				return true, h.ReplicaSet.StopWithTimeout(h.ShutdownTimeout)
+			}
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
+// startWithTimeout starts the objects, failing if that takes longer than the
+// timeout when it's non zero. The start can't be interrupted, so on timeout it
+// is left to finish in the background while the process exits.
+func startWithTimeout(objects []*inject.Object, log startstop.Logger, timeout time.Duration) error {
+	if timeout <= 0 {
+		return startstop.Start(objects, log)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- startstop.Start(objects, log)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("dvara: startup did not complete within %s", timeout)
+	}
+}
+
+// reloadTunables applies the tunables in the given JSON file to the running
+// ReplicaSet and the log. Only the timeouts, wire_dump,
+// max_per_client_connections and log_level are reloadable, values missing
+// from the file are left unchanged.
+func reloadTunables(replicaSet *dvara.ReplicaSet, log *stdLogger, path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw struct {
+		MessageTimeout          string  `json:"message_timeout"`
+		ClientIdleTimeout       string  `json:"client_idle_timeout"`
+		GetLastErrorTimeout     string  `json:"get_last_error_timeout"`
+		WireDump                *string `json:"wire_dump"`
+		MaxPerClientConnections uint    `json:"max_per_client_connections"`
+		LogLevel                string  `json:"log_level"`
+	}
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return err
+	}
+	var level logLevel
+	if raw.LogLevel != "" {
+		if level, err = parseLogLevel(raw.LogLevel); err != nil {
+			return err
+		}
+	}
+
+	tunables := replicaSet.Tunables()
+	fields := []struct {
+		raw string
+		dst *time.Duration
+	}{
+		{raw.MessageTimeout, &tunables.MessageTimeout},
+		{raw.ClientIdleTimeout, &tunables.ClientIdleTimeout},
+		{raw.GetLastErrorTimeout, &tunables.GetLastErrorTimeout},
+	}
+	for _, f := range fields {
+		if f.raw == "" {
+			continue
+		}
+		if *f.dst, err = time.ParseDuration(f.raw); err != nil {
+			return err
+		}
+	}
+	if raw.WireDump != nil {
+		tunables.WireDump = dvara.WireDump(*raw.WireDump)
+	}
+	if err := replicaSet.SetTunables(tunables); err != nil {
+		return err
+	}
+	if raw.MaxPerClientConnections != 0 {
+		if err := replicaSet.SetMaxPerClientConnections(raw.MaxPerClientConnections); err != nil {
+			return err
+		}
+	}
+	if raw.LogLevel != "" {
+		log.Infof("setting log level %s", raw.LogLevel)
+		log.SetLevel(level)
+	}
 	return nil
 }
+
+// parseProxyMap parses a comma separated list of mongo=proxy address pairs.
+func parseProxyMap(s string) (dvara.StaticProxyMapper, error) {
+	mapper := make(dvara.StaticProxyMapper)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid proxy_map entry: %q", pair)
+		}
+		mapper[parts[0]] = parts[1]
+	}
+	return mapper, nil
+}
+
+// parseDatabaseMaxConnections parses a comma separated list of database=count
+// pairs.
+func parseDatabaseMaxConnections(s string) (map[string]uint, error) {
+	limits := make(map[string]uint)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid database_max_connections entry: %q", pair)
+		}
+		n, err := strconv.ParseUint(parts[1], 10, 0)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid database_max_connections entry: %q", pair)
+		}
+		limits[parts[0]] = uint(n)
+	}
+	return limits, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/dvara"
+	"github.com/facebookgo/inject"
+)
+
+// blockingStarter is started once release is closed.
+type blockingStarter struct {
+	release chan struct{}
+}
+
+func (s *blockingStarter) Start() error {
+	<-s.release
+	return nil
+}
+
+func TestStartWithTimeout(t *testing.T) {
+	t.Parallel()
+	s := &blockingStarter{release: make(chan struct{})}
+	defer close(s.release)
+	objects := []*inject.Object{{Value: s}}
+	const expected = "dvara: startup did not complete within 10ms"
+	err := startWithTimeout(objects, &stdLogger{}, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("did not get expected error, got: %v", err)
+	}
+}
+
+func TestStartWithTimeoutCompletes(t *testing.T) {
+	t.Parallel()
+	s := &blockingStarter{release: make(chan struct{})}
+	close(s.release)
+	objects := []*inject.Object{{Value: s}}
+	if err := startWithTimeout(objects, &stdLogger{}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignalHandlerReloadsTunables(t *testing.T) {
+	t.Parallel()
+	f, err := ioutil.TempFile("", "dvara-tunables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`{"message_timeout": "5s", "log_level": "warn"}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	log := &stdLogger{level: int32(logLevelError)}
+	replicaSet := &dvara.ReplicaSet{Log: log, MessageTimeout: time.Minute}
+	h := signalHandler{ReplicaSet: replicaSet, Log: log, TunablesFile: f.Name()}
+	ch := make(chan os.Signal, 2)
+	ch <- syscall.SIGHUP
+	ch <- syscall.SIGTERM
+	stopped, err := h.loop(ch)
+	if stopped || err != nil {
+		t.Fatalf("unexpected stop %v with error %v", stopped, err)
+	}
+	if timeout := replicaSet.Tunables().MessageTimeout; timeout != 5*time.Second {
+		t.Fatalf("expected the reloaded message timeout got %s", timeout)
+	}
+	if log.enabled(logLevelInfo) || !log.enabled(logLevelWarn) {
+		t.Fatal("expected the reloaded log level to be warn")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	t.Parallel()
+	if level, err := parseLogLevel("info"); err != nil || level != logLevelInfo {
+		t.Fatalf("unexpected level %d with error %v", level, err)
+	}
+	const expected = `unknown log level "loud"`
+	if _, err := parseLogLevel("loud"); err == nil || err.Error() != expected {
+		t.Fatalf("did not get expected error, got: %v", err)
+	}
+}
@@ -102,6 +102,7 @@ func newHarnessInternal(url string, s stopper, t testing.TB) *Harness {
 	err := graph.Provide(
 		&inject.Object{Value: &log},
 		&inject.Object{Value: &replicaSet},
+		&inject.Object{Value: &ReplicaSetStateCreator{}},
 		&inject.Object{Value: &stats.HookClient{}},
 	)
 	ensure.Nil(t, err)
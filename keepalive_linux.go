@@ -0,0 +1,39 @@
+package dvara
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// setKeepAliveProbes sets the time between keep-alive probes and the number of
+// unanswered probes before the connection is dropped. Zero values are left at
+// the system default.
+func setKeepAliveProbes(c *net.TCPConn, interval time.Duration, count int) error {
+	if interval <= 0 && count <= 0 {
+		return nil
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if interval > 0 {
+			// The interval is in whole seconds, rounded up so it's never zero.
+			secs := int((interval + time.Second - 1) / time.Second)
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+			if serr != nil {
+				return
+			}
+		}
+		if count > 0 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -0,0 +1,42 @@
+package dvara
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestSetKeepAliveProbes(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer listener.Close()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	conn := c.(*net.TCPConn)
+	ensure.Nil(t, setKeepAlive(conn, keepAliveConfig{
+		Idle:     time.Minute,
+		Interval: 1500 * time.Millisecond,
+		Count:    3,
+	}))
+	raw, err := conn.SyscallConn()
+	ensure.Nil(t, err)
+	ensure.Nil(t, raw.Control(func(fd uintptr) {
+		for opt, expected := range map[int]int{
+			syscall.TCP_KEEPIDLE:  60,
+			syscall.TCP_KEEPINTVL: 2,
+			syscall.TCP_KEEPCNT:   3,
+		} {
+			actual, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+			ensure.Nil(t, err)
+			if actual != expected {
+				t.Fatalf("expected option %d to be %d got %d", opt, expected, actual)
+			}
+		}
+	}))
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package dvara
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errKeepAliveProbes = errors.New(
+	"dvara: ClientKeepAliveInterval and ClientKeepAliveCount are only supported on linux")
+
+// setKeepAliveProbes fails if the time between keep-alive probes or the number
+// of probes is set, since they can't be on this platform.
+func setKeepAliveProbes(c *net.TCPConn, interval time.Duration, count int) error {
+	if interval > 0 || count > 0 {
+		return errKeepAliveProbes
+	}
+	return nil
+}
@@ -1,15 +1,42 @@
 package dvara
 
 import (
+	"bytes"
+	"compress/zlib"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"net"
+	"sync"
 )
 
 var (
 	errWrite = errors.New("incorrect number of bytes written")
 )
 
+// unsupportedCompressorError is returned for messages compressed with a
+// compressor the proxy doesn't implement.
+type unsupportedCompressorError struct {
+	CompressorID uint8
+}
+
+func (e *unsupportedCompressorError) Error() string {
+	return fmt.Sprintf("unsupported compressor %d", e.CompressorID)
+}
+
+// unexpectedReplyOpCodeError is returned when the server replies with a
+// message that isn't an OpReply. The connection is out of sync at that point.
+type unexpectedReplyOpCodeError struct {
+	Expected OpCode
+	OpCode   OpCode
+}
+
+func (e *unexpectedReplyOpCodeError) Error() string {
+	return fmt.Sprintf("dvara: expected op %s, got %s", e.Expected, e.OpCode)
+}
+
 // Look at http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/ for the protocol.
 
 // OpCode allow identifying the type of operation:
@@ -40,18 +67,24 @@ func (c OpCode) String() string {
 		return "DELETE"
 	case OpKillCursors:
 		return "KILL_CURSORS"
+	case OpCompressed:
+		return "COMPRESSED"
+	case OpMsg:
+		return "MSG"
 	}
 }
 
 // IsMutation tells us if the operation will mutate data. These operations can
-// be followed up by a getLastErr operation.
+// be followed up by a getLastErr operation. OpMsg writes report their own
+// result, so they aren't considered mutations.
 func (c OpCode) IsMutation() bool {
 	return c == OpInsert || c == OpUpdate || c == OpDelete
 }
 
 // HasResponse tells us if the operation will have a response from the server.
+// An OpMsg has none if it has the opMsgMoreToCome flag set.
 func (c OpCode) HasResponse() bool {
-	return c == OpQuery || c == OpGetMore
+	return c == OpQuery || c == OpGetMore || c == OpMsg
 }
 
 // The full set of known request op codes:
@@ -66,8 +99,25 @@ const (
 	OpGetMore     = OpCode(2005)
 	OpDelete      = OpCode(2006)
 	OpKillCursors = OpCode(2007)
+	OpCompressed  = OpCode(2012)
+	OpMsg         = OpCode(2013)
+)
+
+// The compressors that may be used in an OpCompressed message:
+// https://github.com/mongodb/specifications/blob/master/source/compression/OP_COMPRESSED.rst
+const (
+	compressorNoop = uint8(0)
+	compressorZlib = uint8(2)
 )
 
+// maxMessageSize is the largest message mongo sends or accepts. It bounds the
+// buffers allocated for messages whose sizes come from the wire.
+const maxMessageSize = 48000000
+
+// compressedPrefixLen is the length of the originalOpcode, uncompressedSize
+// and compressorId fields that follow the header in an OpCompressed message.
+const compressedPrefixLen = 9
+
 // messageHeader is the mongo MessageHeader
 type messageHeader struct {
 	// MessageLength is the total message size, including this header
@@ -78,6 +128,12 @@ type messageHeader struct {
 	ResponseTo int32
 	// OpCode is the request type, see consts above.
 	OpCode OpCode
+
+	// compressed is true if this header was decompressed from an OpCompressed
+	// message using the compressorID compressor. These are not part of the wire
+	// header.
+	compressed   bool
+	compressorID uint8
 }
 
 // ToWire converts the messageHeader to the wire protocol
@@ -134,19 +190,615 @@ func readHeader(r io.Reader) (*messageHeader, error) {
 	return &h, nil
 }
 
-// copyMessage copies reads & writes an entire message.
+// copyMessage copies reads & writes an entire message. The entire message is
+// read even if writing fails, leaving r at a message boundary.
 func copyMessage(w io.Writer, r io.Reader) error {
 	h, err := readHeader(r)
 	if err != nil {
 		return err
 	}
+	return copyMessageBody(w, r, h, nil)
+}
+
+// copyReplyMessage copies a server reply like copyMessage. If the reply isn't
+// an OpReply, possibly compressed, an unexpectedReplyOpCodeError is returned
+// before anything is written, and the rest of the reply is left unread.
+func copyReplyMessage(w io.Writer, r io.Reader) error {
+	h, prefix, err := readReplyHeader(r, OpReply)
+	if err != nil {
+		return err
+	}
+	return copyMessageBody(w, r, h, prefix)
+}
+
+// readReplyHeader reads the header of a server reply, checking it has the
+// expected opcode. The original opcode of an OpCompressed reply is checked,
+// and returned as the prefix of the body that was read along with the header.
+func readReplyHeader(r io.Reader, expected OpCode) (*messageHeader, []byte, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.OpCode == expected {
+		return h, nil, nil
+	}
+	if h.OpCode != OpCompressed {
+		return nil, nil, &unexpectedReplyOpCodeError{Expected: expected, OpCode: h.OpCode}
+	}
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, err
+	}
+	if op := OpCode(getInt32(prefix, 0)); op != expected {
+		return nil, nil, &unexpectedReplyOpCodeError{Expected: expected, OpCode: op}
+	}
+	return h, prefix, nil
+}
+
+// copyMessageBody writes the header and the prefix of the body that was
+// already read, and copies the rest of the message. The entire message is
+// read even if writing fails.
+func copyMessageBody(w io.Writer, r io.Reader, h *messageHeader, prefix []byte) error {
+	dw := &drainWriter{w: w}
+	if err := h.WriteTo(dw); err != nil {
+		return err
+	}
+	dw.Write(prefix)
+	if _, err := io.CopyN(dw, r, int64(h.MessageLength-headerLen)-int64(len(prefix))); err != nil {
+		return err
+	}
+	return dw.err
+}
+
+// copyReplyLimited copies a reply like copyMessage, unless it's an OpReply
+// with more than maxDocs documents or maxBytes of documents, zero meaning no
+// limit. Then only the leading documents within the limits are written, and
+// the reply is marked as the end of its cursor. It returns if the reply was
+// truncated and the ID of the cursor left open on the server, if any. The
+// entire reply is read even if writing fails, unless it isn't a reply at all
+// in which case an unexpectedReplyOpCodeError is returned like
+// copyReplyMessage.
+func copyReplyLimited(w io.Writer, r io.Reader, maxDocs, maxBytes int) (bool, []byte, error) {
+	h, compressedPrefix, err := readReplyHeader(r, OpReply)
+	if err != nil {
+		return false, nil, err
+	}
+	if h.OpCode != OpReply {
+		return false, nil, copyMessageBody(w, r, h, compressedPrefix)
+	}
+	dw := &drainWriter{w: w}
+
+	var prefix replyPrefix
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return false, nil, err
+	}
+	numberReturned := int(getInt32(prefix[:], 16))
+	docsLen := int(h.MessageLength) - headerLen - len(prefix)
+	if (maxDocs == 0 || numberReturned <= maxDocs) && (maxBytes == 0 || docsLen <= maxBytes) {
+		if err := h.WriteTo(dw); err != nil {
+			return false, nil, err
+		}
+		dw.Write(prefix[:])
+		if _, err := io.CopyN(dw, r, int64(docsLen)); err != nil {
+			return false, nil, err
+		}
+		return false, nil, dw.err
+	}
+
+	docs := io.LimitReader(r, int64(docsLen))
+	var kept [][]byte
+	keptLen := 0
+	for i := 0; i < numberReturned; i++ {
+		doc, err := readDocument(docs)
+		if err != nil {
+			return false, nil, err
+		}
+		if len(kept) == i &&
+			(maxDocs == 0 || len(kept) < maxDocs) &&
+			(maxBytes == 0 || keptLen+len(doc) <= maxBytes) {
+			kept = append(kept, doc)
+			keptLen += len(doc)
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, docs); err != nil {
+		return false, nil, err
+	}
+
+	var cursorID []byte
+	if !bytes.Equal(prefix[4:12], make([]byte, 8)) {
+		cursorID = append(cursorID, prefix[4:12]...)
+		copy(prefix[4:12], make([]byte, 8))
+	}
+	setInt32(prefix[:], 16, int32(len(kept)))
+	h.MessageLength = int32(headerLen + len(prefix) + keptLen)
+	parts := append([][]byte{h.ToWire(), prefix[:]}, kept...)
+	buffers := net.Buffers(parts)
+	_, err = buffers.WriteTo(w)
+	return true, cursorID, err
+}
+
+// writeKillCursors writes an OpKillCursors message for the cursor.
+func writeKillCursors(w io.Writer, cursorID []byte) error {
+	body := make([]byte, 8, 8+len(cursorID))
+	setInt32(body, 4, 1) // numberOfCursorIDs
+	body = append(body, cursorID...)
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(body)),
+		OpCode:        OpKillCursors,
+	}
 	if err := h.WriteTo(w); err != nil {
 		return err
 	}
-	_, err = io.CopyN(w, r, int64(h.MessageLength-headerLen))
+	_, err := w.Write(body)
 	return err
 }
 
+// drainWriter records the first error writing to w and discards everything
+// written after it.
+type drainWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *drainWriter) Write(b []byte) (int, error) {
+	if d.err == nil {
+		n, err := d.w.Write(b)
+		if err == nil && n != len(b) {
+			err = errWrite
+		}
+		d.err = err
+	}
+	return len(b), nil
+}
+
+// decompressMessage reads the body of an OpCompressed message described by h
+// and returns the header and body of the original message.
+func decompressMessage(h *messageHeader, r io.Reader) (*messageHeader, []byte, error) {
+	var prefix [compressedPrefixLen]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, nil, err
+	}
+	originalOpCode := OpCode(getInt32(prefix[:], 0))
+	uncompressedSize := getInt32(prefix[:], 4)
+	compressorID := prefix[8]
+
+	compressedLen := int64(h.MessageLength) - headerLen - compressedPrefixLen
+	if compressedLen < 0 || compressedLen > maxMessageSize ||
+		uncompressedSize < 0 || uncompressedSize > maxMessageSize-headerLen {
+		return nil, nil, fmt.Errorf(
+			"invalid compressed message of %d bytes with %d uncompressed bytes",
+			h.MessageLength,
+			uncompressedSize,
+		)
+	}
+	compressed := make([]byte, compressedLen)
+	if _, err := io.ReadFull(r, compressed); err != nil {
+		return nil, nil, err
+	}
+
+	var body []byte
+	switch compressorID {
+	default:
+		return nil, nil, &unsupportedCompressorError{CompressorID: compressorID}
+	case compressorNoop:
+		body = compressed
+	case compressorZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, nil, err
+		}
+		// Reading a byte past the expected size is enough to tell the body is
+		// too large, without inflating all of it.
+		if body, err = ioutil.ReadAll(io.LimitReader(zr, int64(uncompressedSize)+1)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if int32(len(body)) != uncompressedSize {
+		return nil, nil, fmt.Errorf(
+			"expected %d uncompressed bytes, got %d",
+			uncompressedSize,
+			len(body),
+		)
+	}
+
+	return &messageHeader{
+		MessageLength: headerLen + uncompressedSize,
+		RequestID:     h.RequestID,
+		ResponseTo:    h.ResponseTo,
+		OpCode:        originalOpCode,
+		compressed:    true,
+		compressorID:  compressorID,
+	}, body, nil
+}
+
+// compressMessage compresses the given message body using the compressor the
+// header was originally decompressed with, and returns the OpCompressed
+// message parts.
+func compressMessage(h *messageHeader, body []byte) ([][]byte, error) {
+	var compressed []byte
+	switch h.compressorID {
+	default:
+		return nil, fmt.Errorf("unsupported compressor %d", h.compressorID)
+	case compressorNoop:
+		compressed = body
+	case compressorZlib:
+		var b bytes.Buffer
+		zw := zlib.NewWriter(&b)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		compressed = b.Bytes()
+	}
+
+	var prefix [compressedPrefixLen]byte
+	setInt32(prefix[:], 0, int32(h.OpCode))
+	setInt32(prefix[:], 4, int32(len(body)))
+	prefix[8] = h.compressorID
+	ch := messageHeader{
+		MessageLength: int32(headerLen + len(prefix) + len(compressed)),
+		RequestID:     h.RequestID,
+		ResponseTo:    h.ResponseTo,
+		OpCode:        OpCompressed,
+	}
+	return [][]byte{ch.ToWire(), prefix[:], compressed}, nil
+}
+
+// The OpMsg flags:
+// https://github.com/mongodb/specifications/blob/master/source/message/OP_MSG.rst
+const (
+	opMsgChecksumPresent = 1 << 0
+	opMsgMoreToCome      = 1 << 1
+	opMsgExhaustAllowed  = 1 << 16
+)
+
+// The OpMsg section kinds.
+const (
+	opMsgSectionBody     = byte(0)
+	opMsgSectionSequence = byte(1)
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// opMsgSection is a section of an OpMsg. The body section has a single
+// document, while a document sequence has an identifier and any number of
+// documents.
+type opMsgSection struct {
+	Kind       byte
+	Identifier string
+	Documents  [][]byte
+}
+
+// opMsg is a parsed OpMsg. The checksum isn't kept, it's computed again when
+// the message is written if the opMsgChecksumPresent flag is set.
+type opMsg struct {
+	Flags    uint32
+	Sections []opMsgSection
+}
+
+// readOpMsg reads the body of the OpMsg described by h.
+func readOpMsg(h *messageHeader, r io.Reader) (*opMsg, error) {
+	n := int64(h.MessageLength) - headerLen
+	if n < 4 || n > maxMessageSize {
+		return nil, fmt.Errorf("invalid OP_MSG: %s", h)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return parseOpMsg(b)
+}
+
+// opMsgHead is the start of an OpMsg up to the end of its body section, which
+// drivers send first. It's enough to find the command without buffering the
+// document sequences that may follow, which can be large.
+type opMsgHead struct {
+	Flags uint32
+	Body  []byte
+
+	// raw is the part of the message read after the header.
+	raw []byte
+}
+
+// readOpMsgHead reads the OpMsg described by h up to the end of its body
+// section. If the body isn't the first section the entire message is read.
+func readOpMsgHead(h *messageHeader, r io.Reader) (*opMsgHead, error) {
+	n := int(h.MessageLength) - headerLen
+	if n < 5 || n > maxMessageSize {
+		return nil, fmt.Errorf("invalid OP_MSG: %s", h)
+	}
+	raw := make([]byte, 5, 9)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	head := &opMsgHead{Flags: uint32(getInt32(raw, 0))}
+
+	if raw[4] != opMsgSectionBody {
+		b := make([]byte, n)
+		copy(b, raw)
+		if _, err := io.ReadFull(r, b[len(raw):]); err != nil {
+			return nil, err
+		}
+		m, err := parseOpMsg(b)
+		if err != nil {
+			return nil, err
+		}
+		head.Body = m.Body()
+		head.raw = b
+		return head, nil
+	}
+
+	if n < 9 {
+		return nil, errors.New("invalid OP_MSG: truncated document")
+	}
+	raw = raw[:9]
+	if _, err := io.ReadFull(r, raw[5:]); err != nil {
+		return nil, err
+	}
+	size := int(getInt32(raw, 5))
+	if size < 5 || size > n-5 {
+		return nil, fmt.Errorf("invalid OP_MSG: document of %d bytes", size)
+	}
+	raw = append(raw, make([]byte, size-4)...)
+	if _, err := io.ReadFull(r, raw[9:]); err != nil {
+		return nil, err
+	}
+	head.Body = raw[5:]
+	head.raw = raw
+	return head, nil
+}
+
+// parseOpMsg parses the body of an OpMsg. It must have exactly one body
+// section.
+func parseOpMsg(b []byte) (*opMsg, error) {
+	m := &opMsg{Flags: uint32(getInt32(b, 0))}
+	b = b[4:]
+	if m.Flags&opMsgChecksumPresent != 0 {
+		if len(b) < 4 {
+			return nil, errors.New("invalid OP_MSG: missing checksum")
+		}
+		b = b[:len(b)-4]
+	}
+	bodies := 0
+	for len(b) > 0 {
+		s := opMsgSection{Kind: b[0]}
+		b = b[1:]
+		switch s.Kind {
+		default:
+			return nil, fmt.Errorf("invalid OP_MSG: unsupported section kind %d", s.Kind)
+		case opMsgSectionBody:
+			doc, rest, err := splitDocument(b)
+			if err != nil {
+				return nil, err
+			}
+			s.Documents = [][]byte{doc}
+			b = rest
+			bodies++
+		case opMsgSectionSequence:
+			if len(b) < 4 {
+				return nil, errors.New("invalid OP_MSG: truncated document sequence")
+			}
+			size := int(getInt32(b, 0))
+			if size < 4 || size > len(b) {
+				return nil, fmt.Errorf("invalid OP_MSG: document sequence of %d bytes", size)
+			}
+			seq := b[4:size]
+			b = b[size:]
+			end := bytes.IndexByte(seq, x00)
+			if end < 0 {
+				return nil, errors.New("invalid OP_MSG: unterminated sequence identifier")
+			}
+			s.Identifier = string(seq[:end])
+			seq = seq[end+1:]
+			for len(seq) > 0 {
+				doc, rest, err := splitDocument(seq)
+				if err != nil {
+					return nil, err
+				}
+				s.Documents = append(s.Documents, doc)
+				seq = rest
+			}
+		}
+		m.Sections = append(m.Sections, s)
+	}
+	if bodies != 1 {
+		return nil, fmt.Errorf("invalid OP_MSG: expected 1 body section, got %d", bodies)
+	}
+	return m, nil
+}
+
+// splitDocument splits the leading document off b.
+func splitDocument(b []byte) ([]byte, []byte, error) {
+	if len(b) < 5 {
+		return nil, nil, errors.New("invalid OP_MSG: truncated document")
+	}
+	size := int(getInt32(b, 0))
+	if size < 5 || size > len(b) {
+		return nil, nil, fmt.Errorf("invalid OP_MSG: document of %d bytes", size)
+	}
+	return b[:size], b[size:], nil
+}
+
+// Body returns the document of the body section.
+func (m *opMsg) Body() []byte {
+	for _, s := range m.Sections {
+		if s.Kind == opMsgSectionBody {
+			return s.Documents[0]
+		}
+	}
+	return nil
+}
+
+// SetBody replaces the document of the body section.
+func (m *opMsg) SetBody(doc []byte) {
+	for i := range m.Sections {
+		if m.Sections[i].Kind == opMsgSectionBody {
+			m.Sections[i].Documents = [][]byte{doc}
+		}
+	}
+}
+
+// Marshal returns the wire message, with the IDs and compression from h.
+func (m *opMsg) Marshal(h *messageHeader) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, headerLen))
+	var i32 [4]byte
+	setInt32(i32[:], 0, int32(m.Flags))
+	b.Write(i32[:])
+	for _, s := range m.Sections {
+		b.WriteByte(s.Kind)
+		if s.Kind == opMsgSectionBody {
+			b.Write(s.Documents[0])
+			continue
+		}
+		size := 4 + len(s.Identifier) + 1
+		for _, doc := range s.Documents {
+			size += len(doc)
+		}
+		setInt32(i32[:], 0, int32(size))
+		b.Write(i32[:])
+		b.WriteString(s.Identifier)
+		b.WriteByte(x00)
+		for _, doc := range s.Documents {
+			b.Write(doc)
+		}
+	}
+	if m.Flags&opMsgChecksumPresent != 0 {
+		b.Write(i32[:])
+	}
+
+	msg := b.Bytes()
+	mh := *h
+	mh.MessageLength = int32(len(msg))
+	mh.OpCode = OpMsg
+	copy(msg, mh.ToWire())
+	if m.Flags&opMsgChecksumPresent != 0 {
+		sum := crc32.Checksum(msg[:len(msg)-4], crc32c)
+		setInt32(msg, len(msg)-4, int32(sum))
+	}
+	return msg
+}
+
+// writeOpMsg writes the OpMsg with the IDs from h, compressed if h was
+// decompressed.
+func writeOpMsg(w io.Writer, h *messageHeader, m *opMsg) error {
+	msg := m.Marshal(h)
+	parts := [][]byte{msg}
+	if h.compressed {
+		ch := *h
+		ch.OpCode = OpMsg
+		var err error
+		if parts, err = compressMessage(&ch, msg[headerLen:]); err != nil {
+			return err
+		}
+	}
+	buffers := net.Buffers(parts)
+	if _, err := buffers.WriteTo(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readOpMsgReply reads an OpMsg reply from the server, decompressing it if
+// needed. The header keeps the compressor, so writeOpMsg compresses the reply
+// again.
+func readOpMsgReply(r io.Reader) (*messageHeader, *opMsg, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.OpCode == OpCompressed {
+		var body []byte
+		if h, body, err = decompressMessage(h, r); err != nil {
+			return nil, nil, err
+		}
+		r = bytes.NewReader(body)
+	}
+	if h.OpCode != OpMsg {
+		return nil, nil, &unexpectedReplyOpCodeError{Expected: OpMsg, OpCode: h.OpCode}
+	}
+	m, err := readOpMsg(h, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, m, nil
+}
+
+// copyOpMsgReplies copies OpMsg replies until one doesn't have the
+// opMsgMoreToCome flag set, which the server sets while it has more exhaust
+// replies to send. Compressed replies are decompressed to check their flags.
+func copyOpMsgReplies(w io.Writer, r io.Reader) error {
+	for {
+		h, prefix, err := readReplyHeader(r, OpMsg)
+		if err != nil {
+			return err
+		}
+		if h.OpCode == OpCompressed {
+			more, err := copyCompressedOpMsg(w, r, h, prefix)
+			if err != nil || !more {
+				return err
+			}
+			continue
+		}
+		prefix = make([]byte, 4)
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return err
+		}
+		if err := copyMessageBody(w, r, h, prefix); err != nil {
+			return err
+		}
+		if uint32(getInt32(prefix, 0))&opMsgMoreToCome == 0 {
+			return nil
+		}
+	}
+}
+
+// copyCompressedOpMsg copies a compressed OpMsg reply, of which prefix was
+// already read, and returns if it has the opMsgMoreToCome flag set. A reply
+// with a compressor the proxy doesn't implement is still copied, but an
+// unsupportedCompressorError is returned since the end of the replies can't be
+// found.
+func copyCompressedOpMsg(w io.Writer, r io.Reader, h *messageHeader, prefix []byte) (bool, error) {
+	n := int64(h.MessageLength) - headerLen
+	if n < compressedPrefixLen || n > maxMessageSize {
+		return false, fmt.Errorf("invalid compressed OP_MSG: %s", h)
+	}
+	raw := make([]byte, n)
+	copy(raw, prefix)
+	if _, err := io.ReadFull(r, raw[len(prefix):]); err != nil {
+		return false, err
+	}
+	_, body, decompressErr := decompressMessage(h, bytes.NewReader(raw))
+	if _, ok := decompressErr.(*unsupportedCompressorError); decompressErr != nil && !ok {
+		return false, decompressErr
+	}
+	if err := copyMessageBody(w, bytes.NewReader(raw), h, nil); err != nil {
+		return false, err
+	}
+	if decompressErr != nil {
+		return false, decompressErr
+	}
+	if len(body) < 4 {
+		return false, fmt.Errorf("invalid compressed OP_MSG: %s", h)
+	}
+	return uint32(getInt32(body, 0))&opMsgMoreToCome != 0, nil
+}
+
+// commandName returns the name of the first element of the document, which
+// is the command name for command documents.
+func commandName(doc []byte) string {
+	if len(doc) < 6 {
+		return ""
+	}
+	name := doc[5:]
+	if end := bytes.IndexByte(name, x00); end >= 0 {
+		return string(name[:end])
+	}
+	return ""
+}
+
 // readDocument read an entire BSON document. This document can be used with
 // bson.Unmarshal.
 func readDocument(r io.Reader) ([]byte, error) {
@@ -163,6 +815,63 @@ func readDocument(r io.Reader) ([]byte, error) {
 	return doc, nil
 }
 
+// docBuffer is a reusable buffer for reading documents.
+type docBuffer struct {
+	b []byte
+}
+
+// maxPooledDocBuffer is the largest buffer kept for reuse, so an occasional
+// huge document doesn't stay pinned in memory.
+const maxPooledDocBuffer = 64 << 10
+
+var docBuffers = sync.Pool{
+	New: func() interface{} {
+		return &docBuffer{b: make([]byte, 0, 1024)}
+	},
+}
+
+// getDocBuffer returns a buffer from the pool.
+func getDocBuffer() *docBuffer {
+	return docBuffers.Get().(*docBuffer)
+}
+
+// putDocBuffer returns the buffer to the pool. Nothing may reference it
+// afterwards.
+func putDocBuffer(d *docBuffer) {
+	if cap(d.b) > maxPooledDocBuffer {
+		return
+	}
+	d.b = d.b[:0]
+	docBuffers.Put(d)
+}
+
+// readDocumentInto reads an entire BSON document like readDocument, reusing
+// buf if it's large enough. A size larger than any message is an error rather
+// than an allocation.
+func readDocumentInto(r io.Reader, buf []byte) ([]byte, error) {
+	if cap(buf) < 4 {
+		buf = make([]byte, 4)
+	}
+	buf = buf[:4]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	size := int(getInt32(buf, 0))
+	if size < 5 || size > maxMessageSize {
+		return nil, fmt.Errorf("invalid document size %d", size)
+	}
+	if size > cap(buf) {
+		doc := make([]byte, size)
+		copy(doc, buf)
+		buf = doc
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(r, buf[4:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 const x00 = byte(0)
 
 // readCString reads a null turminated string as defined by BSON from the
@@ -2,9 +2,15 @@ package dvara
 
 import (
 	"bytes"
+	"compress/zlib"
 	"errors"
+	"hash/crc32"
 	"io"
+	"strings"
 	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type testReader struct {
@@ -35,6 +41,7 @@ func TestOpStrings(t *testing.T) {
 		{OpGetMore, "GET_MORE"},
 		{OpDelete, "DELETE"},
 		{OpKillCursors, "KILL_CURSORS"},
+		{OpCompressed, "COMPRESSED"},
 	}
 	for _, c := range cases {
 		if c.OpCode.String() != c.String {
@@ -169,3 +176,460 @@ func TestReadCString(t *testing.T) {
 		}
 	}
 }
+
+func TestDecompressMessageErrors(t *testing.T) {
+	t.Parallel()
+	prefix := func(size int32, compressorID uint8) []byte {
+		var b [compressedPrefixLen]byte
+		setInt32(b[:], 0, int32(OpReply))
+		setInt32(b[:], 4, size)
+		b[8] = compressorID
+		return b[:]
+	}
+	var bomb bytes.Buffer
+	zw := zlib.NewWriter(&bomb)
+	_, err := zw.Write(make([]byte, 1<<20))
+	ensure.Nil(t, err)
+	ensure.Nil(t, zw.Close())
+	cases := []struct {
+		Name   string
+		Data   []byte
+		Length int32 // the message length if not that of the data
+		Error  string
+	}{
+		{
+			Name:  "EOF before prefix",
+			Data:  []byte{1, 0},
+			Error: "unexpected EOF",
+		},
+		{
+			Name:  "unknown compressor",
+			Data:  prefix(0, 42),
+			Error: "unsupported compressor 42",
+		},
+		{
+			Name:  "wrong uncompressed size",
+			Data:  append(prefix(3, compressorNoop), 1, 2),
+			Error: "expected 3 uncompressed bytes, got 2",
+		},
+		{
+			Name:  "larger than the uncompressed size",
+			Data:  append(prefix(10, compressorZlib), bomb.Bytes()...),
+			Error: "expected 10 uncompressed bytes, got 11",
+		},
+		{
+			Name:  "uncompressed size too large",
+			Data:  prefix(maxMessageSize, compressorZlib),
+			Error: "invalid compressed message of 25 bytes with 48000000 uncompressed bytes",
+		},
+		{
+			Name:  "negative uncompressed size",
+			Data:  prefix(-1, compressorZlib),
+			Error: "invalid compressed message of 25 bytes with -1 uncompressed bytes",
+		},
+		{
+			Name:   "message too large",
+			Data:   prefix(10, compressorZlib),
+			Length: 1 << 30,
+			Error:  "invalid compressed message of 1073741824 bytes with 10 uncompressed bytes",
+		},
+	}
+	for _, c := range cases {
+		h := &messageHeader{
+			OpCode:        OpCompressed,
+			MessageLength: int32(headerLen + len(c.Data)),
+		}
+		if c.Length != 0 {
+			h.MessageLength = c.Length
+		}
+		_, _, err := decompressMessage(h, bytes.NewReader(c.Data))
+		if err == nil || err.Error() != c.Error {
+			t.Fatalf("did not get expected error for case %s instead got %s", c.Name, err)
+		}
+	}
+}
+
+// fakeReply returns an OpReply with the documents for the cursor.
+func fakeReply(t testing.TB, cursorID byte, docs ...interface{}) []byte {
+	prefix := make([]byte, 20)
+	prefix[4] = cursorID
+	setInt32(prefix, 16, int32(len(docs)))
+	b := prefix
+	for _, d := range docs {
+		doc, err := bson.Marshal(d)
+		ensure.Nil(t, err)
+		b = append(b, doc...)
+	}
+	h := messageHeader{OpCode: OpReply, MessageLength: int32(headerLen + len(b))}
+	return append(h.ToWire(), b...)
+}
+
+func TestCopyReplyMessage(t *testing.T) {
+	t.Parallel()
+	reply := fakeReply(t, 0, bson.M{"ok": 1})
+	compress := func(op OpCode) []byte {
+		h := &messageHeader{OpCode: op, compressorID: compressorNoop}
+		parts, err := compressMessage(h, reply[headerLen:])
+		ensure.Nil(t, err)
+		return bytes.Join(parts, nil)
+	}
+	cases := []struct {
+		Name   string
+		Reply  []byte
+		OpCode OpCode
+	}{
+		{Name: "reply", Reply: reply},
+		{Name: "compressed reply", Reply: compress(OpReply)},
+		{
+			Name:   "message",
+			Reply:  append((&messageHeader{OpCode: OpMessage, MessageLength: headerLen}).ToWire(), reply...),
+			OpCode: OpMessage,
+		},
+		{Name: "compressed query", Reply: compress(OpQuery), OpCode: OpQuery},
+	}
+	for _, c := range cases {
+		var w bytes.Buffer
+		err := copyReplyMessage(&w, bytes.NewReader(c.Reply))
+		if c.OpCode == 0 {
+			ensure.Nil(t, err)
+			if !bytes.Equal(w.Bytes(), c.Reply) {
+				t.Fatalf("%s: expected %v got %v", c.Name, c.Reply, w.Bytes())
+			}
+			continue
+		}
+		ue, ok := err.(*unexpectedReplyOpCodeError)
+		if !ok || ue.OpCode != c.OpCode {
+			t.Fatalf("%s: expected unexpected opcode %s got %v", c.Name, c.OpCode, err)
+		}
+		if w.Len() != 0 {
+			t.Fatalf("%s: unexpected reply was written: %v", c.Name, w.Bytes())
+		}
+	}
+}
+
+func TestCopyReplyLimited(t *testing.T) {
+	t.Parallel()
+	docs := []interface{}{bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3}}
+	docLen := 14 // each of the documents above
+	cases := []struct {
+		Name      string
+		Reply     []byte
+		MaxDocs   int
+		MaxBytes  int
+		Expected  []byte
+		Truncated bool
+		CursorID  []byte
+	}{
+		{
+			Name:     "within limits",
+			Reply:    fakeReply(t, 7, docs...),
+			MaxDocs:  3,
+			MaxBytes: 3 * docLen,
+			Expected: fakeReply(t, 7, docs...),
+		},
+		{
+			Name:      "too many documents",
+			Reply:     fakeReply(t, 7, docs...),
+			MaxDocs:   2,
+			Expected:  fakeReply(t, 0, docs[:2]...),
+			Truncated: true,
+			CursorID:  []byte{7, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			Name:      "too many bytes",
+			Reply:     fakeReply(t, 7, docs...),
+			MaxBytes:  docLen,
+			Expected:  fakeReply(t, 0, docs[:1]...),
+			Truncated: true,
+			CursorID:  []byte{7, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			Name:      "final batch",
+			Reply:     fakeReply(t, 0, docs...),
+			MaxBytes:  docLen - 1,
+			Expected:  fakeReply(t, 0),
+			Truncated: true,
+		},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		r := bytes.NewReader(c.Reply)
+		truncated, cursorID, err := copyReplyLimited(&out, r, c.MaxDocs, c.MaxBytes)
+		ensure.Nil(t, err)
+		if truncated != c.Truncated || !bytes.Equal(cursorID, c.CursorID) {
+			t.Fatalf("%s: expected truncated %v cursor %v got %v %v", c.Name, c.Truncated, c.CursorID, truncated, cursorID)
+		}
+		if !bytes.Equal(out.Bytes(), c.Expected) {
+			t.Fatalf("%s: expected reply %v got %v", c.Name, c.Expected, out.Bytes())
+		}
+		if r.Len() != 0 {
+			t.Fatalf("%s: %d bytes of the reply were not read", c.Name, r.Len())
+		}
+	}
+}
+
+func TestReadDocumentInto(t *testing.T) {
+	t.Parallel()
+	small, err := bson.Marshal(bson.M{"a": 1})
+	ensure.Nil(t, err)
+	large, err := bson.Marshal(bson.M{"a": strings.Repeat("x", 100)})
+	ensure.Nil(t, err)
+
+	buf := make([]byte, 0, 64)
+	doc, err := readDocumentInto(bytes.NewReader(small), buf)
+	ensure.Nil(t, err)
+	if !bytes.Equal(doc, small) || &doc[0] != &buf[:1][0] {
+		t.Fatal("small document was not read into the buffer")
+	}
+	doc, err = readDocumentInto(bytes.NewReader(large), buf)
+	ensure.Nil(t, err)
+	if !bytes.Equal(doc, large) {
+		t.Fatalf("expected %v got %v", large, doc)
+	}
+	if _, err := readDocumentInto(bytes.NewReader([]byte{1, 0, 0, 0}), buf); err == nil {
+		t.Fatal("was expecting an error for an invalid size")
+	}
+	huge := make([]byte, 4)
+	setInt32(huge, 0, maxMessageSize+1)
+	if _, err := readDocumentInto(bytes.NewReader(huge), buf); err == nil {
+		t.Fatal("was expecting an error for a size larger than any message")
+	}
+	if _, err := readDocumentInto(bytes.NewReader(small[:len(small)-1]), buf); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// fakeOpMsg returns an OpMsg with the body document and optionally a
+// "documents" sequence, with a checksum if the flag is set.
+func fakeOpMsg(t testing.TB, flags uint32, body interface{}, docs ...interface{}) []byte {
+	b := make([]byte, 4)
+	setInt32(b, 0, int32(flags))
+	doc, err := bson.Marshal(body)
+	ensure.Nil(t, err)
+	b = append(b, opMsgSectionBody)
+	b = append(b, doc...)
+	if len(docs) > 0 {
+		seq := append(make([]byte, 4), "documents\x00"...)
+		for _, d := range docs {
+			doc, err := bson.Marshal(d)
+			ensure.Nil(t, err)
+			seq = append(seq, doc...)
+		}
+		setInt32(seq, 0, int32(len(seq)))
+		b = append(b, opMsgSectionSequence)
+		b = append(b, seq...)
+	}
+	if flags&opMsgChecksumPresent != 0 {
+		b = append(b, 0, 0, 0, 0)
+	}
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(b)),
+		RequestID:     7,
+		OpCode:        OpMsg,
+	}
+	msg := append(h.ToWire(), b...)
+	if flags&opMsgChecksumPresent != 0 {
+		setInt32(msg, len(msg)-4, int32(crc32.Checksum(msg[:len(msg)-4], crc32c)))
+	}
+	return msg
+}
+
+func TestOpMsgRoundTrip(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name string
+		Msg  []byte
+	}{
+		{
+			Name: "body",
+			Msg:  fakeOpMsg(t, 0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}),
+		},
+		{
+			Name: "checksum and sequence",
+			Msg: fakeOpMsg(
+				t,
+				opMsgChecksumPresent|opMsgExhaustAllowed,
+				bson.D{{Name: "insert", Value: "c"}, {Name: "$db", Value: "test"}},
+				bson.M{"_id": 1},
+				bson.M{"_id": 2},
+			),
+		},
+	}
+	for _, c := range cases {
+		r := bytes.NewReader(c.Msg)
+		h, err := readHeader(r)
+		ensure.Nil(t, err)
+		m, err := readOpMsg(h, r)
+		ensure.Nil(t, err)
+		if actual := m.Marshal(h); !bytes.Equal(actual, c.Msg) {
+			t.Fatalf("%s: expected %v got %v", c.Name, c.Msg, actual)
+		}
+	}
+
+	m, err := parseOpMsg(fakeOpMsg(t, 0, bson.M{"insert": "c"}, bson.M{"_id": 1}, bson.M{"_id": 2})[headerLen:])
+	ensure.Nil(t, err)
+	if cmd := commandName(m.Body()); cmd != "insert" {
+		t.Fatalf("expected insert command got %q", cmd)
+	}
+	if len(m.Sections) != 2 || m.Sections[1].Identifier != "documents" || len(m.Sections[1].Documents) != 2 {
+		t.Fatalf("unexpected sections %+v", m.Sections)
+	}
+}
+
+func TestParseOpMsgErrors(t *testing.T) {
+	t.Parallel()
+	body := fakeOpMsg(t, 0, bson.M{"ping": 1})[headerLen:]
+	flags := []byte{0, 0, 0, 0}
+	cases := []struct {
+		Name  string
+		Data  []byte
+		Error string
+	}{
+		{
+			Name:  "no body",
+			Data:  flags,
+			Error: "invalid OP_MSG: expected 1 body section, got 0",
+		},
+		{
+			Name:  "two bodies",
+			Data:  append(append([]byte{}, body...), body[4:]...),
+			Error: "invalid OP_MSG: expected 1 body section, got 2",
+		},
+		{
+			Name:  "unknown kind",
+			Data:  append(append([]byte{}, flags...), 2),
+			Error: "invalid OP_MSG: unsupported section kind 2",
+		},
+		{
+			Name:  "truncated document",
+			Data:  body[:len(body)-1],
+			Error: "invalid OP_MSG: document of 15 bytes",
+		},
+		{
+			Name:  "sequence too long",
+			Data:  append(append([]byte{}, body...), opMsgSectionSequence, 10, 0, 0, 0),
+			Error: "invalid OP_MSG: document sequence of 10 bytes",
+		},
+		{
+			Name:  "missing checksum",
+			Data:  []byte{1, 0, 0, 0},
+			Error: "invalid OP_MSG: missing checksum",
+		},
+	}
+	for _, c := range cases {
+		_, err := parseOpMsg(c.Data)
+		if err == nil || err.Error() != c.Error {
+			t.Fatalf("did not get expected error for case %s instead got %v", c.Name, err)
+		}
+	}
+}
+
+func TestReadOpMsgHead(t *testing.T) {
+	t.Parallel()
+	body := bson.D{{Name: "insert", Value: "c"}, {Name: "$db", Value: "test"}}
+	doc, err := bson.Marshal(body)
+	ensure.Nil(t, err)
+	msg := fakeOpMsg(t, 0, body, bson.M{"_id": 1}, bson.M{"_id": 2})
+	seq := msg[headerLen+5+len(doc):]
+
+	// Only the body is read when it's the first section.
+	r := bytes.NewReader(msg)
+	h, err := readHeader(r)
+	ensure.Nil(t, err)
+	head, err := readOpMsgHead(h, r)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, head.Body, doc)
+	ensure.DeepEqual(t, head.raw, msg[headerLen:headerLen+5+len(doc)])
+	if r.Len() != len(seq) {
+		t.Fatalf("expected the %d byte sequence to be unread, %d bytes are", len(seq), r.Len())
+	}
+
+	// Otherwise the entire message is read.
+	reordered := append(append([]byte{}, msg[:headerLen+4]...), seq...)
+	reordered = append(append(reordered, opMsgSectionBody), doc...)
+	r = bytes.NewReader(reordered)
+	h, err = readHeader(r)
+	ensure.Nil(t, err)
+	head, err = readOpMsgHead(h, r)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, head.Body, doc)
+	ensure.DeepEqual(t, head.raw, reordered[headerLen:])
+	ensure.DeepEqual(t, r.Len(), 0)
+
+	// The body size is checked before it's allocated.
+	oversized := append([]byte{}, msg...)
+	setInt32(oversized, headerLen+5, 1<<30)
+	r = bytes.NewReader(oversized)
+	h, err = readHeader(r)
+	ensure.Nil(t, err)
+	_, err = readOpMsgHead(h, r)
+	if err == nil || err.Error() != "invalid OP_MSG: document of 1073741824 bytes" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// So is the message size.
+	h.MessageLength = 1 << 30
+	if _, err := readOpMsgHead(h, bytes.NewReader(msg[headerLen:])); err == nil {
+		t.Fatal("expected an error for a message over the maximum size")
+	}
+	if _, err := readOpMsg(h, bytes.NewReader(msg[headerLen:])); err == nil {
+		t.Fatal("expected an error for a message over the maximum size")
+	}
+}
+
+func TestCopyOpMsgReplies(t *testing.T) {
+	t.Parallel()
+	first := fakeOpMsg(t, opMsgMoreToCome, bson.M{"ok": 1})
+	last := fakeOpMsg(t, 0, bson.M{"ok": 1})
+	next := fakeOpMsg(t, 0, bson.M{"next": 1})
+	r := bytes.NewReader(bytes.Join([][]byte{first, last, next}, nil))
+	var w bytes.Buffer
+	ensure.Nil(t, copyOpMsgReplies(&w, r))
+	if expected := append(append([]byte{}, first...), last...); !bytes.Equal(w.Bytes(), expected) {
+		t.Fatalf("expected %v got %v", expected, w.Bytes())
+	}
+	if r.Len() != len(next) {
+		t.Fatalf("read past the last reply, %d bytes left", r.Len())
+	}
+
+	err := copyOpMsgReplies(&w, bytes.NewReader(fakeReply(t, 0, bson.M{"ok": 1})))
+	if ue, ok := err.(*unexpectedReplyOpCodeError); !ok || ue.OpCode != OpReply {
+		t.Fatalf("expected an unexpected opcode error got %v", err)
+	}
+}
+
+func TestCopyCompressedOpMsgReplies(t *testing.T) {
+	t.Parallel()
+	compress := func(msg []byte, id uint8) []byte {
+		h := &messageHeader{OpCode: OpMsg, compressorID: id}
+		parts, err := compressMessage(h, msg[headerLen:])
+		ensure.Nil(t, err)
+		return bytes.Join(parts, nil)
+	}
+
+	// A compressed reply in the middle of the stream doesn't end it.
+	first := compress(fakeOpMsg(t, opMsgMoreToCome, bson.M{"ok": 1}), compressorZlib)
+	last := compress(fakeOpMsg(t, 0, bson.M{"ok": 1}), compressorNoop)
+	next := fakeOpMsg(t, 0, bson.M{"next": 1})
+	r := bytes.NewReader(bytes.Join([][]byte{first, last, next}, nil))
+	var w bytes.Buffer
+	ensure.Nil(t, copyOpMsgReplies(&w, r))
+	if expected := append(append([]byte{}, first...), last...); !bytes.Equal(w.Bytes(), expected) {
+		t.Fatalf("expected %v got %v", expected, w.Bytes())
+	}
+	if r.Len() != len(next) {
+		t.Fatalf("expected %d bytes left got %d", len(next), r.Len())
+	}
+
+	// The end of the stream can't be found after an unsupported compressor.
+	unsupported := compress(fakeOpMsg(t, 0, bson.M{"ok": 1}), compressorNoop)
+	unsupported[headerLen+8] = 3
+	w.Reset()
+	err := copyOpMsgReplies(&w, bytes.NewReader(unsupported))
+	if ue, ok := err.(*unsupportedCompressorError); !ok || ue.CompressorID != 3 {
+		t.Fatalf("expected an unsupported compressor error got %v", err)
+	}
+	if !bytes.Equal(w.Bytes(), unsupported) {
+		t.Fatalf("expected %v got %v", unsupported, w.Bytes())
+	}
+}
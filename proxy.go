@@ -1,17 +1,25 @@
 package dvara
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/facebookgo/clock"
 	"github.com/facebookgo/rpool"
 	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const headerLen = 16
@@ -21,6 +29,9 @@ var (
 	errZeroMaxPerClientConnections = errors.New("dvara: MaxPerClientConnections cannot be 0")
 	errNormalClose                 = errors.New("dvara: normal close")
 	errClientReadTimeout           = errors.New("dvara: client read timeout")
+	errMaintenanceMode             = errors.New("dvara in maintenance")
+	errStopping                    = errors.New("dvara is shutting down")
+	errClientHalfOpen              = errors.New("dvara: client stopped answering keep-alives")
 
 	timeInPast = time.Now()
 )
@@ -33,11 +44,22 @@ type Proxy struct {
 	ProxyAddr      string       // Address for incoming client connections
 	MongoAddr      string       // Address for destination Mongo server
 
+	activeConnections       int32 // accessed atomically
+	clients                 map[net.Conn]struct{}
+	clientsMutex            sync.Mutex
 	wg                      sync.WaitGroup
 	closed                  chan struct{}
+	draining                chan struct{}
 	serverPool              rpool.Pool
+	databasePools           map[string]*rpool.Pool
 	stats                   stats.Client
 	maxPerClientConnections *maxPerClientConnections
+	auditor                 *auditor
+	noTimeoutCursors        map[[8]byte]time.Time
+	noTimeoutCursorsMutex   sync.Mutex
+	idleConns               map[*agedConn]struct{}
+	idleConnsMutex          sync.Mutex
+	serverConnGeneration    int32 // accessed atomically
 }
 
 // String representation for debugging.
@@ -45,6 +67,22 @@ func (p *Proxy) String() string {
 	return fmt.Sprintf("proxy %s => mongo %s", p.ProxyAddr, p.MongoAddr)
 }
 
+// ActiveConnections returns the number of clients currently connected to the
+// proxy.
+func (p *Proxy) ActiveConnections() int {
+	return int(atomic.LoadInt32(&p.activeConnections))
+}
+
+// SetMaxPerClientConnections changes the maximum number of connections per
+// client IP for the running proxy.
+func (p *Proxy) SetMaxPerClientConnections(max uint) error {
+	if max == 0 {
+		return errZeroMaxPerClientConnections
+	}
+	p.maxPerClientConnections.setMax(max)
+	return nil
+}
+
 // Start the proxy.
 func (p *Proxy) Start() error {
 	if p.ReplicaSet.MaxConnections == 0 {
@@ -55,6 +93,8 @@ func (p *Proxy) Start() error {
 	}
 
 	p.closed = make(chan struct{})
+	p.draining = make(chan struct{})
+	p.clients = make(map[net.Conn]struct{})
 	p.maxPerClientConnections = newMaxPerClientConnections(p.ReplicaSet.MaxPerClientConnections)
 	p.serverPool = rpool.Pool{
 		New:               p.newServerConn,
@@ -63,6 +103,25 @@ func (p *Proxy) Start() error {
 		MinIdle:           p.ReplicaSet.MinIdleConnections,
 		IdleTimeout:       p.ReplicaSet.ServerIdleTimeout,
 		ClosePoolSize:     p.ReplicaSet.ServerClosePoolSize,
+		Clock:             p.ReplicaSet.clock(),
+	}
+
+	if len(p.ReplicaSet.DatabaseMaxConnections) > 0 {
+		p.databasePools = make(map[string]*rpool.Pool)
+		for db, max := range p.ReplicaSet.DatabaseMaxConnections {
+			if max == 0 {
+				return fmt.Errorf("dvara: DatabaseMaxConnections for %s cannot be 0", db)
+			}
+			p.databasePools[db] = &rpool.Pool{
+				New:               p.newServerConn,
+				CloseErrorHandler: p.serverCloseErrorHandler,
+				Max:               max,
+				MinIdle:           p.ReplicaSet.MinIdleConnections,
+				IdleTimeout:       p.ReplicaSet.ServerIdleTimeout,
+				ClosePoolSize:     p.ReplicaSet.ServerClosePoolSize,
+				Clock:             p.ReplicaSet.clock(),
+			}
+		}
 	}
 
 	// plug stats if we can
@@ -70,6 +129,16 @@ func (p *Proxy) Start() error {
 		// Drop the default port suffix to make them pretty in production.
 		dbName := strings.TrimSuffix(p.MongoAddr, ":27017")
 
+		for db, pool := range p.databasePools {
+			pool.Stats = stats.PrefixClient(
+				[]string{
+					fmt.Sprintf("mongoproxy.server.pool.%s.", db),
+					fmt.Sprintf("mongoproxy.%s.server.pool.%s.", dbName, db),
+				},
+				p.ReplicaSet.Stats,
+			)
+		}
+
 		// We want 2 sets of keys, one specific to the proxy, and another shared
 		// with others.
 		p.serverPool.Stats = stats.PrefixClient(
@@ -88,7 +157,25 @@ func (p *Proxy) Start() error {
 		)
 	}
 
-	go p.clientAcceptLoop()
+	if interval := p.ReplicaSet.ServerKeepAliveInterval; interval != 0 {
+		p.wg.Add(1)
+		go p.keepAliveLoop(p.ReplicaSet.clock().Ticker(interval))
+	}
+
+	if lifetime := p.ReplicaSet.NoTimeoutCursorLifetime; lifetime > 0 {
+		p.wg.Add(1)
+		go p.cursorReapLoop(p.ReplicaSet.clock().Ticker(lifetime / 2))
+	}
+
+	// Accept is safe to call concurrently, and each loop keeps the wg
+	// accounting for the Accept it's blocked in.
+	acceptConcurrency := p.ReplicaSet.AcceptConcurrency
+	if acceptConcurrency == 0 {
+		acceptConcurrency = 1
+	}
+	for i := uint(0); i < acceptConcurrency; i++ {
+		go p.clientAcceptLoop()
+	}
 
 	return nil
 }
@@ -99,6 +186,9 @@ func (p *Proxy) Stop() error {
 }
 
 func (p *Proxy) stop(hard bool) error {
+	if !hard {
+		p.drainAcceptQueue(p.ReplicaSet.AcceptDrainTimeout)
+	}
 	if err := p.ClientListener.Close(); err != nil {
 		return err
 	}
@@ -106,11 +196,90 @@ func (p *Proxy) stop(hard bool) error {
 	if !hard {
 		p.wg.Wait()
 	}
-	p.serverPool.Close()
+	p.closeServerPools()
 	return nil
 }
 
+// stopWithTimeout stops the proxy waiting up to timeout for the clients to
+// finish. Clients still connected after the timeout are disconnected, and
+// their number is returned.
+func (p *Proxy) stopWithTimeout(timeout time.Duration) (int, error) {
+	drain := p.ReplicaSet.AcceptDrainTimeout
+	if drain > timeout {
+		drain = timeout
+	}
+	p.drainAcceptQueue(drain)
+	timeout -= drain
+	if err := p.ClientListener.Close(); err != nil {
+		return 0, err
+	}
+	close(p.closed)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var forced int
+	select {
+	case <-done:
+	case <-p.ReplicaSet.clock().After(timeout):
+		p.clientsMutex.Lock()
+		for c := range p.clients {
+			if err := c.Close(); err != nil {
+				p.Log.Error(err)
+			}
+			forced++
+		}
+		p.clientsMutex.Unlock()
+	}
+	p.closeServerPools()
+	return forced, nil
+}
+
+// drainAcceptQueue keeps accepting clients for the duration before the
+// listener is closed, answering them with an error instead of serving them.
+// Clients already queued in the kernel get a clean reply instead of a reset.
+func (p *Proxy) drainAcceptQueue(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	close(p.draining)
+	p.ReplicaSet.clock().Sleep(d)
+}
+
+// rejectQueuedClient responds to the first message of a client accepted while
+// draining with an error, waiting for it until the deadline.
+func (p *Proxy) rejectQueuedClient(c net.Conn, deadline time.Time) {
+	defer p.wg.Done()
+	defer c.Close()
+	stats.BumpSum(p.stats, "client.rejected.stopping", 1)
+	c.SetDeadline(deadline)
+	h, err := readHeader(c)
+	if err != nil {
+		return
+	}
+	if _, err := io.CopyN(ioutil.Discard, c, int64(h.MessageLength-headerLen)); err != nil {
+		return
+	}
+	if err := writeErrorReply(c, h.RequestID, errCodeShutdownInProgress, errStopping.Error()); err != nil {
+		p.Log.Error(err)
+	}
+}
+
+func (p *Proxy) closeServerPools() {
+	p.serverPool.Close()
+	for _, pool := range p.databasePools {
+		pool.Close()
+	}
+}
+
 func (p *Proxy) checkRSChanged() bool {
+	// A direct connection isn't tied to the replica set configuration.
+	if p.ReplicaSet.DirectConnection {
+		return false
+	}
 	addrs := p.ReplicaSet.lastState.Addrs()
 	r, err := p.ReplicaSet.ReplicaSetStateCreator.FromAddrs(addrs, p.ReplicaSet.Name)
 	if err != nil {
@@ -120,6 +289,9 @@ func (p *Proxy) checkRSChanged() bool {
 
 	if err := r.AssertEqual(p.ReplicaSet.lastState); err != nil {
 		p.Log.Error(err)
+		for _, c := range p.ReplicaSet.lastState.Diff(r) {
+			p.Log.Warnf("replica set changed: %s", c)
+		}
 		go p.ReplicaSet.Restart()
 		return true
 	}
@@ -133,9 +305,13 @@ func (p *Proxy) checkRSChanged() bool {
 func (p *Proxy) newServerConn() (io.Closer, error) {
 	retrySleep := 50 * time.Millisecond
 	for retryCount := 7; retryCount > 0; retryCount-- {
-		c, err := net.Dial("tcp", p.MongoAddr)
+		c, err := p.dialServer()
 		if err == nil {
-			return c, nil
+			return &agedConn{
+				Conn:       c,
+				created:    p.ReplicaSet.clock().Now(),
+				generation: atomic.LoadInt32(&p.serverConnGeneration),
+			}, nil
 		}
 		p.Log.Error(err)
 
@@ -143,19 +319,325 @@ func (p *Proxy) newServerConn() (io.Closer, error) {
 		if p.checkRSChanged() {
 			return nil, errNormalClose
 		}
-		time.Sleep(retrySleep)
+		p.ReplicaSet.clock().Sleep(retrySleep)
 		retrySleep = retrySleep * 2
 	}
 	return nil, fmt.Errorf("could not connect to %s", p.MongoAddr)
 }
 
+// dialServer dials a new server connection, waiting for a slot if the number
+// of concurrent dials is limited.
+func (p *Proxy) dialServer() (net.Conn, error) {
+	if limiter := p.ReplicaSet.dialLimiter; limiter != nil {
+		limiter <- struct{}{}
+		defer func() { <-limiter }()
+	}
+	dial := p.ReplicaSet.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	return dial("tcp", p.MongoAddr)
+}
+
+// agedConn is a server connection that knows when it was created, and how
+// long it has been idle for the keep-alive pings.
+type agedConn struct {
+	net.Conn
+	created    time.Time
+	generation int32
+	closed     int32 // accessed atomically
+
+	// These are guarded by the Proxy idleConnsMutex.
+	idleSince time.Time
+	pinging   chan struct{} // closed once the keep-alive ping is done
+	dead      bool
+}
+
+func (c *agedConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
+}
+
+// resetServerConns makes the server connections made so far be discarded
+// instead of reused, so fresh ones are made. This is done when the member
+// resolves to new addresses.
+func (p *Proxy) resetServerConns() {
+	atomic.AddInt32(&p.serverConnGeneration, 1)
+	stats.BumpSum(p.stats, "server.conn.reset", 1)
+}
+
+// stale returns true if the server connection was made before the server
+// connections were last reset.
+func (p *Proxy) stale(c *agedConn) bool {
+	return c.generation != atomic.LoadInt32(&p.serverConnGeneration)
+}
+
+// releaseServerConn returns the server connection to the pool, unless it has
+// outlived the ServerConnMaxLifetime or was reset in which case it's
+// discarded so a fresh one is made instead.
+func (p *Proxy) releaseServerConn(pool *rpool.Pool, c net.Conn) {
+	if ac, ok := c.(*agedConn); ok {
+		now := p.ReplicaSet.clock().Now()
+		max := p.ReplicaSet.ServerConnMaxLifetime
+		if max > 0 && now.Sub(ac.created) >= max {
+			stats.BumpSum(p.stats, "server.conn.expired", 1)
+			pool.Discard(c)
+			return
+		}
+		if p.stale(ac) {
+			stats.BumpSum(p.stats, "server.conn.stale", 1)
+			pool.Discard(c)
+			return
+		}
+		if p.ReplicaSet.ServerKeepAliveInterval > 0 {
+			p.idleConnsMutex.Lock()
+			if p.idleConns == nil {
+				p.idleConns = make(map[*agedConn]struct{})
+			}
+			ac.idleSince = now
+			p.idleConns[ac] = struct{}{}
+			p.idleConnsMutex.Unlock()
+		}
+	}
+	pool.Release(c)
+}
+
+// claimServerConn marks the server connection acquired from the pool as in
+// use, waiting for a keep-alive ping of it to finish. It returns false if the
+// connection failed a ping and must be discarded.
+func (p *Proxy) claimServerConn(c *agedConn) bool {
+	p.idleConnsMutex.Lock()
+	delete(p.idleConns, c)
+	pinging := c.pinging
+	p.idleConnsMutex.Unlock()
+	if pinging != nil {
+		<-pinging
+	}
+	p.idleConnsMutex.Lock()
+	defer p.idleConnsMutex.Unlock()
+	return !c.dead
+}
+
+// serverPools returns all the server connection pools.
+func (p *Proxy) serverPools() []*rpool.Pool {
+	pools := []*rpool.Pool{&p.serverPool}
+	for _, pool := range p.databasePools {
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// clientServerPool returns the server connection pool for the message with
+// the given header. If the databases are partitioned, the namespace is read
+// from the client and the returned connection will replay it.
+func (p *Proxy) clientServerPool(h *messageHeader, c net.Conn) (net.Conn, *rpool.Pool, error) {
+	if p.databasePools == nil {
+		return c, &p.serverPool, nil
+	}
+	switch h.OpCode {
+	case OpQuery, OpInsert, OpUpdate, OpDelete, OpGetMore:
+	default:
+		return c, &p.serverPool, nil
+	}
+
+	c.SetReadDeadline(p.ReplicaSet.clock().Now().Add(p.ReplicaSet.messageTimeout(h.OpCode)))
+	c, fullCollectionName, err := readNamespace(h, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pool, ok := p.databasePools[databaseName(fullCollectionName)]; ok {
+		return c, pool, nil
+	}
+	return c, &p.serverPool, nil
+}
+
+// readNamespace reads the full collection name of an OpQuery, OpInsert,
+// OpUpdate, OpDelete or OpGetMore, all of which start with an int32 followed
+// by it. The returned connection replays what was read.
+func readNamespace(h *messageHeader, c net.Conn) (net.Conn, []byte, error) {
+	body := io.LimitReader(c, int64(h.MessageLength-headerLen))
+	var prefix [4]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, nil, err
+	}
+	fullCollectionName, err := readCString(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	c = &prefixConn{
+		Conn:   c,
+		prefix: bytes.NewReader(append(prefix[:], fullCollectionName...)),
+	}
+	return c, fullCollectionName, nil
+}
+
 // getServerConn gets a server connection from the pool.
-func (p *Proxy) getServerConn() (net.Conn, error) {
-	c, err := p.serverPool.Acquire()
+func (p *Proxy) getServerConn(pool *rpool.Pool) (net.Conn, error) {
+	// Time spent waiting on the pool is part of message.proxy.time, this breaks
+	// it out so queueing under load can be told apart from slow servers.
+	defer stats.BumpTime(p.stats, "server.acquire.time").End()
+	for {
+		c, err := pool.Acquire()
+		if err != nil {
+			// Distinguish shutting down from being unable to connect.
+			select {
+			case <-p.closed:
+				stats.BumpSum(p.stats, "server.acquire.failed.closed", 1)
+			default:
+				stats.BumpSum(p.stats, "server.acquire.failed.connect", 1)
+			}
+			return nil, err
+		}
+		if ac, ok := c.(*agedConn); ok && (!p.claimServerConn(ac) || p.stale(ac)) {
+			pool.Discard(c)
+			continue
+		}
+		return c.(net.Conn), nil
+	}
+}
+
+// keepAliveLoop pings idle server connections on each tick until the proxy is
+// stopped.
+func (p *Proxy) keepAliveLoop(ticker *clock.Ticker) {
+	defer p.wg.Done()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+			p.keepAlive()
+		}
+	}
+}
+
+// keepAlive pings the pooled server connections that have been idle for at
+// least the ServerKeepAliveInterval. They're left in their pool, so clients
+// never wait on the pings besides for a connection being pinged, and none are
+// dialed. Connections that fail the ping are discarded once acquired so they
+// are replaced instead of failing the next client message.
+func (p *Proxy) keepAlive() {
+	now := p.ReplicaSet.clock().Now()
+	var idle []*agedConn
+	p.idleConnsMutex.Lock()
+	for c := range p.idleConns {
+		if atomic.LoadInt32(&c.closed) != 0 {
+			delete(p.idleConns, c)
+			continue
+		}
+		if c.pinging == nil && now.Sub(c.idleSince) >= p.ReplicaSet.ServerKeepAliveInterval {
+			c.pinging = make(chan struct{})
+			idle = append(idle, c)
+		}
+	}
+	p.idleConnsMutex.Unlock()
+
+	for _, c := range idle {
+		// Stop doesn't wait for the remaining pings.
+		var err error
+		select {
+		case <-p.closed:
+		default:
+			err = p.pingServer(c)
+		}
+
+		p.idleConnsMutex.Lock()
+		if err != nil {
+			c.dead = true
+			delete(p.idleConns, c)
+		} else {
+			c.idleSince = p.ReplicaSet.clock().Now()
+		}
+		close(c.pinging)
+		c.pinging = nil
+		p.idleConnsMutex.Unlock()
+
+		if err != nil {
+			stats.BumpSum(p.stats, "server.keepalive.failed", 1)
+			p.Log.Warnf("discarding server connection for %s: %s", p, err)
+			continue
+		}
+		stats.BumpSum(p.stats, "server.keepalive.ok", 1)
+	}
+}
+
+// adminCommand returns an OpQuery message running the named command on the
+// admin database.
+func adminCommand(name string) ([]byte, error) {
+	cmd, err := bson.Marshal(bson.D{{Name: name, Value: 1}})
 	if err != nil {
 		return nil, err
 	}
-	return c.(net.Conn), nil
+	var b []byte
+	b = append(b, make([]byte, headerLen+4)...)
+	b = append(b, "admin.$cmd\x00"...)
+	b = append(b, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff)
+	b = append(b, cmd...)
+	h := messageHeader{MessageLength: int32(len(b)), OpCode: OpQuery}
+	copy(b, h.ToWire())
+	return b, nil
+}
+
+// pingServer sends a ping command on the server connection and waits for the
+// reply.
+func (p *Proxy) pingServer(c net.Conn) error {
+	b, err := adminCommand("ping")
+	if err != nil {
+		return err
+	}
+
+	if timeout := p.ReplicaSet.Tunables().MessageTimeout; timeout != 0 {
+		if err := c.SetDeadline(p.ReplicaSet.clock().Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer c.SetDeadline(time.Time{})
+	}
+	if _, err := c.Write(b); err != nil {
+		return err
+	}
+	reply, err := readHeader(c)
+	if err != nil {
+		return err
+	}
+	if reply.MessageLength < headerLen {
+		return fmt.Errorf("ping: invalid response message length %d", reply.MessageLength)
+	}
+	_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+	return err
+}
+
+// ping connects to the proxy as a client and runs isMaster through it.
+func (p *Proxy) ping(ctx context.Context) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", p.ClientListener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	b, err := adminCommand("isMaster")
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(b); err != nil {
+		return err
+	}
+	var res struct {
+		OK float64 `bson:"ok"`
+	}
+	rw := ReplyRW{Log: p.Log}
+	if _, _, _, err := rw.ReadOne(c, &res); err != nil {
+		return err
+	}
+	if res.OK != 1 {
+		return fmt.Errorf("isMaster through %s failed", p)
+	}
+	return nil
 }
 
 func (p *Proxy) serverCloseErrorHandler(err error) {
@@ -172,15 +654,111 @@ func (p *Proxy) proxyMessage(
 ) error {
 
 	p.Log.Debugf("proxying message %s from %s for %s", h, client.RemoteAddr(), p)
-	deadline := time.Now().Add(p.ReplicaSet.MessageTimeout)
+
+	// The namespace of queries, getMores and mutations, when it has been read
+	// for the slow message log or the database check.
+	var fullCollectionName []byte
+	if threshold := p.ReplicaSet.SlowMessageThreshold; threshold > 0 {
+		defer func(start time.Time) {
+			if elapsed := p.ReplicaSet.clock().Now().Sub(start); elapsed > threshold {
+				stats.BumpSum(p.stats, "message.slow", 1)
+				if len(fullCollectionName) == 0 {
+					p.Log.Warnf(
+						"slow message %s from %s for %s took %s",
+						h,
+						client.RemoteAddr(),
+						p,
+						elapsed,
+					)
+					return
+				}
+				p.Log.Warnf(
+					"slow message %s on %s from %s for %s took %s",
+					h,
+					fullCollectionName[:len(fullCollectionName)-1],
+					client.RemoteAddr(),
+					p,
+					elapsed,
+				)
+			}
+		}(p.ReplicaSet.clock().Now())
+	}
+	start := p.ReplicaSet.clock().Now()
+	timeout := p.ReplicaSet.messageTimeout(h.OpCode)
+	deadline := start.Add(timeout)
 	server.SetDeadline(deadline)
 	client.SetDeadline(deadline)
+	if max := p.ReplicaSet.MaxMessageReadTime; max > timeout {
+		client = &progressConn{
+			Conn:   client,
+			extend: []net.Conn{client, server},
+			window: timeout,
+			until:  start.Add(max),
+			clock:  p.ReplicaSet.clock(),
+		}
+	}
+	if wt := p.ReplicaSet.ClientWriteTimeout; wt > 0 {
+		client = &writeTimeoutConn{
+			Conn:    client,
+			timeout: wt,
+			clock:   p.ReplicaSet.clock(),
+		}
+	}
+
+	// Clear the deadlines once we're done so they don't linger on the
+	// connections, leaving the idle read in control of the client timing.
+	defer func() {
+		server.SetDeadline(time.Time{})
+		client.SetDeadline(time.Time{})
+	}()
+
+	// Compressed requests that may need inspecting are proxied decompressed, so
+	// the server replies uncompressed. The others are proxied as is, and
+	// handled according to their original opcode. Those with a compressor the
+	// proxy doesn't implement can't be inspected, and are only passed through
+	// if nothing needs to inspect them. Drivers don't send those since the
+	// compressors are removed from handshakes, so an OpMsg with moreToCome
+	// going unnoticed among them isn't a concern.
+	op := h.OpCode
+	if op == OpCompressed {
+		var err error
+		if client, op, err = decompressRequest(h, client, p.checksDatabases() || p.limitsReplies()); err != nil {
+			if _, ok := err.(*unsupportedCompressorError); !ok || p.inspectsRequests() {
+				p.Log.Error(err)
+				return err
+			}
+			stats.BumpSum(p.stats, "message.compressed.unsupported", 1)
+		}
+		if h.OpCode != OpCompressed {
+			stats.BumpSum(p.stats, "message.decompressed", 1)
+		}
+	}
+
+	if p.auditor != nil {
+		var err error
+		if client, err = p.audit(h, client); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+	}
+
+	if p.ReplicaSet.SlowMessageThreshold > 0 &&
+		(h.OpCode == OpQuery || h.OpCode == OpGetMore || h.OpCode.IsMutation()) {
+		var err error
+		if client, fullCollectionName, err = readNamespace(h, client); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+	}
 
 	// OpQuery may need to be transformed and need special handling in order to
 	// make the proxy transparent.
 	if h.OpCode == OpQuery {
 		stats.BumpSum(p.stats, "message.with.response", 1)
-		return p.ReplicaSet.ProxyQuery.Proxy(h, client, server, lastError)
+		if p.ReplicaSet.DisableGetLastErrorCache && lastError.Exists() && !lastError.local {
+			lastError.Reset()
+		}
+		return p.proxyQuery(h, client, server, lastError)
 	}
 
 	// Anything besides a getlasterror call (which requires an OpQuery) resets
@@ -190,6 +768,68 @@ func (p *Proxy) proxyMessage(
 		lastError.Reset()
 	}
 
+	// OpMsg commands are checked like OpQuery commands, and handshakes need
+	// their replies rewritten. Only the body section is read to find the
+	// command, which is shared by the audit log, getMore limiter and ProxyMsg.
+	if h.OpCode == OpMsg {
+		stats.BumpSum(p.stats, "message.with.response", 1)
+		head, err := readOpMsgHead(h, client)
+		if err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		if p.auditor != nil {
+			p.auditMsg(head, client)
+		}
+		if strings.EqualFold(commandName(head.Body), "getMore") {
+			defer p.acquireGetMore()()
+		}
+		return p.ReplicaSet.ProxyQuery.ProxyMsg(h, head, client, server)
+	}
+
+	// The other messages with a namespace are checked against the allowed
+	// databases like queries and commands are. Mutations have no reply, so
+	// the rejection is reported by the following getLastError call.
+	if p.checksDatabases() && (h.OpCode.IsMutation() || h.OpCode == OpGetMore) {
+		if fullCollectionName == nil {
+			var err error
+			if client, fullCollectionName, err = readNamespace(h, client); err != nil {
+				p.Log.Error(err)
+				return err
+			}
+		}
+		if db := databaseName(fullCollectionName); !p.ReplicaSet.ProxyQuery.databaseAllowed(db) {
+			stats.BumpSum(p.stats, "database.denied", 1)
+			msg := fmt.Sprintf("database %s not allowed by proxy", db)
+			p.Log.Errorf("rejecting message %s: %s", h, msg)
+			if _, err := io.CopyN(ioutil.Discard, client, int64(h.MessageLength-headerLen)); err != nil {
+				p.Log.Error(err)
+				return err
+			}
+			if h.OpCode == OpGetMore {
+				if err := writeErrorReply(client, h.RequestID, errCodeUnauthorized, msg); err != nil {
+					p.Log.Error(err)
+					return err
+				}
+				return nil
+			}
+			return lastError.setLocal(errCodeUnauthorized, msg)
+		}
+	}
+
+	if p.ReplicaSet.ReadOnly && h.OpCode.IsMutation() {
+		stats.BumpSum(p.stats, "write.rejected", 1)
+		if _, err := io.CopyN(ioutil.Discard, client, int64(h.MessageLength-headerLen)); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		return lastError.setLocal(errCodeUnauthorized, errReadOnly)
+	}
+
+	if op == OpGetMore {
+		defer p.acquireGetMore()()
+	}
+
 	// For other Ops we proxy the header & raw body over.
 	if err := h.WriteTo(server); err != nil {
 		p.Log.Error(err)
@@ -202,9 +842,16 @@ func (p *Proxy) proxyMessage(
 	}
 
 	// For Ops with responses we proxy the raw response message over.
-	if h.OpCode.HasResponse() {
+	if op.HasResponse() {
 		stats.BumpSum(p.stats, "message.with.response", 1)
-		if err := copyMessage(client, server); err != nil {
+		if pq := p.ReplicaSet.ProxyQuery; pq != nil && op == OpGetMore {
+			return pq.copyReply(client, server)
+		}
+		copyReply := copyReplyMessage
+		if op == OpMsg {
+			copyReply = copyOpMsgReplies
+		}
+		if err := copyReply(client, server); err != nil {
 			p.Log.Error(err)
 			return err
 		}
@@ -213,6 +860,198 @@ func (p *Proxy) proxyMessage(
 	return nil
 }
 
+// inspectsRequests returns true if any request may need to be inspected, to be
+// audited, limited or checked against the request policies.
+func (p *Proxy) inspectsRequests() bool {
+	if p.ReplicaSet.ReadOnly || p.auditor != nil || p.ReplicaSet.getMoreLimiter != nil {
+		return true
+	}
+	pq := p.ReplicaSet.ProxyQuery
+	return pq != nil && (len(pq.DeniedCommands) > 0 ||
+		len(pq.AllowedDatabases) > 0 || pq.MaxQueryDocSize > 0 ||
+		pq.MaxReplyDocs > 0 || pq.MaxReplyBytes > 0)
+}
+
+// checksDatabases returns true if the namespaces of messages are checked
+// against ProxyQuery.AllowedDatabases.
+func (p *Proxy) checksDatabases() bool {
+	pq := p.ReplicaSet.ProxyQuery
+	return pq != nil && len(pq.AllowedDatabases) > 0
+}
+
+// limitsReplies returns true if query and getMore replies are limited by
+// ProxyQuery.MaxReplyDocs or MaxReplyBytes.
+func (p *Proxy) limitsReplies() bool {
+	pq := p.ReplicaSet.ProxyQuery
+	return pq != nil && (pq.MaxReplyDocs > 0 || pq.MaxReplyBytes > 0)
+}
+
+// acquireGetMore waits for the getMore limiter, if there is one, and returns
+// the function to release it once the getMore is done.
+func (p *Proxy) acquireGetMore() func() {
+	limiter := p.ReplicaSet.getMoreLimiter
+	if limiter == nil {
+		return func() {}
+	}
+	select {
+	case limiter <- struct{}{}:
+	default:
+		stats.BumpSum(p.stats, "getmore.throttled", 1)
+		limiter <- struct{}{}
+	}
+	return func() { <-limiter }
+}
+
+// proxyQuery proxies an OpQuery. A query with the tailable or awaitData flag
+// pins the server connection to the client. If NoTimeoutCursorLifetime is set
+// and the query has the noCursorTimeout flag, the cursor it opens is tracked
+// so it can be killed once it's past the lifetime.
+func (p *Proxy) proxyQuery(h *messageHeader, client, server net.Conn, lastError *LastError) error {
+	var flags [4]byte
+	if _, err := io.ReadFull(client, flags[:]); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	client = &prefixConn{Conn: client, prefix: bytes.NewReader(flags[:])}
+
+	// The getMores of a tailable cursor may wait on the server for a long time,
+	// which is why the client's server connection is pinned for it.
+	if getInt32(flags[:], 0)&(queryFlagTailableCursor|queryFlagAwaitData) != 0 {
+		if tc, ok := server.(*trackedConn); ok {
+			tc.pinCursor = true
+		}
+	}
+
+	if p.ReplicaSet.NoTimeoutCursorLifetime <= 0 ||
+		getInt32(flags[:], 0)&queryFlagNoCursorTimeout == 0 {
+		return p.ReplicaSet.ProxyQuery.Proxy(h, client, server, lastError)
+	}
+
+	reply := &headConn{Conn: server, head: make([]byte, 0, headerLen+len(emptyPrefix))}
+	if err := p.ReplicaSet.ProxyQuery.Proxy(h, client, reply, lastError); err != nil {
+		return err
+	}
+	if len(reply.head) < cap(reply.head) {
+		return nil
+	}
+	var rh messageHeader
+	rh.FromWire(reply.head)
+	var cursorID [8]byte
+	copy(cursorID[:], reply.head[headerLen+4:])
+	if rh.OpCode != OpReply || cursorID == [8]byte{} {
+		return nil
+	}
+	p.noTimeoutCursorsMutex.Lock()
+	if p.noTimeoutCursors == nil {
+		p.noTimeoutCursors = make(map[[8]byte]time.Time)
+	}
+	p.noTimeoutCursors[cursorID] = p.ReplicaSet.clock().Now()
+	p.noTimeoutCursorsMutex.Unlock()
+	return nil
+}
+
+// headConn records the first bytes read from the connection, up to the
+// capacity of head.
+type headConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *headConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if missing := cap(c.head) - len(c.head); missing > 0 {
+		if missing > n {
+			missing = n
+		}
+		c.head = append(c.head, b[:missing]...)
+	}
+	return n, err
+}
+
+// cursorReapLoop kills the noCursorTimeout cursors past their lifetime on
+// each tick until the proxy is stopped.
+func (p *Proxy) cursorReapLoop(ticker *clock.Ticker) {
+	defer p.wg.Done()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+			p.reapNoTimeoutCursors()
+		}
+	}
+}
+
+// reapNoTimeoutCursors kills the noCursorTimeout cursors opened more than
+// NoTimeoutCursorLifetime ago. Killing a cursor that was already exhausted
+// or closed by the client is harmless.
+func (p *Proxy) reapNoTimeoutCursors() {
+	cutoff := p.ReplicaSet.clock().Now().Add(-p.ReplicaSet.NoTimeoutCursorLifetime)
+	var expired [][8]byte
+	p.noTimeoutCursorsMutex.Lock()
+	for id, opened := range p.noTimeoutCursors {
+		if !opened.After(cutoff) {
+			expired = append(expired, id)
+			delete(p.noTimeoutCursors, id)
+		}
+	}
+	p.noTimeoutCursorsMutex.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+
+	c, err := p.getServerConn(&p.serverPool)
+	if err != nil {
+		p.Log.Error(err)
+		return
+	}
+	for _, id := range expired {
+		if err := writeKillCursors(c, id[:]); err != nil {
+			p.Log.Error(err)
+			p.serverPool.Discard(c)
+			return
+		}
+		stats.BumpSum(p.stats, "cursor.no.timeout.reaped", 1)
+	}
+	p.Log.Warnf("killed %d noCursorTimeout cursors past their lifetime on %s", len(expired), p)
+	p.releaseServerConn(&p.serverPool, c)
+}
+
+// decompressRequest decompresses an OpCompressed request if the original
+// message may need to be inspected or rewritten. Those are queries and OpMsg
+// commands, and mutations which may be followed by a getLastError or be
+// rejected. getMores are decompressed too if getMore is true, so their
+// namespace can be checked or their reply limited. The header is replaced by
+// the original one, and the returned connection reads the original body.
+// Other requests are left compressed. The original opcode is returned either
+// way. Requests compressed with a compressor the proxy doesn't implement are
+// also left compressed, and returned along with an
+// unsupportedCompressorError.
+func decompressRequest(h *messageHeader, client net.Conn, getMore bool) (net.Conn, OpCode, error) {
+	var prefix [compressedPrefixLen]byte
+	if _, err := io.ReadFull(client, prefix[:4]); err != nil {
+		return nil, 0, err
+	}
+	op := OpCode(getInt32(prefix[:], 0))
+	if op != OpQuery && op != OpMsg && !op.IsMutation() && !(getMore && op == OpGetMore) {
+		return &prefixConn{Conn: client, prefix: bytes.NewReader(prefix[:4])}, op, nil
+	}
+	if _, err := io.ReadFull(client, prefix[4:]); err != nil {
+		return nil, 0, err
+	}
+	if id := prefix[8]; id != compressorNoop && id != compressorZlib {
+		passed := &prefixConn{Conn: client, prefix: bytes.NewReader(prefix[:])}
+		return passed, op, &unsupportedCompressorError{CompressorID: id}
+	}
+	original, body, err := decompressMessage(h, io.MultiReader(bytes.NewReader(prefix[:]), client))
+	if err != nil {
+		return nil, 0, err
+	}
+	*h = *original
+	return &prefixConn{Conn: client, prefix: bytes.NewReader(body)}, op, nil
+}
+
 // clientAcceptLoop accepts new clients and creates a clientServeLoop for each
 // new client that connects to the proxy.
 func (p *Proxy) clientAcceptLoop() {
@@ -227,10 +1066,49 @@ func (p *Proxy) clientAcceptLoop() {
 			p.Log.Error(err)
 			continue
 		}
+		select {
+		case <-p.draining:
+			deadline := p.ReplicaSet.clock().Now().Add(p.ReplicaSet.AcceptDrainTimeout)
+			go p.rejectQueuedClient(c, deadline)
+			continue
+		default:
+		}
+		if limiter := p.ReplicaSet.connRateLimiter; limiter != nil {
+			wait, ok := limiter.reserve(maxConnRateLimitWait)
+			if !ok {
+				stats.BumpSum(p.stats, "client.rate.rejected", 1)
+				c.Close()
+				p.wg.Done()
+				continue
+			}
+			if wait > 0 {
+				// The delayed clients wait on their own so the others keep being
+				// accepted, and rejected once the wait gets too long.
+				stats.BumpSum(p.stats, "client.rate.limited", 1)
+				go p.delayedClientServeLoop(c, wait)
+				continue
+			}
+		}
 		go p.clientServeLoop(c)
 	}
 }
 
+// maxConnRateLimitWait is the longest a new client connection is delayed by
+// MaxConnectionsPerSecond. Connections that would wait longer are closed.
+const maxConnRateLimitWait = time.Second
+
+// delayedClientServeLoop waits before running the clientServeLoop, unless the
+// proxy is stopped meanwhile.
+func (p *Proxy) delayedClientServeLoop(c net.Conn, wait time.Duration) {
+	select {
+	case <-p.closed:
+		c.Close()
+		p.wg.Done()
+	case <-p.ReplicaSet.clock().After(wait):
+		p.clientServeLoop(c)
+	}
+}
+
 // clientServeLoop loops on a single client connected to the proxy and
 // dispatches its requests.
 func (p *Proxy) clientServeLoop(c net.Conn) {
@@ -247,23 +1125,49 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 	// turn on TCP keep-alive and set it to the recommended period of 2 minutes
 	// http://docs.mongodb.org/manual/faq/diagnostics/#faq-keepalive
 	if conn, ok := c.(*net.TCPConn); ok {
-		conn.SetKeepAlivePeriod(2 * time.Minute)
-		conn.SetKeepAlive(true)
+		if err := setKeepAlive(conn, p.ReplicaSet.clientKeepAliveConfig()); err != nil {
+			p.Log.Error(err)
+		}
 	}
 
-	c = teeIf(fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
+	c = teeIf(p.ReplicaSet.Tunables().WireDump, fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
 	p.Log.Infof("client %s connected to %s", c.RemoteAddr(), p)
 	stats.BumpSum(p.stats, "client.connected", 1)
+	atomic.AddInt32(&p.activeConnections, 1)
+	p.clientsMutex.Lock()
+	p.clients[c] = struct{}{}
+	p.clientsMutex.Unlock()
 	defer func() {
 		p.Log.Infof("client %s disconnected from %s", c.RemoteAddr(), p)
+		atomic.AddInt32(&p.activeConnections, -1)
+		p.clientsMutex.Lock()
+		delete(p.clients, c)
+		p.clientsMutex.Unlock()
 		p.wg.Done()
-		if err := c.Close(); err != nil {
-			p.Log.Error(err)
-		}
+		p.closeClient(c)
 		p.maxPerClientConnections.dec(remoteIP)
 	}()
 
-	var lastError LastError
+	if p.ReplicaSet.InMaintenanceMode() {
+		stats.BumpSum(p.stats, "client.rejected.maintenance", 1)
+		p.rejectClient(c, errCodeShutdownInProgress, errMaintenanceMode)
+		return
+	}
+
+	var (
+		lastError  LastError
+		stickyConn net.Conn
+		stickyPool *rpool.Pool
+	)
+	// A sticky server connection is held until the client disconnects.
+	defer func() {
+		if stickyConn != nil {
+			p.releaseServerConn(stickyPool, stickyConn)
+		}
+	}()
+	// Each client has at most one request outstanding: the next header isn't
+	// read until the reply to the previous message was written, so pipelined
+	// requests wait in the client's socket until it drains its replies.
 	for {
 		h, err := p.idleClientReadHeader(c)
 		if err != nil {
@@ -274,33 +1178,70 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 		}
 
 		mpt := stats.BumpTime(p.stats, "message.proxy.time")
-		serverConn, err := p.getServerConn()
+		client, pool, err := p.clientServerPool(h, c)
 		if err != nil {
-			if err != errNormalClose {
-				p.Log.Error(err)
-			}
+			p.Log.Error(err)
 			return
 		}
+		var serverConn net.Conn
+		if stickyConn != nil {
+			serverConn, pool = stickyConn, stickyPool
+		} else {
+			serverConn, err = p.getServerConn(pool)
+			if err != nil {
+				if err != errNormalClose {
+					p.Log.Error(err)
+				}
+				return
+			}
+			if p.ReplicaSet.StickyClientSessions {
+				stickyConn, stickyPool = serverConn, pool
+			}
+		}
 
 		scht := stats.BumpTime(p.stats, "server.conn.held.time")
 		for {
-			err := p.proxyMessage(h, c, serverConn, &lastError)
+			trackedClient := &trackedConn{Conn: client}
+			trackedServer := &trackedConn{Conn: serverConn}
+			err := p.proxyMessage(h, trackedClient, trackedServer, &lastError)
 			if err != nil {
-				p.serverPool.Discard(serverConn)
+				stickyConn = nil
+				// Failures caused by the client don't mean the server connection is
+				// bad, so it goes back to the pool if it's still usable.
+				if serverConnReusable(trackedClient, trackedServer) {
+					stats.BumpSum(p.stats, "message.proxy.client.error", 1)
+					p.releaseServerConn(pool, serverConn)
+				} else {
+					pool.Discard(serverConn)
+				}
 				p.Log.Error(err)
 				stats.BumpSum(p.stats, "message.proxy.error", 1)
 				if ne, ok := err.(net.Error); ok && ne.Timeout() {
 					stats.BumpSum(p.stats, "message.proxy.timeout", 1)
+					if trackedClient.writeErr != nil {
+						stats.BumpSum(p.stats, "client.not.draining", 1)
+						p.Log.Warnf("disconnecting client %s not reading replies from %s", c.RemoteAddr(), p)
+					}
 				}
 				if err == errRSChanged {
 					go p.ReplicaSet.Restart()
 				}
+				if _, ok := err.(*unexpectedReplyOpCodeError); ok {
+					stats.BumpSum(p.stats, "server.reply.unexpected.opcode", 1)
+				}
 				return
 			}
 
 			// One message was proxied, stop it's timer.
 			mpt.End()
 
+			// A client that opened a tailable cursor keeps its server connection
+			// until it disconnects, like a sticky session.
+			if trackedServer.pinCursor && stickyConn == nil {
+				stats.BumpSum(p.stats, "server.conn.pinned.cursor", 1)
+				stickyConn, stickyPool = serverConn, pool
+			}
+
 			if !h.OpCode.IsMutation() {
 				break
 			}
@@ -323,24 +1264,137 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 				}
 				// We need to return our server to the pool (it's still good as far
 				// as we know).
-				p.serverPool.Release(serverConn)
+				stickyConn = nil
+				p.releaseServerConn(pool, serverConn)
 				return
 			}
 
 			// Successfully read message when waiting for the getLastError call.
+			// It stays on the same server connection regardless of the database.
+			client = c
 			mpt = stats.BumpTime(p.stats, "message.proxy.time")
 		}
-		p.serverPool.Release(serverConn)
+		if stickyConn == nil {
+			p.releaseServerConn(pool, serverConn)
+		}
 		scht.End()
 		stats.BumpSum(p.stats, "message.proxy.success", 1)
 	}
 }
 
+// closeClient closes the client connection, applying the ClientLinger.
+func (p *Proxy) closeClient(c net.Conn) {
+	if linger := p.ReplicaSet.ClientLinger; linger != 0 {
+		// SO_LINGER takes whole seconds, and 0 resets the connection, so a
+		// positive linger is rounded up.
+		sec := int((linger + time.Second - 1) / time.Second)
+		if linger < 0 {
+			sec = 0
+		}
+		if err := setLinger(c, sec); err != nil {
+			p.Log.Error(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		p.Log.Error(err)
+	}
+}
+
+// trackedConn records the errors reading and writing a connection and the
+// bytes written to it while proxying a message, so failures can be attributed
+// to the client or the server.
+type trackedConn struct {
+	net.Conn
+	readErr  error
+	writeErr error
+	written  int64
+
+	// pinCursor is set on the server connection when the message opened a
+	// cursor that should keep using it.
+	pinCursor bool
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && c.readErr == nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += int64(n)
+	if err != nil && c.writeErr == nil {
+		c.writeErr = err
+	}
+	return n, err
+}
+
+// serverConnReusable returns true if a failure proxying a message was caused
+// by the client and left the server connection at a message boundary. Server
+// replies are read entirely even if writing them to the client fails, so a
+// client write error leaves it usable. A client read error only does if
+// nothing was sent to the server yet.
+func serverConnReusable(client, server *trackedConn) bool {
+	if server.readErr != nil || server.writeErr != nil {
+		return false
+	}
+	if client.writeErr != nil {
+		return true
+	}
+	return client.readErr != nil && server.written == 0
+}
+
+// lingerer is implemented by *net.TCPConn.
+type lingerer interface {
+	SetLinger(sec int) error
+}
+
+// setLinger sets the linger on the connection, looking through our connection
+// wrappers.
+func setLinger(c net.Conn, sec int) error {
+	for {
+		switch v := c.(type) {
+		case lingerer:
+			return v.SetLinger(sec)
+		case *teeConn:
+			c = v.Conn
+		case *prefixConn:
+			c = v.Conn
+		case *trackedConn:
+			c = v.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// rejectClient responds to the first message from the client with the given
+// error instead of proxying it.
+func (p *Proxy) rejectClient(c net.Conn, code int, reason error) {
+	h, err := p.idleClientReadHeader(c)
+	if err != nil {
+		if err != errNormalClose {
+			p.Log.Error(err)
+		}
+		return
+	}
+	c.SetDeadline(p.ReplicaSet.clock().Now().Add(p.ReplicaSet.messageTimeout(h.OpCode)))
+	if _, err := io.CopyN(ioutil.Discard, c, int64(h.MessageLength-headerLen)); err != nil {
+		p.Log.Error(err)
+		return
+	}
+	if err := writeErrorReply(c, h.RequestID, code, reason.Error()); err != nil {
+		p.Log.Error(err)
+	}
+}
+
 // We wait for upto ClientIdleTimeout in MessageTimeout increments and keep
 // checking if we're waiting to be closed. This ensures that at worse we
 // wait for MessageTimeout when closing even when we're idling.
 func (p *Proxy) idleClientReadHeader(c net.Conn) (*messageHeader, error) {
-	h, err := p.clientReadHeader(c, p.ReplicaSet.ClientIdleTimeout)
+	h, err := p.clientReadHeader(c, p.ReplicaSet.Tunables().ClientIdleTimeout)
 	if err == errClientReadTimeout {
 		stats.BumpSum(p.stats, "client.idle.timeout", 1)
 	}
@@ -348,7 +1402,7 @@ func (p *Proxy) idleClientReadHeader(c net.Conn) (*messageHeader, error) {
 }
 
 func (p *Proxy) gleClientReadHeader(c net.Conn) (*messageHeader, error) {
-	h, err := p.clientReadHeader(c, p.ReplicaSet.GetLastErrorTimeout)
+	h, err := p.clientReadHeader(c, p.ReplicaSet.Tunables().GetLastErrorTimeout)
 	if err == errClientReadTimeout {
 		stats.BumpSum(p.stats, "client.gle.timeout", 1)
 	}
@@ -363,9 +1417,9 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 	}
 	resChan := make(chan headerError)
 
-	c.SetReadDeadline(time.Now().Add(timeout))
+	deadline := p.ReplicaSet.clock().Now().Add(timeout)
 	go func() {
-		h, err := readHeader(c)
+		h, err := p.readClientHeader(c, deadline)
 		resChan <- headerError{header: h, error: err}
 	}()
 
@@ -393,6 +1447,14 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 		return nil, errNormalClose
 	}
 
+	// The client stopped answering keep-alive probes, it likely went away
+	// without closing the connection. This is also a timeout, so it's checked
+	// first.
+	if errors.Is(response.error, syscall.ETIMEDOUT) {
+		stats.BumpSum(p.stats, "client.half.open", 1)
+		return nil, errClientHalfOpen
+	}
+
 	// We hit our ReadDeadline.
 	if ne, ok := response.error.(net.Error); ok && ne.Timeout() {
 		if closed {
@@ -408,37 +1470,207 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 	return nil, response.error
 }
 
+// readClientHeader reads a header from the client. The read deadline is
+// advanced in MessageTimeout rounds up to the given deadline, and bytes read in
+// one round are kept for the next. A client that started sending a header
+// isn't idle, so the deadline is pushed back to give it at least a
+// MessageTimeout after each round it made progress in. This allows a slow
+// client trickling in a header to be read correctly rather than being dropped.
+func (p *Proxy) readClientHeader(c net.Conn, deadline time.Time) (*messageHeader, error) {
+	var d [headerLen]byte
+	b := d[:]
+	var read int
+	mt := p.ReplicaSet.Tunables().MessageTimeout
+	for {
+		round := deadline
+		if mt > 0 {
+			if next := p.ReplicaSet.clock().Now().Add(mt); next.Before(deadline) {
+				round = next
+			}
+		}
+		c.SetReadDeadline(round)
+		n, err := io.ReadFull(c, b[read:])
+		read += n
+		if err == nil {
+			h := messageHeader{}
+			h.FromWire(b)
+			return &h, nil
+		}
+
+		if n > 0 && mt > 0 {
+			if next := p.ReplicaSet.clock().Now().Add(mt); next.After(deadline) {
+				deadline = next
+			}
+		}
+
+		// Keep waiting if we only hit the deadline for this round, unless we're
+		// being closed. A failed keep-alive is also a timeout, but the client is
+		// gone.
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && round.Before(deadline) &&
+			!errors.Is(err, syscall.ETIMEDOUT) {
+			select {
+			case <-p.closed:
+			default:
+				continue
+			}
+		}
+
+		// A header cut short by a clean close in a later round is still partial.
+		if err == io.EOF && read > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+}
+
 var teeIfEnable = os.Getenv("MONGOPROXY_TEE") == "1"
 
+// WireDump controls dumping the data sent and received on client connections
+// to stdout for debugging.
+type WireDump string
+
+const (
+	// WireDumpOff disables dumping, unless the MONGOPROXY_TEE environment
+	// variable is set to 1 in which case WireDumpRaw is used.
+	WireDumpOff = WireDump("")
+
+	// WireDumpRaw dumps the raw bytes.
+	WireDumpRaw = WireDump("raw")
+
+	// WireDumpHex dumps the bytes like hexdump -C along with the decoded
+	// message headers and query namespaces and command names.
+	WireDumpHex = WireDump("hex")
+)
+
+// wireDumpMaxBytes is the most bytes WireDumpHex will dump for a single read
+// or write.
+const wireDumpMaxBytes = 1024
+
+func (w WireDump) valid() bool {
+	return w == WireDumpOff || w == WireDumpRaw || w == WireDumpHex
+}
+
 type teeConn struct {
 	context string
+	mode    WireDump
+	out     io.Writer
 	net.Conn
+
+	// pendingRead and pendingWrite are the OpCode of a header that was read or
+	// written by itself, which means the next read or write is its body.
+	pendingRead  OpCode
+	pendingWrite OpCode
 }
 
-func (t teeConn) Read(b []byte) (int, error) {
+func (t *teeConn) Read(b []byte) (int, error) {
 	n, err := t.Conn.Read(b)
 	if n > 0 {
-		fmt.Fprintf(os.Stdout, "READ %s: %s %v\n", t.context, b[0:n], b[0:n])
+		t.dump("READ", b[0:n], &t.pendingRead)
 	}
 	return n, err
 }
 
-func (t teeConn) Write(b []byte) (int, error) {
+func (t *teeConn) Write(b []byte) (int, error) {
 	n, err := t.Conn.Write(b)
 	if n > 0 {
-		fmt.Fprintf(os.Stdout, "WRIT %s: %s %v\n", t.context, b[0:n], b[0:n])
+		t.dump("WRIT", b[0:n], &t.pendingWrite)
 	}
 	return n, err
 }
 
-func teeIf(context string, c net.Conn) net.Conn {
-	if teeIfEnable {
-		return teeConn{
-			context: context,
-			Conn:    c,
+func (t *teeConn) dump(prefix string, b []byte, pending *OpCode) {
+	if t.mode != WireDumpHex {
+		fmt.Fprintf(t.out, "%s %s: %s %v\n", prefix, t.context, b, b)
+		return
+	}
+
+	fmt.Fprintf(t.out, "%s %s: %d bytes\n", prefix, t.context, len(b))
+	if *pending == OpQuery {
+		if desc := describeQuery(b); desc != "" {
+			fmt.Fprintf(t.out, "%s %s: %s\n", prefix, t.context, desc)
+		}
+	}
+	*pending = 0
+	if h := decodeWireHeader(b); h != nil {
+		fmt.Fprintf(t.out, "%s %s: %s\n", prefix, t.context, h)
+		if len(b) == headerLen {
+			*pending = h.OpCode
+		} else if h.OpCode == OpQuery {
+			if desc := describeQuery(b[headerLen:]); desc != "" {
+				fmt.Fprintf(t.out, "%s %s: %s\n", prefix, t.context, desc)
+			}
 		}
 	}
-	return c
+
+	dump := b
+	if len(dump) > wireDumpMaxBytes {
+		dump = dump[:wireDumpMaxBytes]
+	}
+	io.WriteString(t.out, hex.Dump(dump))
+	if len(b) > len(dump) {
+		fmt.Fprintf(t.out, "... %d more bytes\n", len(b)-len(dump))
+	}
+}
+
+// decodeWireHeader returns the header at the start of b if it looks like one.
+func decodeWireHeader(b []byte) *messageHeader {
+	if len(b) < headerLen {
+		return nil
+	}
+	var h messageHeader
+	h.FromWire(b)
+	if h.MessageLength < headerLen || h.OpCode.String() == "UNKNOWN" {
+		return nil
+	}
+	return &h
+}
+
+// queryCommandNameOffset is the number of bytes between the namespace and the
+// command name of an OpQuery command: numberToSkip, numberToReturn, the
+// document length and the type of the first element, whose name is the
+// command name.
+const queryCommandNameOffset = 4 + 4 + 4 + 1
+
+// describeQuery returns the namespace, and for commands the command name, of
+// the OpQuery body at the start of b. It returns an empty string if they can't
+// be decoded, for example because b was cut short.
+func describeQuery(b []byte) string {
+	if len(b) < 4 {
+		return ""
+	}
+	r := bytes.NewReader(b[4:])
+	ns, err := readCString(r)
+	if err != nil {
+		return ""
+	}
+	name := string(ns[:len(ns)-1])
+	if !strings.HasSuffix(name, ".$cmd") {
+		return "namespace " + name
+	}
+
+	if _, err := r.Seek(queryCommandNameOffset, io.SeekCurrent); err != nil {
+		return "namespace " + name
+	}
+	cmd, err := readCString(r)
+	if err != nil {
+		return "namespace " + name
+	}
+	return fmt.Sprintf("command %s on %s", cmd[:len(cmd)-1], name)
+}
+
+func teeIf(mode WireDump, context string, c net.Conn) net.Conn {
+	if mode == WireDumpOff && teeIfEnable {
+		mode = WireDumpRaw
+	}
+	if mode == WireDumpOff {
+		return c
+	}
+	return &teeConn{
+		context: context,
+		mode:    mode,
+		out:     os.Stdout,
+		Conn:    c,
+	}
 }
 
 type maxPerClientConnections struct {
@@ -465,6 +1697,14 @@ func (m *maxPerClientConnections) inc(remoteIP string) bool {
 	return false
 }
 
+// setMax changes the limit. Clients already over a lowered limit keep their
+// connections until they close.
+func (m *maxPerClientConnections) setMax(max uint) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.max = max
+}
+
 func (m *maxPerClientConnections) dec(remoteIP string) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -477,3 +1717,115 @@ func (m *maxPerClientConnections) dec(remoteIP string) {
 		m.counts[remoteIP] = current - 1
 	}
 }
+
+// rateLimiter is a token bucket allowing up to rate events per second, with
+// bursts of up to rate events.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+func newRateLimiter(rate uint, now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now(),
+		now:    now,
+	}
+}
+
+// reserve takes a token and returns how long the caller must wait before
+// proceeding. If that's longer than max the token isn't taken, and false is
+// returned.
+func (r *rateLimiter) reserve(max time.Duration) (time.Duration, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := r.now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0, true
+	}
+	wait := time.Duration(-r.tokens / r.rate * float64(time.Second))
+	if wait > max {
+		r.tokens++
+		return 0, false
+	}
+	return wait, true
+}
+
+// progressConn is a net.Conn whose reads continue past a hit deadline as long
+// as data arrived since the deadline was last set, up to a final deadline. This
+// allows a slow but progressing client to send a message over multiple
+// windows, while one that stalls still times out.
+type progressConn struct {
+	net.Conn
+	extend   []net.Conn // deadlines extended along with the reads
+	window   time.Duration
+	until    time.Time
+	clock    clock.Clock
+	progress int
+}
+
+func (c *progressConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		c.progress += n
+		ne, ok := err.(net.Error)
+		if !ok || !ne.Timeout() || c.progress == 0 {
+			return n, err
+		}
+		now := c.clock.Now()
+		if !now.Before(c.until) {
+			return n, err
+		}
+		next := now.Add(c.window)
+		if next.After(c.until) {
+			next = c.until
+		}
+		for _, conn := range c.extend {
+			conn.SetDeadline(next)
+		}
+		c.progress = 0
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// writeTimeoutConn is a net.Conn that sets a write deadline before each write,
+// so a client that isn't reading replies fails the write once its buffers
+// fill up.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	clock   clock.Clock
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(c.clock.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// prefixConn is a net.Conn that returns bytes already read from the
+// underlying connection before reading from it again.
+type prefixConn struct {
+	net.Conn
+	prefix *bytes.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if c.prefix.Len() > 0 {
+		return c.prefix.Read(b)
+	}
+	return c.Conn.Read(b)
+}
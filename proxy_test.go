@@ -1,10 +1,22 @@
 package dvara
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/facebookgo/clock"
 	"github.com/facebookgo/ensure"
 	"github.com/facebookgo/inject"
 	"github.com/facebookgo/mgotest"
@@ -279,6 +291,683 @@ func TestZeroMaxConnections(t *testing.T) {
 	}
 }
 
+// deadlineConn is a net.Conn that reads from r, discards writes and records
+// the deadlines that were set on it.
+type deadlineConn struct {
+	net.Conn
+	r         *bytes.Reader
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c *deadlineConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *deadlineConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *deadlineConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *deadlineConn) Close() error                       { return nil }
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestOpTimeouts(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			ProxyQuery:     &ProxyQuery{Log: log},
+			MessageTimeout: time.Minute,
+			OpTimeouts: map[OpCode]time.Duration{
+				OpInsert: time.Hour,
+				OpQuery:  time.Second,
+			},
+		},
+	}
+
+	deadlineFor := func(op OpCode) time.Duration {
+		client := &deadlineConn{r: bytes.NewReader(nil)}
+		server := &deadlineConn{r: bytes.NewReader(nil)}
+		h := &messageHeader{OpCode: op, MessageLength: headerLen}
+		start := time.Now()
+		p.proxyMessage(h, client, server, &LastError{})
+		if !client.deadlines[0].Equal(server.deadlines[0]) {
+			t.Fatalf("client and server deadlines differ for %s", op)
+		}
+		return client.deadlines[0].Sub(start)
+	}
+
+	insert := deadlineFor(OpInsert)
+	query := deadlineFor(OpQuery)
+	if insert < time.Hour || insert > time.Hour+time.Minute {
+		t.Fatalf("unexpected insert timeout %s", insert)
+	}
+	if query < time.Second || query > time.Minute {
+		t.Fatalf("unexpected query timeout %s", query)
+	}
+	if other := deadlineFor(OpDelete); other < time.Minute || other > time.Hour {
+		t.Fatalf("unexpected delete timeout %s", other)
+	}
+}
+
+func TestInvalidOpTimeouts(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		OpTimeouts map[OpCode]time.Duration
+		Error      string
+	}{
+		{
+			OpTimeouts: map[OpCode]time.Duration{OpCode(42): time.Second},
+			Error:      "dvara: unknown OpCode 42 in OpTimeouts",
+		},
+		{
+			OpTimeouts: map[OpCode]time.Duration{OpQuery: 0},
+			Error:      "dvara: OpTimeouts for QUERY must be positive, got 0s",
+		},
+	}
+	for _, c := range cases {
+		r := &ReplicaSet{Addrs: "127.0.0.1:666", OpTimeouts: c.OpTimeouts}
+		err := r.Start()
+		if err == nil || err.Error() != c.Error {
+			t.Fatalf("did not get expected error, got: %s", err)
+		}
+	}
+}
+
+// slowConn is a deadlineConn with slow writes.
+type slowConn struct {
+	*deadlineConn
+	delay time.Duration
+}
+
+func (c slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.deadlineConn.Write(b)
+}
+
+// slowLogger records the slow message warnings.
+type slowLogger struct {
+	*tLogger
+	warnings []string
+}
+
+func (l *slowLogger) Warnf(format string, args ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func TestSlowMessage(t *testing.T) {
+	t.Parallel()
+	var slow float64
+	log := &slowLogger{tLogger: &tLogger{TB: t}}
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout:       time.Minute,
+			SlowMessageThreshold: 20 * time.Millisecond,
+		},
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "message.slow" {
+					slow += val
+				}
+			},
+		},
+	}
+	body := "\x00\x00\x00\x00a.foo\x00"
+	h := &messageHeader{OpCode: OpInsert, MessageLength: headerLen + int32(len(body))}
+
+	fast := &deadlineConn{r: bytes.NewReader(nil)}
+	client := &deadlineConn{r: bytes.NewReader([]byte(body))}
+	ensure.Nil(t, p.proxyMessage(h, client, fast, &LastError{}))
+	if slow != 0 {
+		t.Fatal("fast message was counted as slow")
+	}
+
+	server := slowConn{deadlineConn: &deadlineConn{r: bytes.NewReader(nil)}, delay: 50 * time.Millisecond}
+	client = &deadlineConn{r: bytes.NewReader([]byte(body))}
+	ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+	if slow != 1 {
+		t.Fatalf("expected 1 slow message got %v", slow)
+	}
+	ensure.DeepEqual(t, len(log.warnings), 1)
+	ensure.StringContains(t, log.warnings[0], " on a.foo from ")
+}
+
+func TestDeadlinesClearedAfterMessage(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		Log: &tLogger{TB: t},
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: 10 * time.Millisecond,
+		},
+	}
+	client, proxyClient := net.Pipe()
+	defer client.Close()
+	defer proxyClient.Close()
+	server := &deadlineConn{r: bytes.NewReader(nil)}
+
+	go func() {
+		client.Write([]byte{1, 2, 3, 4})
+		// A long gap before the client sends anything else.
+		time.Sleep(50 * time.Millisecond)
+		client.Write([]byte{5})
+	}()
+
+	h := &messageHeader{OpCode: OpInsert, MessageLength: headerLen + 4}
+	ensure.Nil(t, p.proxyMessage(h, proxyClient, server, &LastError{}))
+	if last := server.deadlines[len(server.deadlines)-1]; !last.IsZero() {
+		t.Fatalf("server deadline was not cleared: %s", last)
+	}
+
+	var b [1]byte
+	if _, err := io.ReadFull(proxyClient, b[:]); err != nil {
+		t.Fatalf("unexpected error after long gap: %s", err)
+	}
+}
+
+func TestSlowClientHeader(t *testing.T) {
+	t.Parallel()
+	// Each byte comes within the MessageTimeout, but the whole header takes
+	// longer than the ClientIdleTimeout.
+	p := &Proxy{
+		Log:    &tLogger{TB: t},
+		closed: make(chan struct{}),
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout:    50 * time.Millisecond,
+			ClientIdleTimeout: 100 * time.Millisecond,
+		},
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	expected := messageHeader{
+		MessageLength: 42,
+		RequestID:     1,
+		ResponseTo:    2,
+		OpCode:        OpQuery,
+	}
+	go func() {
+		for _, b := range expected.ToWire() {
+			time.Sleep(15 * time.Millisecond)
+			if _, err := client.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+
+	h, err := p.idleClientReadHeader(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *h != expected {
+		t.Fatalf("expected %s got %s", &expected, h)
+	}
+}
+
+// timeoutError is a net.Error for a hit deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// clockConn is a net.Conn whose reads block until the read deadline has passed
+// on the mock clock and advanced is closed.
+type clockConn struct {
+	net.Conn
+	clock       *clock.Mock
+	deadlineSet chan struct{}
+	advanced    chan struct{}
+
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func (c *clockConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	select {
+	case c.deadlineSet <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *clockConn) Read(b []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		deadline := c.deadline
+		c.mutex.Unlock()
+		if !c.clock.Now().Before(deadline) {
+			return 0, timeoutError{}
+		}
+		<-c.advanced
+	}
+}
+
+func TestClientReadHeaderIdleTimeout(t *testing.T) {
+	t.Parallel()
+	mock := clock.NewMock()
+	p := &Proxy{
+		Log:        &tLogger{TB: t},
+		ReplicaSet: &ReplicaSet{Clock: mock},
+	}
+	c := &clockConn{
+		clock:       mock,
+		deadlineSet: make(chan struct{}, 1),
+		advanced:    make(chan struct{}),
+	}
+	errch := make(chan error, 1)
+	go func() {
+		_, err := p.clientReadHeader(c, time.Hour)
+		errch <- err
+	}()
+
+	<-c.deadlineSet
+	if expected := mock.Now().Add(time.Hour); !c.deadline.Equal(expected) {
+		t.Fatalf("expected deadline %s got %s", expected, c.deadline)
+	}
+	mock.Add(time.Hour)
+	close(c.advanced)
+	if err := <-errch; err != errClientReadTimeout {
+		t.Fatalf("expected client read timeout got %v", err)
+	}
+}
+
+func TestClientReadHeaderHalfOpen(t *testing.T) {
+	t.Parallel()
+	// With a MessageTimeout the read is done in rounds, which must not retry
+	// the keep-alive timeout like a round timing out.
+	for _, mt := range []time.Duration{0, time.Minute} {
+		p := &Proxy{
+			Log:        &tLogger{TB: t},
+			ReplicaSet: &ReplicaSet{MessageTimeout: mt},
+		}
+		c := &faultConn{
+			readErr: &net.OpError{
+				Op:  "read",
+				Net: "tcp",
+				Err: os.NewSyscallError("read", syscall.ETIMEDOUT),
+			},
+		}
+		if _, err := p.clientReadHeader(c, time.Hour); err != errClientHalfOpen {
+			t.Fatalf("MessageTimeout %s: expected client half open got %v", mt, err)
+		}
+	}
+}
+
+func TestClientKeepAliveConfig(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Interval time.Duration
+		Count    int
+		Expected keepAliveConfig
+	}{
+		{
+			Name:     "default",
+			Expected: keepAliveConfig{Idle: 2 * time.Minute},
+		},
+		{
+			Name:     "tuned",
+			Interval: 10 * time.Second,
+			Count:    3,
+			Expected: keepAliveConfig{
+				Idle:     2 * time.Minute,
+				Interval: 10 * time.Second,
+				Count:    3,
+			},
+		},
+	}
+	for _, c := range cases {
+		r := &ReplicaSet{
+			ClientKeepAliveInterval: c.Interval,
+			ClientKeepAliveCount:    c.Count,
+		}
+		if actual := r.clientKeepAliveConfig(); actual != c.Expected {
+			t.Fatalf("%s: expected %+v got %+v", c.Name, c.Expected, actual)
+		}
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 10,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Minute,
+		},
+	}
+	r := &ReplicaSet{proxies: map[string]*Proxy{p.ProxyAddr: p}}
+	ensure.Nil(t, p.Start())
+
+	waitFor := func(expected int) {
+		for i := 0; p.ActiveConnections() != expected; i++ {
+			if i == 100 {
+				t.Fatalf("expected %d active connections got %d", expected, p.ActiveConnections())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	c1, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	c2, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	waitFor(2)
+	if total := r.TotalActiveConnections(); total != 2 {
+		t.Fatalf("expected 2 total active connections got %d", total)
+	}
+
+	c1.Close()
+	waitFor(1)
+	c2.Close()
+	waitFor(0)
+	ensure.Nil(t, p.Stop())
+}
+
+func TestStickyClientSessions(t *testing.T) {
+	t.Parallel()
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	const messages = 3
+	var (
+		serversMutex sync.Mutex
+		servers      []*recordingConn
+	)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 10,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Minute,
+			StickyClientSessions:    true,
+			Dial: func(network, address string) (net.Conn, error) {
+				s := &recordingConn{
+					deadlineConn: deadlineConn{
+						r: bytes.NewReader(bytes.Repeat(reply, messages)),
+					},
+				}
+				serversMutex.Lock()
+				servers = append(servers, s)
+				serversMutex.Unlock()
+				return s, nil
+			},
+		},
+	}
+	ensure.Nil(t, p.Start())
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	body := []byte{0, 0, 0, 0}
+	for i := 0; i < messages; i++ {
+		h := &messageHeader{
+			MessageLength: int32(headerLen + len(body)),
+			RequestID:     int32(i + 1),
+			OpCode:        OpGetMore,
+		}
+		ensure.Nil(t, h.WriteTo(c))
+		_, err = c.Write(body)
+		ensure.Nil(t, err)
+		replyH, err := readHeader(c)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(replyH.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+	c.Close()
+	ensure.Nil(t, p.Stop())
+
+	if len(servers) != 1 {
+		t.Fatalf("expected 1 server connection got %d", len(servers))
+	}
+	written := servers[0].written.Bytes()
+	for i := 0; i < messages; i++ {
+		h, err := readHeader(bytes.NewReader(written))
+		ensure.Nil(t, err)
+		if h.RequestID != int32(i+1) {
+			t.Fatalf("expected request %d got %d", i+1, h.RequestID)
+		}
+		written = written[h.MessageLength:]
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	log := &tLogger{TB: t}
+	p := &Proxy{
+		Log:            log,
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		ReplicaSet: &ReplicaSet{
+			Log:                     log,
+			MaxConnections:          1,
+			MaxPerClientConnections: 10,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Minute,
+		},
+	}
+	p.ReplicaSet.SetMaintenanceMode(true)
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	body := []byte{1, 2, 3, 4}
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     42,
+		OpCode:        OpQuery,
+	}
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+
+	r := &ReplyRW{Log: log}
+	var reply bson.M
+	rh, prefix, _, err := r.ReadOne(c, &reply)
+	ensure.Nil(t, err)
+	if rh.ResponseTo != h.RequestID {
+		t.Fatalf("expected response to %d got %d", h.RequestID, rh.ResponseTo)
+	}
+	if getInt32(prefix[:], 0)&replyFlagQueryFailure == 0 {
+		t.Fatal("expected QueryFailure flag to be set")
+	}
+	if reply["$err"] != errMaintenanceMode.Error() {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+
+	// The client is disconnected after the error.
+	var b [1]byte
+	if _, err := c.Read(b[:]); err != io.EOF {
+		t.Fatalf("expected EOF got %v", err)
+	}
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	t.Parallel()
+	const maxDials = 2
+	var mu sync.Mutex
+	var current, max int
+	r := &ReplicaSet{
+		dialLimiter: make(chan struct{}, maxDials),
+		Dial: func(network, address string) (net.Conn, error) {
+			mu.Lock()
+			current++
+			if current > max {
+				max = current
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			current--
+			mu.Unlock()
+			return nil, errors.New("connection refused")
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := &Proxy{ReplicaSet: r, MongoAddr: "127.0.0.1:666"}
+			if _, err := p.dialServer(); err == nil {
+				t.Error("was expecting an error")
+			}
+		}()
+	}
+	wg.Wait()
+	if max != maxDials {
+		t.Fatalf("expected at most %d concurrent dials got %d", maxDials, max)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	l := newRateLimiter(10, func() time.Time { return now })
+	for i := 0; i < 10; i++ {
+		if wait, _ := l.reserve(time.Second); wait != 0 {
+			t.Fatalf("unexpected wait %s within burst", wait)
+		}
+	}
+	if wait, _ := l.reserve(time.Second); wait != 100*time.Millisecond {
+		t.Fatalf("expected 100ms wait got %s", wait)
+	}
+	if wait, _ := l.reserve(time.Second); wait != 200*time.Millisecond {
+		t.Fatalf("expected 200ms wait got %s", wait)
+	}
+	// Waiting too long doesn't take a token.
+	if _, ok := l.reserve(250 * time.Millisecond); ok {
+		t.Fatal("expected a wait over the maximum to be refused")
+	}
+	if wait, _ := l.reserve(time.Second); wait != 300*time.Millisecond {
+		t.Fatalf("expected 300ms wait got %s", wait)
+	}
+	now = now.Add(time.Hour)
+	if wait, _ := l.reserve(time.Second); wait != 0 {
+		t.Fatalf("unexpected wait %s after refill", wait)
+	}
+}
+
+func TestMaxConnectionsPerSecond(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	var limited int32
+	// The client deadlines come from the clock, so it needs the current time.
+	clk := clock.NewMock()
+	clk.Add(time.Since(clk.Now()))
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		ReplicaSet: &ReplicaSet{
+			Clock:                   clk,
+			MaxConnections:          1,
+			MaxPerClientConnections: 100,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Minute,
+			connRateLimiter:         newRateLimiter(5, clk.Now),
+			Stats: &stats.HookClient{
+				BumpSumHook: func(key string, val float64) {
+					if key == "mongoproxy.client.rate.limited" {
+						atomic.AddInt32(&limited, int32(val))
+					}
+				},
+			},
+		},
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	for i := 0; i < 10; i++ {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		defer c.Close()
+	}
+
+	// The first 5 are served right away, and the rest are throttled until the
+	// clock moves.
+	for i := 0; p.ActiveConnections() != 5 || atomic.LoadInt32(&limited) != 5; i++ {
+		if i == 100 {
+			t.Fatalf("expected 5 active and 5 rate limited connections got %d and %d",
+				p.ActiveConnections(), atomic.LoadInt32(&limited))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; p.ActiveConnections() != 10; i++ {
+		if i == 500 {
+			t.Fatalf("expected 10 active connections got %d", p.ActiveConnections())
+		}
+		clk.Add(time.Second)
+	}
+}
+
+func TestMaxConnectionsPerSecondRejects(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	var rejected int32
+	now := time.Now()
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 100,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Minute,
+			// Time stands still, so the connections past the burst wait 500ms,
+			// 1s, 1.5s and 2s, and the last two are rejected.
+			connRateLimiter: newRateLimiter(2, func() time.Time { return now }),
+			Stats: &stats.HookClient{
+				BumpSumHook: func(key string, val float64) {
+					if key == "mongoproxy.client.rate.rejected" {
+						atomic.AddInt32(&rejected, int32(val))
+					}
+				},
+			},
+		},
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	for i := 0; i < 6; i++ {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		defer c.Close()
+	}
+	for i := 0; p.ActiveConnections() != 4; i++ {
+		if i == 200 {
+			t.Fatalf("expected 4 active connections got %d", p.ActiveConnections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&rejected); n != 2 {
+		t.Fatalf("expected 2 rejected connections got %d", n)
+	}
+}
+
 func TestNoAddrsGiven(t *testing.T) {
 	t.Parallel()
 	replicaSet := ReplicaSet{MaxConnections: 1}
@@ -287,6 +976,7 @@ func TestNoAddrsGiven(t *testing.T) {
 	err := graph.Provide(
 		&inject.Object{Value: &log},
 		&inject.Object{Value: &replicaSet},
+		&inject.Object{Value: &ReplicaSetStateCreator{}},
 		&inject.Object{Value: &stats.HookClient{}},
 	)
 	ensure.Nil(t, err)
@@ -311,6 +1001,7 @@ func TestSingleNodeWhenExpectingRS(t *testing.T) {
 	err := graph.Provide(
 		&inject.Object{Value: &log},
 		&inject.Object{Value: &replicaSet},
+		&inject.Object{Value: &ReplicaSetStateCreator{}},
 		&inject.Object{Value: &stats.HookClient{}},
 	)
 	ensure.Nil(t, err)
@@ -385,3 +1076,1475 @@ func BenchmarkInsertReadDirect(b *testing.B) {
 	p := NewSingleHarness(b)
 	benchmarkInsertRead(b, p.RealSession())
 }
+
+func benchmarkAccept(b *testing.B, acceptConcurrency uint) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(b, err)
+	p := &Proxy{
+		Log:            &tLogger{TB: b},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1 << 20,
+			AcceptConcurrency:       acceptConcurrency,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Minute,
+		},
+	}
+	ensure.Nil(b, p.Start())
+	defer p.Stop()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c, err := net.Dial("tcp", p.ProxyAddr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			c.Close()
+		}
+	})
+}
+
+func BenchmarkAccept1(b *testing.B) {
+	benchmarkAccept(b, 1)
+}
+
+func BenchmarkAccept8(b *testing.B) {
+	benchmarkAccept(b, 8)
+}
+
+func TestKeepAliveDiscardsDeadConnections(t *testing.T) {
+	t.Parallel()
+	var dials, ok, failed int32
+	pinged := make(chan struct{}, 4)
+	// The ping deadlines come from the clock, so it needs the current time.
+	clk := clock.NewMock()
+	clk.Add(time.Since(clk.Now()))
+	p := &Proxy{
+		Log:       &tLogger{TB: t},
+		MongoAddr: "fake:27017",
+		ReplicaSet: &ReplicaSet{
+			Clock:                   clk,
+			ServerKeepAliveInterval: time.Minute,
+			MessageTimeout:          time.Second,
+			// Every other connection is one the server has already closed.
+			Dial: func(network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				if atomic.AddInt32(&dials, 1)%2 == 0 {
+					server.Close()
+					return client, nil
+				}
+				go func() {
+					defer server.Close()
+					h, err := readHeader(server)
+					if err != nil {
+						return
+					}
+					io.CopyN(ioutil.Discard, server, int64(h.MessageLength-headerLen))
+					reply := fakeSingleDocReply(bson.M{"ok": 1})
+					io.Copy(server, reply)
+				}()
+				return client, nil
+			},
+		},
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				switch key {
+				case "server.keepalive.ok":
+					atomic.AddInt32(&ok, int32(val))
+				case "server.keepalive.failed":
+					atomic.AddInt32(&failed, int32(val))
+				default:
+					return
+				}
+				pinged <- struct{}{}
+			},
+		},
+		closed: make(chan struct{}),
+	}
+	p.serverPool.New = p.newServerConn
+	var conns []*agedConn
+	for i := 0; i < 5; i++ {
+		c, err := p.getServerConn(&p.serverPool)
+		ensure.Nil(t, err)
+		conns = append(conns, c.(*agedConn))
+	}
+	for _, c := range conns[:4] {
+		p.releaseServerConn(&p.serverPool, c)
+	}
+	clk.Add(30 * time.Second)
+
+	// The last connection was used since, so it isn't idle long enough to be
+	// pinged on the next tick.
+	p.releaseServerConn(&p.serverPool, conns[4])
+	p.wg.Add(1)
+	go p.keepAliveLoop(clk.Ticker(30 * time.Second))
+	clk.Add(30 * time.Second)
+	for i := 0; i < 4; i++ {
+		<-pinged
+	}
+	close(p.closed)
+	p.wg.Wait()
+
+	if ok != 2 || failed != 2 {
+		t.Fatalf("expected 2 ok and 2 failed pings got %d and %d", ok, failed)
+	}
+	if dials != 5 {
+		t.Fatalf("expected no dials by the keep-alive got %d", dials-5)
+	}
+	for i, c := range conns[:4] {
+		// The odd dials are the ones the server closed.
+		if expected := i%2 == 0; p.claimServerConn(c) != expected {
+			t.Fatalf("expected connection %d to be usable: %v", i, expected)
+		}
+	}
+}
+
+func TestDatabaseServerPools(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          3,
+			MaxPerClientConnections: 1,
+			MessageTimeout:          time.Second,
+			DatabaseMaxConnections:  map[string]uint{"a": 1, "b": 2},
+		},
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	cases := []struct {
+		Name   string
+		OpCode OpCode
+		Body   string
+		Max    uint
+	}{
+		{Name: "a", OpCode: OpInsert, Body: "\x00\x00\x00\x00a.foo\x00rest", Max: 1},
+		{Name: "b", OpCode: OpQuery, Body: "\x00\x00\x00\x00b.$cmd\x00rest", Max: 2},
+		{Name: "other", OpCode: OpDelete, Body: "\x00\x00\x00\x00c.foo\x00rest", Max: 3},
+		{Name: "no namespace", OpCode: OpKillCursors, Body: "rest", Max: 3},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func(body string) {
+			io.WriteString(server, body)
+			server.Close()
+		}(c.Body)
+		h := &messageHeader{OpCode: c.OpCode, MessageLength: int32(headerLen + len(c.Body))}
+		conn, pool, err := p.clientServerPool(h, client)
+		ensure.Nil(t, err)
+		if pool.Max != c.Max {
+			t.Fatalf("%s: expected pool with max %d got %d", c.Name, c.Max, pool.Max)
+		}
+		body, err := ioutil.ReadAll(conn)
+		ensure.Nil(t, err)
+		if string(body) != c.Body {
+			t.Fatalf("%s: expected body %q got %q", c.Name, c.Body, body)
+		}
+		client.Close()
+	}
+	if p.databasePools["a"] == p.databasePools["b"] {
+		t.Fatal("expected separate pools for a and b")
+	}
+}
+
+func TestTeeConnHexDump(t *testing.T) {
+	t.Parallel()
+	qh, body := fakeQuery("admin.$cmd", bson.D{{Name: "ping", Value: 1}})
+	rest, err := ioutil.ReadAll(body)
+	ensure.Nil(t, err)
+	query := append(qh.ToWire(), rest...)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write(query)
+		server.Close()
+	}()
+
+	var out bytes.Buffer
+	c := &teeConn{context: "test", mode: WireDumpHex, out: &out, Conn: client}
+	h, err := readHeader(c)
+	ensure.Nil(t, err)
+	_, err = io.CopyN(ioutil.Discard, c, int64(h.MessageLength-headerLen))
+	ensure.Nil(t, err)
+
+	expected := []string{
+		"READ test: opCode:QUERY (2004)",
+		"READ test: command ping on admin.$cmd",
+		"00000000  ",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out.String(), e) {
+			t.Fatalf("expected output to contain %q got:\n%s", e, out.String())
+		}
+	}
+}
+
+func TestStopWithTimeoutStuckClient(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		MongoAddr:      "fake:27017",
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Minute,
+			// The server reads the message but never replies.
+			Dial: func(network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				go io.Copy(ioutil.Discard, server)
+				return client, nil
+			},
+		},
+	}
+	ensure.Nil(t, p.Start())
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	h := messageHeader{OpCode: OpGetMore, MessageLength: headerLen + 4}
+	_, err = c.Write(append(h.ToWire(), 0, 0, 0, 0))
+	ensure.Nil(t, err)
+	for i := 0; p.ActiveConnections() != 1; i++ {
+		if i == 100 {
+			t.Fatal("client never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	forced, err := p.stopWithTimeout(100 * time.Millisecond)
+	ensure.Nil(t, err)
+	if forced != 1 {
+		t.Fatalf("expected 1 forcibly closed client got %d", forced)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stop took %s", elapsed)
+	}
+}
+
+func TestServerAcquireFailureCause(t *testing.T) {
+	t.Parallel()
+	failures := make(map[string]float64)
+	p := &Proxy{
+		Log:    &tLogger{TB: t},
+		closed: make(chan struct{}),
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				failures[key] += val
+			},
+		},
+	}
+	p.serverPool.New = func() (io.Closer, error) {
+		return nil, errors.New("could not connect")
+	}
+	_, err := p.getServerConn(&p.serverPool)
+	if err == nil {
+		t.Fatal("was expecting an error")
+	}
+	close(p.closed)
+	_, err = p.getServerConn(&p.serverPool)
+	if err == nil {
+		t.Fatal("was expecting an error")
+	}
+	expected := map[string]float64{
+		"server.acquire.failed.connect": 1,
+		"server.acquire.failed.closed":  1,
+	}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Fatalf("expected %v got %v", expected, failures)
+	}
+}
+
+type lingerConn struct {
+	net.Conn
+	linger []int
+}
+
+func (c *lingerConn) SetLinger(sec int) error {
+	c.linger = append(c.linger, sec)
+	return nil
+}
+
+func (c *lingerConn) Close() error {
+	return nil
+}
+
+func TestClientLinger(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Linger   time.Duration
+		Expected []int
+	}{
+		{Name: "default", Linger: 0},
+		{Name: "linger", Linger: 5 * time.Second, Expected: []int{5}},
+		{Name: "sub second", Linger: 500 * time.Millisecond, Expected: []int{1}},
+		{Name: "reset", Linger: -1, Expected: []int{0}},
+	}
+	for _, c := range cases {
+		p := &Proxy{
+			Log:        &tLogger{TB: t},
+			ReplicaSet: &ReplicaSet{ClientLinger: c.Linger},
+		}
+		conn := &lingerConn{}
+		p.closeClient(&teeConn{Conn: conn, out: ioutil.Discard})
+		if !reflect.DeepEqual(conn.linger, c.Expected) {
+			t.Fatalf("%s: expected linger %v got %v", c.Name, c.Expected, conn.linger)
+		}
+	}
+}
+
+// faultConn is a deadlineConn whose reads or writes fail with the given
+// errors.
+type faultConn struct {
+	deadlineConn
+	readErr  error
+	writeErr error
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	return c.deadlineConn.Read(b)
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	return c.deadlineConn.Write(b)
+}
+
+func TestServerConnReusable(t *testing.T) {
+	t.Parallel()
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	cases := []struct {
+		Name     string
+		OpCode   OpCode
+		Client   *faultConn
+		Server   *faultConn
+		Reusable bool
+	}{
+		{
+			Name:   "client write error",
+			OpCode: OpGetMore,
+			Client: &faultConn{
+				deadlineConn: deadlineConn{r: bytes.NewReader([]byte{0, 0, 0, 0})},
+				writeErr:     errors.New("broken pipe"),
+			},
+			Server:   &faultConn{deadlineConn: deadlineConn{r: bytes.NewReader(reply)}},
+			Reusable: true,
+		},
+		{
+			Name:   "client read error before sending",
+			OpCode: OpQuery,
+			Client: &faultConn{
+				deadlineConn: deadlineConn{r: bytes.NewReader(nil)},
+				readErr:      errors.New("connection reset"),
+			},
+			Server:   &faultConn{deadlineConn: deadlineConn{r: bytes.NewReader(reply)}},
+			Reusable: true,
+		},
+		{
+			Name:   "client read error after sending",
+			OpCode: OpGetMore,
+			Client: &faultConn{
+				deadlineConn: deadlineConn{r: bytes.NewReader(nil)},
+				readErr:      errors.New("connection reset"),
+			},
+			Server: &faultConn{deadlineConn: deadlineConn{r: bytes.NewReader(reply)}},
+		},
+		{
+			Name:   "unexpected reply opcode",
+			OpCode: OpGetMore,
+			Client: &faultConn{deadlineConn: deadlineConn{r: bytes.NewReader([]byte{0, 0, 0, 0})}},
+			Server: &faultConn{
+				deadlineConn: deadlineConn{
+					r: bytes.NewReader((&messageHeader{
+						OpCode:        OpMessage,
+						MessageLength: headerLen,
+					}).ToWire()),
+				},
+			},
+		},
+		{
+			Name:   "server read error",
+			OpCode: OpGetMore,
+			Client: &faultConn{deadlineConn: deadlineConn{r: bytes.NewReader([]byte{0, 0, 0, 0})}},
+			Server: &faultConn{
+				deadlineConn: deadlineConn{r: bytes.NewReader(nil)},
+				readErr:      errors.New("connection reset"),
+			},
+		},
+	}
+	for _, c := range cases {
+		log := &tLogger{TB: t}
+		p := &Proxy{
+			Log: log,
+			ReplicaSet: &ReplicaSet{
+				ProxyQuery:     &ProxyQuery{Log: log},
+				MessageTimeout: time.Minute,
+			},
+		}
+		h := &messageHeader{OpCode: c.OpCode, MessageLength: headerLen + 4}
+		client := &trackedConn{Conn: c.Client}
+		server := &trackedConn{Conn: c.Server}
+		if err := p.proxyMessage(h, client, server, &LastError{}); err == nil {
+			t.Fatalf("%s: was expecting an error", c.Name)
+		}
+		if reusable := serverConnReusable(client, server); reusable != c.Reusable {
+			t.Fatalf("%s: expected reusable %v got %v", c.Name, c.Reusable, reusable)
+		}
+	}
+}
+
+func TestTailableCursorTimeout(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	clk := clock.NewMock()
+	replicaSet := &ReplicaSet{
+		Clock:          clk,
+		MessageTimeout: time.Second,
+	}
+	replicaSet.ProxyQuery = &ProxyQuery{
+		Log:                   log,
+		ReplicaSet:            replicaSet,
+		TailableCursorTimeout: time.Hour,
+	}
+	p := &Proxy{Log: log, ReplicaSet: replicaSet}
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+
+	cases := []struct {
+		Name    string
+		Flags   int32
+		Timeout time.Duration
+	}{
+		{Name: "regular", Timeout: time.Second},
+		{Name: "tailable", Flags: queryFlagTailableCursor, Timeout: time.Hour},
+		{Name: "await data", Flags: queryFlagTailableCursor | queryFlagAwaitData, Timeout: time.Hour},
+	}
+	for _, c := range cases {
+		h, query := fakeQuery("test.capped", bson.M{})
+		body, err := ioutil.ReadAll(query)
+		ensure.Nil(t, err)
+		setInt32(body, 0, c.Flags)
+		client := &deadlineConn{r: bytes.NewReader(body)}
+		server := &deadlineConn{r: bytes.NewReader(reply)}
+		ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+
+		// The last deadline clears them, the one before is the effective one.
+		for _, d := range [][]time.Time{client.deadlines, server.deadlines} {
+			if timeout := d[len(d)-2].Sub(clk.Now()); timeout != c.Timeout {
+				t.Fatalf("%s: expected timeout %s got %s", c.Name, c.Timeout, timeout)
+			}
+		}
+	}
+}
+
+func TestDisableGetLastErrorCache(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			ProxyQuery: &ProxyQuery{
+				Log:                  log,
+				GetLastErrorRewriter: &GetLastErrorRewriter{Log: log},
+			},
+			MessageTimeout:           time.Second,
+			DisableGetLastErrorCache: true,
+		},
+	}
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1, "n": 0}))
+	ensure.Nil(t, err)
+
+	const calls = 3
+	server := &deadlineConn{r: bytes.NewReader(bytes.Repeat(reply, calls))}
+	var lastError LastError
+	for i := 0; i < calls; i++ {
+		h, query := fakeQuery("test.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+		body, err := ioutil.ReadAll(query)
+		ensure.Nil(t, err)
+		client := &deadlineConn{r: bytes.NewReader(body)}
+		ensure.Nil(t, p.proxyMessage(h, client, server, &lastError))
+	}
+	if server.r.Len() != 0 {
+		t.Fatalf("expected every getLastError to hit the server, %d bytes unread", server.r.Len())
+	}
+}
+
+func TestMaxConcurrentGetMore(t *testing.T) {
+	t.Parallel()
+	throttled := make(chan struct{}, 1)
+	limiter := make(chan struct{}, 1)
+	log := &tLogger{TB: t}
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Minute,
+			ProxyQuery:     &ProxyQuery{Log: log},
+			getMoreLimiter: limiter,
+		},
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "getmore.throttled" {
+					throttled <- struct{}{}
+				}
+			},
+		},
+	}
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	getMoreMsg := fakeOpMsg(t, 0, bson.D{{Name: "getMore", Value: int64(1)}, {Name: "$db", Value: "test"}})
+
+	cases := []struct {
+		Name  string
+		Msg   []byte
+		Reply []byte
+	}{
+		{
+			Name:  "OpGetMore",
+			Msg:   append((&messageHeader{OpCode: OpGetMore, MessageLength: headerLen + 4}).ToWire(), 0, 0, 0, 0),
+			Reply: reply,
+		},
+		{
+			Name:  "OpMsg",
+			Msg:   getMoreMsg,
+			Reply: fakeOpMsg(t, 0, bson.M{"ok": 1}),
+		},
+	}
+	for _, c := range cases {
+		// Occupy the only slot as if another getMore was in flight.
+		limiter <- struct{}{}
+		r := bytes.NewReader(c.Msg)
+		h, err := readHeader(r)
+		ensure.Nil(t, err)
+		client := &deadlineConn{r: r}
+		server := &deadlineConn{r: bytes.NewReader(c.Reply)}
+		errch := make(chan error, 1)
+		go func() { errch <- p.proxyMessage(h, client, server, &LastError{}) }()
+
+		<-throttled
+		select {
+		case err := <-errch:
+			t.Fatalf("%s: getMore over the limit was proxied: %v", c.Name, err)
+		default:
+		}
+		if server.r.Len() != len(c.Reply) {
+			t.Fatalf("%s: server was read before a slot was available", c.Name)
+		}
+
+		<-limiter
+		ensure.Nil(t, <-errch)
+		if len(limiter) != 0 {
+			t.Fatalf("%s: slot was not released", c.Name)
+		}
+	}
+}
+
+func TestProgressConn(t *testing.T) {
+	t.Parallel()
+	const window = 50 * time.Millisecond
+	doc, err := bson.Marshal(bson.M{"a": strings.Repeat("x", 64)})
+	ensure.Nil(t, err)
+
+	cases := []struct {
+		Name   string
+		Chunks int // number of 4 byte chunks sent, all if negative
+		Close  bool
+		Err    func(error) bool
+	}{
+		{Name: "slow but progressing", Chunks: -1},
+		{
+			Name:   "stalled",
+			Chunks: 1,
+			Err: func(err error) bool {
+				ne, ok := err.(net.Error)
+				return ok && ne.Timeout()
+			},
+		},
+		{
+			Name:   "truncated",
+			Chunks: 2,
+			Close:  true,
+			Err:    func(err error) bool { return err == io.ErrUnexpectedEOF },
+		},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func(chunks int, closeAfter bool) {
+			for i := 0; i < len(doc) && chunks != 0; i, chunks = i+4, chunks-1 {
+				time.Sleep(5 * time.Millisecond)
+				end := i + 4
+				if end > len(doc) {
+					end = len(doc)
+				}
+				if _, err := client.Write(doc[i:end]); err != nil {
+					return
+				}
+			}
+			if closeAfter {
+				client.Close()
+			}
+		}(c.Chunks, c.Close)
+
+		start := time.Now()
+		server.SetDeadline(start.Add(window))
+		pc := &progressConn{
+			Conn:   server,
+			extend: []net.Conn{server},
+			window: window,
+			until:  start.Add(5 * time.Second),
+			clock:  clock.New(),
+		}
+		actual, err := readDocument(pc)
+		if c.Err == nil {
+			ensure.Nil(t, err)
+			if !bytes.Equal(actual, doc) {
+				t.Fatalf("%s: expected %v got %v", c.Name, doc, actual)
+			}
+			if elapsed := time.Since(start); elapsed < window {
+				t.Fatalf("%s: document arrived within a single window in %s", c.Name, elapsed)
+			}
+		} else if !c.Err(err) {
+			t.Fatalf("%s: unexpected error %v", c.Name, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSetMaxPerClientConnections(t *testing.T) {
+	t.Parallel()
+	const ip = "10.0.0.1"
+	p := &Proxy{maxPerClientConnections: newMaxPerClientConnections(3)}
+	r := &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		MaxPerClientConnections: 3,
+		proxies:                 map[string]*Proxy{"proxy": p},
+	}
+	for i := 0; i < 2; i++ {
+		if p.maxPerClientConnections.inc(ip) {
+			t.Fatalf("connection %d rejected under the limit", i)
+		}
+	}
+
+	ensure.Nil(t, r.SetMaxPerClientConnections(2))
+	if r.MaxPerClientConnections != 2 {
+		t.Fatalf("expected the new limit to be kept for restarts, got %d", r.MaxPerClientConnections)
+	}
+	if !p.maxPerClientConnections.inc(ip) {
+		t.Fatal("connection over the lowered limit was accepted")
+	}
+	if p.maxPerClientConnections.inc("10.0.0.2") {
+		t.Fatal("connection from another client was rejected")
+	}
+	p.maxPerClientConnections.dec(ip)
+	if p.maxPerClientConnections.inc(ip) {
+		t.Fatal("connection under the lowered limit was rejected")
+	}
+
+	if err := r.SetMaxPerClientConnections(0); err != errZeroMaxPerClientConnections {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestProxiesSwappedConcurrently(t *testing.T) {
+	t.Parallel()
+	newProxies := func() map[string]*Proxy {
+		p := &Proxy{maxPerClientConnections: newMaxPerClientConnections(3)}
+		return map[string]*Proxy{"proxy": p}
+	}
+	r := &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		MaxPerClientConnections: 3,
+		proxies:                 newProxies(),
+	}
+
+	// Swap the proxies the way a Restart does while they are being used.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			r.lifecycleMutex.Lock()
+			r.proxies = newProxies()
+			r.lifecycleMutex.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ensure.Nil(t, r.SetMaxPerClientConnections(2))
+		r.TotalActiveConnections()
+	}
+	<-done
+}
+
+// timedEnd records how long a stats timer ran.
+type timedEnd struct {
+	start   time.Time
+	elapsed *time.Duration
+}
+
+func (e timedEnd) End() { *e.elapsed = time.Since(e.start) }
+
+func TestServerAcquireTime(t *testing.T) {
+	t.Parallel()
+	const wait = 20 * time.Millisecond
+	var acquire time.Duration
+	p := &Proxy{
+		Log: &tLogger{TB: t},
+		stats: &stats.HookClient{
+			BumpTimeHook: func(key string) interface {
+				End()
+			} {
+				if key != "server.acquire.time" {
+					t.Fatalf("unexpected timer %s", key)
+				}
+				return timedEnd{start: time.Now(), elapsed: &acquire}
+			},
+		},
+	}
+	// A slow New stands in for waiting on a pool at capacity.
+	p.serverPool.New = func() (io.Closer, error) {
+		time.Sleep(wait)
+		return &deadlineConn{}, nil
+	}
+	_, err := p.getServerConn(&p.serverPool)
+	ensure.Nil(t, err)
+	if acquire < wait {
+		t.Fatalf("expected acquire time of at least %s got %s", wait, acquire)
+	}
+}
+
+func TestClientWriteTimeout(t *testing.T) {
+	t.Parallel()
+	const timeout = 20 * time.Millisecond
+	p := &Proxy{
+		Log: &tLogger{TB: t},
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout:     time.Minute,
+			ClientWriteTimeout: timeout,
+		},
+	}
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	body := []byte{0, 0, 0, 0}
+	h := &messageHeader{
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     1,
+		OpCode:        OpGetMore,
+	}
+
+	// The client sends its request but never reads the reply.
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+	go peer.Write(body)
+	server := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(reply)}}
+
+	start := time.Now()
+	err = p.proxyMessage(h, client, server, &LastError{})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected a timeout error got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("client was only disconnected after %s", elapsed)
+	}
+}
+
+func TestReadOnlyRejectsLegacyWrites(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	var rejected float64
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			ProxyQuery: &ProxyQuery{
+				Log:                  log,
+				GetLastErrorRewriter: &GetLastErrorRewriter{Log: log},
+			},
+			MessageTimeout: time.Second,
+			ReadOnly:       true,
+			// The rejection must survive the cache being disabled.
+			DisableGetLastErrorCache: true,
+		},
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "write.rejected" {
+					rejected += val
+				}
+			},
+		},
+	}
+
+	doc, err := bson.Marshal(bson.M{"_id": 1})
+	ensure.Nil(t, err)
+	insert := append([]byte{0, 0, 0, 0}, "test.c\x00"...)
+	insert = append(insert, doc...)
+	h := &messageHeader{
+		MessageLength: int32(headerLen + len(insert)),
+		RequestID:     1,
+		OpCode:        OpInsert,
+	}
+	server := &recordingConn{}
+	client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(insert)}}
+	var lastError LastError
+	ensure.Nil(t, p.proxyMessage(h, client, server, &lastError))
+	if server.written.Len() != 0 {
+		t.Fatalf("insert reached the server: %v", server.written.Bytes())
+	}
+	if rejected != 1 {
+		t.Fatalf("expected 1 rejected write got %v", rejected)
+	}
+
+	gleH, query := fakeQuery("test.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+	body, err := ioutil.ReadAll(query)
+	ensure.Nil(t, err)
+	client = &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}}
+	ensure.Nil(t, p.proxyMessage(gleH, client, server, &lastError))
+	if server.written.Len() != 0 {
+		t.Fatalf("getLastError reached the server: %v", server.written.Bytes())
+	}
+	replyH, err := readHeader(&client.written)
+	ensure.Nil(t, err)
+	if replyH.ResponseTo != gleH.RequestID {
+		t.Fatalf("expected reply to %d got %d", gleH.RequestID, replyH.ResponseTo)
+	}
+	var reply bson.M
+	ensure.Nil(t, bson.Unmarshal(client.written.Bytes()[len(emptyPrefix):], &reply))
+	if reply["errmsg"] != errReadOnly {
+		t.Fatalf("unexpected getLastError reply %v", reply)
+	}
+}
+
+func TestAllowedDatabasesRejectsLegacyOps(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	var denied float64
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			ProxyQuery: &ProxyQuery{
+				Log:                  log,
+				GetLastErrorRewriter: &GetLastErrorRewriter{Log: log},
+				AllowedDatabases:     []string{"app"},
+			},
+			MessageTimeout: time.Second,
+		},
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "database.denied" {
+					denied += val
+				}
+			},
+		},
+	}
+	const msg = "database other not allowed by proxy"
+
+	doc, err := bson.Marshal(bson.M{"_id": 1})
+	ensure.Nil(t, err)
+	insert := func(ns string) (*messageHeader, []byte) {
+		body := append(append([]byte{0, 0, 0, 0}, ns+"\x00"...), doc...)
+		return &messageHeader{
+			MessageLength: int32(headerLen + len(body)),
+			RequestID:     1,
+			OpCode:        OpInsert,
+		}, body
+	}
+
+	// A denied insert never reaches the server, and the getLastError reports
+	// the rejection.
+	h, body := insert("other.c")
+	server := &recordingConn{}
+	client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}}
+	var lastError LastError
+	ensure.Nil(t, p.proxyMessage(h, client, server, &lastError))
+	if server.written.Len() != 0 {
+		t.Fatalf("insert reached the server: %v", server.written.Bytes())
+	}
+	gleH, query := fakeQuery("other.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+	gle, err := ioutil.ReadAll(query)
+	ensure.Nil(t, err)
+	client = &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(gle)}}
+	ensure.Nil(t, p.proxyMessage(gleH, client, server, &lastError))
+	if server.written.Len() != 0 {
+		t.Fatalf("getLastError reached the server: %v", server.written.Bytes())
+	}
+	assertErrorReply(t, &client.written, gleH.RequestID, msg)
+
+	// A denied getMore is answered with the same error.
+	getMore := append(append([]byte{0, 0, 0, 0}, "other.c\x00"...), 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0)
+	getMoreH := &messageHeader{
+		MessageLength: int32(headerLen + len(getMore)),
+		RequestID:     2,
+		OpCode:        OpGetMore,
+	}
+	client = &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(getMore)}}
+	ensure.Nil(t, p.proxyMessage(getMoreH, client, server, &LastError{}))
+	if server.written.Len() != 0 {
+		t.Fatalf("getMore reached the server: %v", server.written.Bytes())
+	}
+	assertErrorReply(t, &client.written, getMoreH.RequestID, msg)
+
+	if denied != 2 {
+		t.Fatalf("expected 2 denied messages got %v", denied)
+	}
+
+	// An insert to an allowed database is proxied as is.
+	h, body = insert("app.c")
+	client = &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}}
+	ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+	if expected := append(h.ToWire(), body...); !bytes.Equal(server.written.Bytes(), expected) {
+		t.Fatalf("expected the insert proxied as %v got %v", expected, server.written.Bytes())
+	}
+}
+
+func TestReadOnlyRejectsWriteCommands(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	replicaSet := &ReplicaSet{
+		MessageTimeout: time.Minute,
+		ReadOnly:       true,
+	}
+	// Only the ReplicaSet is read-only, the ProxyQuery gets it like inject
+	// would set it.
+	replicaSet.ProxyQuery = &ProxyQuery{Log: log, ReplicaSet: replicaSet}
+	p := &Proxy{Log: log, ReplicaSet: replicaSet}
+
+	insert := bson.D{
+		{Name: "insert", Value: "c"},
+		{Name: "documents", Value: []bson.M{{"_id": 1}}},
+	}
+	queryH, query := fakeQuery("test.$cmd", insert)
+	queryBody, err := ioutil.ReadAll(query)
+	ensure.Nil(t, err)
+	msg := fakeOpMsg(t, 0, append(insert, bson.DocElem{Name: "$db", Value: "test"}))
+	msgH, err := readHeader(bytes.NewReader(msg))
+	ensure.Nil(t, err)
+
+	cases := []struct {
+		Name string
+		H    *messageHeader
+		Body []byte
+	}{
+		{Name: "OpQuery", H: queryH, Body: queryBody},
+		{Name: "OpMsg", H: msgH, Body: msg[headerLen:]},
+	}
+	for _, c := range cases {
+		server := &recordingConn{}
+		client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(c.Body)}}
+		ensure.Nil(t, p.proxyMessage(c.H, client, server, &LastError{}))
+		if server.written.Len() != 0 {
+			t.Fatalf("%s: insert reached the server: %v", c.Name, server.written.Bytes())
+		}
+		if !bytes.Contains(client.written.Bytes(), []byte(errReadOnly)) {
+			t.Fatalf("%s: expected read-only error got %v", c.Name, client.written.Bytes())
+		}
+	}
+}
+
+func TestStopDrainsAcceptQueue(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: l,
+		ReplicaSet:     &ReplicaSet{AcceptDrainTimeout: 100 * time.Millisecond},
+		closed:         make(chan struct{}),
+		draining:       make(chan struct{}),
+	}
+
+	// Connect and send a query before the proxy accepts anything, leaving the
+	// clients queued in the kernel.
+	h, query := fakeQuery("test.$cmd", bson.D{{Name: "ping", Value: 1}})
+	body, err := ioutil.ReadAll(query)
+	ensure.Nil(t, err)
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		ensure.Nil(t, err)
+		defer c.Close()
+		_, err = c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		clients = append(clients, c)
+	}
+
+	stopped := make(chan error)
+	go func() { stopped <- p.Stop() }()
+	<-p.draining
+	go p.clientAcceptLoop()
+
+	for _, c := range clients {
+		c.SetDeadline(time.Now().Add(time.Second))
+		replyH, err := readHeader(c)
+		ensure.Nil(t, err)
+		if replyH.ResponseTo != h.RequestID {
+			t.Fatalf("expected reply to %d got %d", h.RequestID, replyH.ResponseTo)
+		}
+		rest := make([]byte, replyH.MessageLength-headerLen)
+		_, err = io.ReadFull(c, rest)
+		ensure.Nil(t, err)
+		var reply bson.M
+		ensure.Nil(t, bson.Unmarshal(rest[len(emptyPrefix):], &reply))
+		if reply["errmsg"] != errStopping.Error() {
+			t.Fatalf("unexpected reply %v", reply)
+		}
+	}
+	ensure.Nil(t, <-stopped)
+}
+
+func TestServerConnMaxLifetime(t *testing.T) {
+	t.Parallel()
+	var expired float64
+	clk := clock.NewMock()
+	p := &Proxy{
+		Log: &tLogger{TB: t},
+		ReplicaSet: &ReplicaSet{
+			ServerConnMaxLifetime: time.Minute,
+			Clock:                 clk,
+			Dial: func(network, address string) (net.Conn, error) {
+				return &deadlineConn{}, nil
+			},
+		},
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "server.conn.expired" {
+					expired += val
+				}
+			},
+		},
+	}
+	p.serverPool.New = p.newServerConn
+
+	c, err := p.getServerConn(&p.serverPool)
+	ensure.Nil(t, err)
+	clk.Add(time.Minute - time.Second)
+	p.releaseServerConn(&p.serverPool, c)
+	if expired != 0 {
+		t.Fatal("connection within its lifetime was discarded")
+	}
+	clk.Add(time.Second)
+	p.releaseServerConn(&p.serverPool, c)
+	if expired != 1 {
+		t.Fatalf("expected the connection past its lifetime to be discarded, got %v", expired)
+	}
+}
+
+func TestResetServerConns(t *testing.T) {
+	t.Parallel()
+	var stale float64
+	p := &Proxy{
+		Log: &tLogger{TB: t},
+		ReplicaSet: &ReplicaSet{
+			Dial: func(network, address string) (net.Conn, error) {
+				return &deadlineConn{}, nil
+			},
+		},
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "server.conn.stale" {
+					stale += val
+				}
+			},
+		},
+	}
+	p.serverPool.New = p.newServerConn
+
+	before, err := p.getServerConn(&p.serverPool)
+	ensure.Nil(t, err)
+	p.resetServerConns()
+	after, err := p.getServerConn(&p.serverPool)
+	ensure.Nil(t, err)
+	p.releaseServerConn(&p.serverPool, after)
+	if stale != 0 {
+		t.Fatal("connection made after the reset was discarded")
+	}
+	p.releaseServerConn(&p.serverPool, before)
+	if stale != 1 {
+		t.Fatalf("expected the connection made before the reset to be discarded, got %v", stale)
+	}
+}
+
+func TestProxyMessageCompressed(t *testing.T) {
+	t.Parallel()
+	compress := func(op OpCode, body []byte) (*messageHeader, []byte) {
+		parts, err := compressMessage(&messageHeader{
+			RequestID:    1,
+			OpCode:       op,
+			compressorID: compressorZlib,
+		}, body)
+		ensure.Nil(t, err)
+		msg := bytes.Join(parts, nil)
+		h, err := readHeader(bytes.NewReader(msg))
+		ensure.Nil(t, err)
+		return h, msg[headerLen:]
+	}
+	_, isMaster := fakeQuery("admin.$cmd", bson.D{{Name: "isMaster", Value: 1}})
+	isMasterBody, err := ioutil.ReadAll(isMaster)
+	ensure.Nil(t, err)
+	doc, err := bson.Marshal(bson.M{"_id": 1})
+	ensure.Nil(t, err)
+	insertBody := append(append([]byte{0, 0, 0, 0}, "test.c\x00"...), doc...)
+	getMoreBody := append(append([]byte{0, 0, 0, 0}, "test.c\x00"...), 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0)
+	isMasterReply, err := ioutil.ReadAll(fakeCompressedSingleDocReply(bson.M{"hosts": []string{"a"}}))
+	ensure.Nil(t, err)
+
+	cases := []struct {
+		Name         string
+		OpCode       OpCode
+		Body         []byte
+		Reply        []byte
+		Decompressed bool
+	}{
+		{Name: "isMaster", OpCode: OpQuery, Body: isMasterBody, Reply: isMasterReply, Decompressed: true},
+		{Name: "insert", OpCode: OpInsert, Body: insertBody, Decompressed: true},
+		{Name: "getMore", OpCode: OpGetMore, Body: getMoreBody, Reply: fakeReply(t, 0, bson.M{"_id": 1})},
+	}
+	for _, c := range cases {
+		log := &tLogger{TB: t}
+		isMasterRewriter := newTestIsMasterResponseRewriter(t)
+		isMasterRewriter.ProxyMapper = fakeProxyMapper{m: map[string]string{"a": "1"}}
+		p := &Proxy{
+			Log: log,
+			ReplicaSet: &ReplicaSet{
+				ProxyQuery: &ProxyQuery{
+					Log:                      log,
+					IsMasterResponseRewriter: isMasterRewriter,
+				},
+				MessageTimeout: time.Minute,
+			},
+		}
+		h, body := compress(c.OpCode, c.Body)
+		compressedH := *h
+		client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}}
+		server := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(c.Reply)}}
+		ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+
+		// Decompressed requests reach the server as the original message, and
+		// the header is replaced so the caller sees the original opcode.
+		expected := append(compressedH.ToWire(), body...)
+		if c.Decompressed {
+			if h.OpCode != c.OpCode {
+				t.Fatalf("%s: expected the header opcode %s got %s", c.Name, c.OpCode, h.OpCode)
+			}
+			expected = append(h.ToWire(), c.Body...)
+		}
+		if !bytes.Equal(server.written.Bytes(), expected) {
+			t.Fatalf("%s: expected %v sent got %v", c.Name, expected, server.written.Bytes())
+		}
+		if c.Reply == nil {
+			continue
+		}
+		if c.OpCode == OpQuery {
+			var actual isMasterResponse
+			_, _, _, err := isMasterRewriter.ReplyRW.ReadOne(&client.written, &actual)
+			ensure.Nil(t, err)
+			if !reflect.DeepEqual(actual.Hosts, []string{"1"}) {
+				t.Fatalf("%s: reply was not rewritten: %+v", c.Name, actual)
+			}
+			continue
+		}
+		if !bytes.Equal(client.written.Bytes(), c.Reply) {
+			t.Fatalf("%s: expected %v received got %v", c.Name, c.Reply, client.written.Bytes())
+		}
+	}
+}
+
+func TestProxyMessageCompressedGetMoreMaxReplyDocs(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			ProxyQuery:     &ProxyQuery{Log: log, MaxReplyDocs: 1},
+			MessageTimeout: time.Minute,
+		},
+	}
+	getMoreBody := append(append([]byte{0, 0, 0, 0}, "test.c\x00"...), 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0)
+	parts, err := compressMessage(&messageHeader{
+		RequestID:    1,
+		OpCode:       OpGetMore,
+		compressorID: compressorZlib,
+	}, getMoreBody)
+	ensure.Nil(t, err)
+	msg := bytes.Join(parts, nil)
+	h, err := readHeader(bytes.NewReader(msg))
+	ensure.Nil(t, err)
+
+	// The getMore reaches the server decompressed, so the reply to limit is
+	// uncompressed too.
+	docs := []interface{}{bson.M{"_id": 1}, bson.M{"_id": 2}}
+	client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(msg[headerLen:])}}
+	server := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(fakeReply(t, 7, docs...))}}
+	ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+	sent, err := readHeader(&server.written)
+	ensure.Nil(t, err)
+	if sent.OpCode != OpGetMore {
+		t.Fatalf("expected the getMore to be decompressed got %s", sent.OpCode)
+	}
+	if expected := fakeReply(t, 0, docs[:1]...); !bytes.Equal(client.written.Bytes(), expected) {
+		t.Fatalf("expected reply %v got %v", expected, client.written.Bytes())
+	}
+}
+
+func TestProxyMessageUnsupportedCompressor(t *testing.T) {
+	t.Parallel()
+	// The compressed body can't be decompressed, so it's never looked at.
+	body := make([]byte, compressedPrefixLen, compressedPrefixLen+8)
+	setInt32(body, 0, int32(OpMsg))
+	setInt32(body, 4, 64)
+	body[8] = 3
+	body = append(body, "zstd...."...)
+	compressedH := messageHeader{
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     1,
+		OpCode:        OpCompressed,
+	}
+	reply := fakeOpMsg(t, 0, bson.M{"ok": 1})
+
+	cases := []struct {
+		Name     string
+		ReadOnly bool
+	}{
+		{Name: "passed through"},
+		{Name: "read-only", ReadOnly: true},
+	}
+	for _, c := range cases {
+		var unsupported float64
+		log := &tLogger{TB: t}
+		p := &Proxy{
+			Log: log,
+			ReplicaSet: &ReplicaSet{
+				ProxyQuery:     &ProxyQuery{Log: log},
+				MessageTimeout: time.Minute,
+				ReadOnly:       c.ReadOnly,
+			},
+			stats: &stats.HookClient{
+				BumpSumHook: func(key string, n float64) {
+					if key == "message.compressed.unsupported" {
+						unsupported += n
+					}
+				},
+			},
+		}
+		h := compressedH
+		client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}}
+		server := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(reply)}}
+		err := p.proxyMessage(&h, client, server, &LastError{})
+
+		if c.ReadOnly {
+			if err == nil || err.Error() != "unsupported compressor 3" {
+				t.Fatalf("%s: expected an unsupported compressor error got %v", c.Name, err)
+			}
+			if server.written.Len() != 0 {
+				t.Fatalf("%s: expected nothing sent got %v", c.Name, server.written.Bytes())
+			}
+			continue
+		}
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, unsupported, float64(1))
+		expected := append(compressedH.ToWire(), body...)
+		if !bytes.Equal(server.written.Bytes(), expected) {
+			t.Fatalf("%s: expected %v sent got %v", c.Name, expected, server.written.Bytes())
+		}
+		if !bytes.Equal(client.written.Bytes(), reply) {
+			t.Fatalf("%s: expected %v received got %v", c.Name, reply, client.written.Bytes())
+		}
+	}
+}
+
+func TestNoTimeoutCursorsReaped(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	clk := clock.NewMock()
+	var dialed []*recordingConn
+	var reaped float64
+	killed := make(chan struct{}, 1)
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			Clock:                   clk,
+			MessageTimeout:          time.Minute,
+			NoTimeoutCursorLifetime: time.Minute,
+			ProxyQuery:              &ProxyQuery{Log: log},
+			Dial: func(network, address string) (net.Conn, error) {
+				c := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(nil)}}
+				dialed = append(dialed, c)
+				return c, nil
+			},
+		},
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "cursor.no.timeout.reaped" {
+					reaped += val
+					killed <- struct{}{}
+				}
+			},
+		},
+	}
+	p.serverPool.New = p.newServerConn
+
+	query := func(flags int32, cursorID byte) {
+		doc, err := bson.Marshal(bson.M{"a": 1})
+		ensure.Nil(t, err)
+		body := make([]byte, 4)
+		setInt32(body, 0, flags)
+		body = append(body, "test.c\x00"...)
+		body = append(body, 0, 0, 0, 0, 0, 0, 0, 0)
+		body = append(body, doc...)
+		h := &messageHeader{OpCode: OpQuery, MessageLength: int32(headerLen + len(body))}
+		client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}}
+		server := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(fakeReply(t, cursorID, bson.M{"_id": 1}))}}
+		ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+	}
+	query(queryFlagNoCursorTimeout, 5)
+	query(queryFlagNoCursorTimeout, 0)
+	query(0, 6)
+	ensure.DeepEqual(t, len(p.noTimeoutCursors), 1)
+
+	p.reapNoTimeoutCursors()
+	ensure.DeepEqual(t, len(dialed), 0)
+
+	p.closed = make(chan struct{})
+	p.wg.Add(1)
+	go p.cursorReapLoop(clk.Ticker(time.Minute))
+	clk.Add(time.Minute)
+	<-killed
+	close(p.closed)
+	p.wg.Wait()
+	ensure.DeepEqual(t, len(dialed), 1)
+	var expected bytes.Buffer
+	ensure.Nil(t, writeKillCursors(&expected, []byte{5, 0, 0, 0, 0, 0, 0, 0}))
+	ensure.DeepEqual(t, dialed[0].written.Bytes(), expected.Bytes())
+	ensure.DeepEqual(t, reaped, float64(1))
+	ensure.DeepEqual(t, len(p.noTimeoutCursors), 0)
+}
+
+func TestPipelinedRequestsWaitForReply(t *testing.T) {
+	t.Parallel()
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	var received int32
+	replied := make(chan struct{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		MongoAddr:      "fake:27017",
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Minute,
+			// The server holds its replies until the test lets them go.
+			Dial: func(network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				go func() {
+					for {
+						h, err := readHeader(server)
+						if err != nil {
+							return
+						}
+						if _, err := io.CopyN(ioutil.Discard, server, int64(h.MessageLength-headerLen)); err != nil {
+							return
+						}
+						atomic.AddInt32(&received, 1)
+						<-replied
+						if _, err := server.Write(reply); err != nil {
+							return
+						}
+					}
+				}()
+				return client, nil
+			},
+		},
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	// The client pipelines two requests without waiting for a reply.
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	var pipelined []byte
+	for i := int32(1); i <= 2; i++ {
+		h := messageHeader{OpCode: OpGetMore, MessageLength: headerLen + 4, RequestID: i}
+		pipelined = append(pipelined, append(h.ToWire(), 0, 0, 0, 0)...)
+	}
+	_, err = c.Write(pipelined)
+	ensure.Nil(t, err)
+
+	waitReceived := func(n int32) {
+		for i := 0; atomic.LoadInt32(&received) != n; i++ {
+			if i == 100 {
+				t.Fatalf("expected %d requests got %d", n, atomic.LoadInt32(&received))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitReceived(1)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&received); n != 1 {
+		t.Fatalf("second request was proxied before the first reply, got %d", n)
+	}
+	close(replied)
+	waitReceived(2)
+}
+
+func TestTailableQueryPinsServerConn(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	p := &Proxy{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Minute,
+			ProxyQuery:     &ProxyQuery{Log: log},
+		},
+	}
+	cases := []struct {
+		Flags  int32
+		Pinned bool
+	}{
+		{Flags: 0},
+		{Flags: queryFlagNoCursorTimeout},
+		{Flags: queryFlagTailableCursor, Pinned: true},
+		{Flags: queryFlagTailableCursor | queryFlagAwaitData, Pinned: true},
+	}
+	for _, c := range cases {
+		doc, err := bson.Marshal(bson.M{})
+		ensure.Nil(t, err)
+		body := make([]byte, 4)
+		setInt32(body, 0, c.Flags)
+		body = append(body, "test.capped\x00"...)
+		body = append(body, 0, 0, 0, 0, 0, 0, 0, 0)
+		body = append(body, doc...)
+		h := &messageHeader{OpCode: OpQuery, MessageLength: int32(headerLen + len(body))}
+		client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}}
+		server := &trackedConn{
+			Conn: &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(fakeReply(t, 7, bson.M{"_id": 1}))}},
+		}
+		ensure.Nil(t, p.proxyMessage(h, client, server, &LastError{}))
+		if server.pinCursor != c.Pinned {
+			t.Fatalf("flags %d: expected pinned %v got %v", c.Flags, c.Pinned, server.pinCursor)
+		}
+	}
+}
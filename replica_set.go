@@ -1,15 +1,23 @@
 package dvara
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
 	"os"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/facebookgo/clock"
 	"github.com/facebookgo/stackerr"
 	"github.com/facebookgo/stats"
 )
@@ -32,7 +40,12 @@ type Logger interface {
 	Debugf(format string, args ...interface{})
 }
 
-var errNoAddrsGiven = errors.New("dvara: no seed addresses given for ReplicaSet")
+var (
+	errNoAddrsGiven          = errors.New("dvara: no seed addresses given for ReplicaSet")
+	errDirectConnectionAddrs = errors.New("dvara: DirectConnection requires exactly one address")
+)
+
+const defaultMaxMembers = 12
 
 // ReplicaSet manages the real => proxy address mapping.
 // NewReplicaSet returns the ReplicaSet given the list of seed servers. It is
@@ -40,9 +53,9 @@ var errNoAddrsGiven = errors.New("dvara: no seed addresses given for ReplicaSet"
 // they are reachable. That is, if two of the addresses are members of
 // different replica sets, it will be considered an error.
 type ReplicaSet struct {
-	Log                    Logger                  `inject:""`
-	ReplicaSetStateCreator *ReplicaSetStateCreator `inject:""`
-	ProxyQuery             *ProxyQuery             `inject:""`
+	Log                    Logger       `inject:""`
+	ReplicaSetStateCreator StateCreator `inject:""`
+	ProxyQuery             *ProxyQuery  `inject:""`
 
 	// Stats if provided will be used to record interesting stats.
 	Stats stats.Client `inject:""`
@@ -50,17 +63,68 @@ type ReplicaSet struct {
 	// Comma separated list of mongo addresses. This is the list of "seed"
 	// servers, and one of two conditions must be met for each entry here -- it's
 	// either alive and part of the same replica set as all others listed, or is
-	// not reachable.
+	// not reachable. An entry may carry hints as query parameters, for example
+	// "host:port?role=arbiter" marks a known arbiter which isn't probed and is
+	// ignored for traffic.
 	Addrs string
 
+	// StartupTimeout if non zero bounds how long Start will wait for the seed
+	// addresses to be probed before failing.
+	StartupTimeout time.Duration
+
+	// MaxMembers is the maximum number of members, and hence proxies, we'll
+	// allow. It guards against accidentally allocating a large number of ports.
+	// Defaults to 12.
+	MaxMembers uint
+
 	// PortStart and PortEnd define the port range within which proxies will be
 	// allocated.
 	PortStart int
 	PortEnd   int
 
+	// DirectConnection if true proxies exactly the one given address without
+	// discovering the replica set, even if the node is a member of one. This
+	// allows maintenance access to a specific member. ProxyQuery.DirectConnection
+	// should be set along with it to leave the member lists in replies alone.
+	DirectConnection bool
+
+	// ExcludeDelayedMembers if true prevents proxying to delayed secondaries,
+	// which are also dropped from the rewritten member lists.
+	ExcludeDelayedMembers bool
+
+	// ExcludeNonVotingMembers if true prevents proxying to members configured
+	// to not vote, which are also dropped from the rewritten member lists.
+	ExcludeNonVotingMembers bool
+
 	// Maximum number of connections that will be established to each mongo node.
 	MaxConnections uint
 
+	// DatabaseMaxConnections optionally partitions the server connections by
+	// database. Each database listed gets its own pool of up to the given number
+	// of connections to each mongo node, so heavy traffic to one database can't
+	// starve another. All other databases share the MaxConnections pool.
+	DatabaseMaxConnections map[string]uint
+
+	// MaxConcurrentDials if non zero limits the number of server connections
+	// being dialed at the same time across all the proxies. This prevents a
+	// reconnect storm against a backend that is down.
+	MaxConcurrentDials uint
+
+	// MaxConcurrentGetMore if non zero limits the number of getMore operations
+	// in flight at the same time across all the proxies. The excess waits for a
+	// slot, protecting quick queries during large scans.
+	MaxConcurrentGetMore uint
+
+	// Dial is used to establish server connections. It defaults to net.Dial.
+	Dial func(network, address string) (net.Conn, error)
+
+	// ProbeOnStart if true makes Start connect to each member once before
+	// starting the proxies. Start fails if none of the members can be
+	// connected to, and logs and records the members that can't be if some
+	// can. Restarts don't probe, members being briefly unreachable is expected
+	// during the elections that trigger them.
+	ProbeOnStart bool
+
 	// MinIdleConnections is the number of idle server connections we'll keep
 	// around.
 	MinIdleConnections uint
@@ -69,6 +133,25 @@ type ReplicaSet struct {
 	// considered idle.
 	ServerIdleTimeout time.Duration
 
+	// ServerConnMaxLifetime if non zero is how long a server connection is
+	// used for. Older connections are discarded instead of being returned to
+	// the pool, regardless of how busy they are.
+	ServerConnMaxLifetime time.Duration
+
+	// NoTimeoutCursorLifetime if non zero is how long cursors opened by queries
+	// with the noCursorTimeout flag are allowed to live. mongo never times
+	// these out, so cursors abandoned by clients would otherwise stay open on
+	// the server. They are killed between one and one and a half lifetimes
+	// after being opened, whether they're still in use or not.
+	NoTimeoutCursorLifetime time.Duration
+
+	// ServerKeepAliveInterval if non zero is how long server connections may
+	// sit idle in the pool before they're pinged. This keeps them from being
+	// closed by mongo and detects ones that already have been. It should be
+	// under half the mongo socket timeout, as connections are checked at this
+	// interval too.
+	ServerKeepAliveInterval time.Duration
+
 	// ServerClosePoolSize is the number of goroutines that will handle closing
 	// server connections.
 	ServerClosePoolSize uint
@@ -77,18 +160,124 @@ type ReplicaSet struct {
 	// idle and disconnect and release it's resources.
 	ClientIdleTimeout time.Duration
 
+	// AcceptConcurrency is the number of goroutines accepting client
+	// connections for each proxy. Defaults to 1.
+	AcceptConcurrency uint
+
+	// AcceptDrainTimeout if non zero keeps the listeners open this long when
+	// stopping, answering clients already queued to connect with a shutting
+	// down error instead of resetting them. It is bounded by the timeout given
+	// to StopWithTimeout.
+	AcceptDrainTimeout time.Duration
+
+	// ClientLinger if non zero sets SO_LINGER on client connections when dvara
+	// closes them. Positive values linger for that long, rounded up to whole
+	// seconds, while negative values reset the connection right away, avoiding
+	// TIME_WAIT.
+	ClientLinger time.Duration
+
+	// ClientKeepAliveInterval and ClientKeepAliveCount if non zero set the time
+	// between TCP keep-alive probes of idle clients, and the number of
+	// unanswered probes after which the client is considered gone. This
+	// detects clients whose machine went away well before ClientIdleTimeout.
+	// The system defaults are used otherwise.
+	ClientKeepAliveInterval time.Duration
+	ClientKeepAliveCount    int
+
 	// MaxPerClientConnections is how many client connections are allowed from a
 	// single client.
 	MaxPerClientConnections uint
 
+	// MaxConnectionsPerSecond if non zero limits the rate at which new client
+	// connections are accepted across all the proxies. Connections over the
+	// limit are delayed by up to a second, and closed if they'd have to wait
+	// longer. This protects mongo when all clients reconnect at once.
+	MaxConnectionsPerSecond uint
+
 	// GetLastErrorTimeout is how long we'll hold on to an acquired server
 	// connection expecting a possibly getLastError call.
 	GetLastErrorTimeout time.Duration
 
+	// DisableGetLastErrorCache if true sends every getLastError call to the
+	// server instead of replaying a cached response. This costs a round trip
+	// but avoids replaying a response for a different write concern.
+	DisableGetLastErrorCache bool
+
+	// StickyClientSessions if true makes each client connection hold on to the
+	// server connection used for its first message until it disconnects, so
+	// all its messages go to the same server connection. This gives clients
+	// read-your-writes consistency at the cost of pooling: every connected
+	// client holds a server connection, so MaxConnections needs to be about as
+	// large as the number of clients.
+	StickyClientSessions bool
+
+	// ReadOnly if true rejects inserts, updates, deletes and any command not
+	// known to only read instead of proxying them. Rejected legacy writes are
+	// reported by the following getLastError call, commands get an error reply.
+	ReadOnly bool
+
 	// MessageTimeout is used to determine the timeout for a single message to be
 	// proxied.
 	MessageTimeout time.Duration
 
+	// SlowMessageThreshold if non zero is the duration after which a proxied
+	// message, including its response, is logged and counted as slow. The log
+	// includes the namespace of queries, getMores and mutations.
+	SlowMessageThreshold time.Duration
+
+	// MaxMessageReadTime if greater than the message timeout allows a client
+	// sending a message slowly further message timeout windows, as long as each
+	// window makes progress, up to this long in total.
+	MaxMessageReadTime time.Duration
+
+	// ClientWriteTimeout if non zero bounds each write of a reply to a client.
+	// A client that stops reading replies is disconnected once it's hit instead
+	// of holding a server connection until the message timeout. Requests a
+	// client pipelines behind an unread reply aren't read in the meantime.
+	ClientWriteTimeout time.Duration
+
+	// OpTimeouts optionally overrides MessageTimeout for specific operations.
+	// This allows for example giving mutations a generous timeout while keeping
+	// queries on a tight one.
+	OpTimeouts map[OpCode]time.Duration
+
+	// WireDump if set dumps the data on new client connections to stdout for
+	// debugging.
+	WireDump WireDump
+
+	// ResolveInterval if non zero is how often the member hostnames will be
+	// resolved again. If the addresses a member resolves to change, the
+	// server connections of its proxy are replaced by ones to the new
+	// addresses.
+	ResolveInterval time.Duration
+
+	// RuntimeStatsInterval if non zero is how often the number of goroutines
+	// and the memory usage are recorded in Stats.
+	RuntimeStatsInterval time.Duration
+
+	// AuditWriter if set receives a JSON line for each insert, update, delete
+	// and write command with the time, client IP, namespace and operation.
+	// Document contents are not recorded.
+	AuditWriter io.Writer
+
+	// TLSConfig is the TLS configuration for client and server connections.
+	// dvara doesn't terminate or originate TLS yet, but Start already rejects
+	// a config that doesn't satisfy ValidateTLSConfig, so it's in line with
+	// the policy once it does.
+	TLSConfig *tls.Config
+
+	// Clock is used for the deadlines, sleeps and tickers. It defaults to the
+	// real clock.
+	Clock clock.Clock
+
+	// LookupHost is used to resolve member hostnames and the proxy hostname. It
+	// defaults to net.LookupHost.
+	LookupHost func(host string) ([]string, error)
+
+	// HostnameFallback controls the advertised proxy address when the hostname
+	// doesn't resolve to the current host. Defaults to HostnameFallbackLoopback.
+	HostnameFallback HostnameFallback
+
 	// Name is the name of the replica set to connect to. Nodes that are not part
 	// of this replica set will be ignored. If this is empty, the first replica set
 	// will be used
@@ -98,12 +287,42 @@ type ReplicaSet struct {
 	realToProxy map[string]string
 	ignoredReal map[string]ReplicaState
 	proxies     map[string]*Proxy
-	restarter   *sync.Once
+	restarter   *sync.Once // guarded by restartMutex
 	lastState   *ReplicaSetState
+	resolved    map[string][]string
+	resolveStop chan struct{}
+
+	runtimeStatsStop chan struct{}
+	maintenance      int32 // accessed atomically
+	dialLimiter      chan struct{}
+	getMoreLimiter   chan struct{}
+	auditor          *auditor
+
+	connRateLimiter *rateLimiter
+
+	tunablesMutex sync.RWMutex
+
+	// stopMutex serializes Stop with an in progress Restart, and stopping
+	// prevents a Restart from starting the proxies again once stopped.
+	stopMutex sync.Mutex
+	stopping  bool
+
+	// lifecycleMutex guards the proxies a Restart replaces. It isn't held while
+	// the proxies drain, so the proxies can be inspected meanwhile.
+	lifecycleMutex sync.Mutex
+
+	// restartMutex guards restarter without waiting on an in progress Restart,
+	// so concurrent calls share the restart instead of running another.
+	restartMutex sync.Mutex
 }
 
 // Start starts proxies to support this ReplicaSet.
 func (r *ReplicaSet) Start() error {
+	return r.start(r.ProbeOnStart)
+}
+
+// start starts the proxies, first probing the members if probe is true.
+func (r *ReplicaSet) start(probe bool) (err error) {
 	r.proxyToReal = make(map[string]string)
 	r.realToProxy = make(map[string]string)
 	r.ignoredReal = make(map[string]ReplicaState)
@@ -113,12 +332,39 @@ func (r *ReplicaSet) Start() error {
 		return errNoAddrsGiven
 	}
 
-	rawAddrs := strings.Split(r.Addrs, ",")
-	var err error
-	r.lastState, err = r.ReplicaSetStateCreator.FromAddrs(rawAddrs, r.Name)
+	if err := validateOpTimeouts(r.OpTimeouts); err != nil {
+		return err
+	}
+	if !r.WireDump.valid() {
+		return fmt.Errorf("dvara: unknown WireDump %q", r.WireDump)
+	}
+	if !r.HostnameFallback.valid() {
+		return fmt.Errorf("dvara: unknown HostnameFallback %q", r.HostnameFallback)
+	}
+	if r.TLSConfig != nil {
+		if err := ValidateTLSConfig(r.TLSConfig); err != nil {
+			return err
+		}
+	}
+
+	seeds, err := parseSeeds(r.Addrs)
 	if err != nil {
 		return err
 	}
+	var rawAddrs, entries []string
+	for _, s := range seeds {
+		entries = append(entries, s.Entry)
+		if !s.Arbiter {
+			rawAddrs = append(rawAddrs, s.Addr)
+		}
+	}
+	if len(rawAddrs) == 0 {
+		return errNoAddrsGiven
+	}
+
+	if r.lastState, err = r.discover(rawAddrs); err != nil {
+		return err
+	}
 
 	healthyAddrs := r.lastState.Addrs()
 
@@ -127,14 +373,60 @@ func (r *ReplicaSet) Start() error {
 		return stackerr.Newf("no healthy primaries or secondaries: %s", r.Addrs)
 	}
 
+	if err := r.checkMaxMembers(healthyAddrs); err != nil {
+		return err
+	}
+
 	// Add discovered nodes to seed address list. Over time if the original seed
 	// nodes have gone away and new nodes have joined this ensures that we'll
 	// still be able to connect.
-	r.Addrs = strings.Join(uniq(append(rawAddrs, healthyAddrs...)), ",")
+	r.Addrs = strings.Join(uniq(append(entries, healthyAddrs...)), ",")
 
+	r.restartMutex.Lock()
 	r.restarter = new(sync.Once)
+	r.restartMutex.Unlock()
+	r.stopping = false
+
+	if r.ProxyQuery != nil {
+		r.ProxyQuery.ReplicaSet = r
+	}
+
+	if r.MaxConcurrentDials > 0 {
+		r.dialLimiter = make(chan struct{}, r.MaxConcurrentDials)
+	}
+	if r.MaxConcurrentGetMore > 0 {
+		r.getMoreLimiter = make(chan struct{}, r.MaxConcurrentGetMore)
+	}
+	if r.MaxConnectionsPerSecond > 0 {
+		r.connRateLimiter = newRateLimiter(r.MaxConnectionsPerSecond, r.clock().Now)
+	}
+
+	hostname, err := r.proxyHostname()
+	if err != nil {
+		return err
+	}
+
+	if r.AuditWriter != nil {
+		r.auditor = newAuditor(r.AuditWriter, r.Log)
+		// The proxies are given the auditor as they're created, so it's
+		// stopped here if they fail to start.
+		defer func() {
+			if err != nil {
+				r.closeAuditor()
+			}
+		}()
+	}
+
+	// Failing from here leaves nothing running: the proxies that were started
+	// are stopped, the listeners of the others closed, and all of them dropped.
+	started := make(map[*Proxy]bool)
+	defer func() {
+		if err != nil {
+			r.abortStart(started)
+		}
+	}()
 
-	for _, addr := range healthyAddrs {
+	for _, addr := range r.proxiedAddrs() {
 		listener, err := r.newListener()
 		if err != nil {
 			return err
@@ -144,15 +436,25 @@ func (r *ReplicaSet) Start() error {
 			Log:            r.Log,
 			ReplicaSet:     r,
 			ClientListener: listener,
-			ProxyAddr:      r.proxyAddr(listener),
+			ProxyAddr:      proxyAddr(hostname, listener),
 			MongoAddr:      addr,
+			auditor:        r.auditor,
 		}
 		if err := r.add(p); err != nil {
+			if err := listener.Close(); err != nil {
+				r.Log.Error(err)
+			}
 			return err
 		}
 	}
 
-	// add the ignored hosts, unless lastRS is nil (single node mode)
+	// add the seeds known to be arbiters, and the ignored hosts unless lastRS is
+	// nil (single node mode)
+	for _, s := range seeds {
+		if s.Arbiter {
+			r.ignoredReal[s.Addr] = ReplicaStateArbiter
+		}
+	}
 	if r.lastState.lastRS != nil {
 		for _, member := range r.lastState.lastRS.Members {
 			if _, ok := r.realToProxy[member.Name]; !ok {
@@ -161,7 +463,19 @@ func (r *ReplicaSet) Start() error {
 		}
 	}
 
+	// The members are probed before the proxies start serving. Some of them
+	// being unready isn't fatal, the others are served meanwhile.
+	if probe {
+		if err := r.probe(); err != nil {
+			if _, ok := err.(*PartiallyReadyError); !ok {
+				return err
+			}
+			r.Log.Warn(err)
+		}
+	}
+
 	var wg sync.WaitGroup
+	var startedMutex sync.Mutex
 	wg.Add(len(r.proxies))
 	errch := make(chan error, len(r.proxies))
 	for _, p := range r.proxies {
@@ -170,28 +484,412 @@ func (r *ReplicaSet) Start() error {
 			if err := p.Start(); err != nil {
 				r.Log.Error(err)
 				errch <- stackerr.Wrap(err)
+				return
 			}
+			startedMutex.Lock()
+			started[p] = true
+			startedMutex.Unlock()
 		}(p)
 	}
 	wg.Wait()
 	select {
 	default:
-		return nil
 	case err := <-errch:
 		return err
 	}
+	r.recordProxiesServing(len(r.proxies))
+
+	if r.ResolveInterval > 0 {
+		r.resolved = nil
+		r.resolveChanged()
+		r.resolveStop = make(chan struct{})
+		go r.resolveLoop(r.resolveStop)
+	}
+	if r.RuntimeStatsInterval > 0 {
+		r.runtimeStatsStop = make(chan struct{})
+		go r.runtimeStatsLoop(r.runtimeStatsStop)
+	}
+	return nil
+}
+
+// abortStart undoes a failed start. The started proxies are stopped, the
+// listeners of the others are closed, and the proxies are dropped.
+func (r *ReplicaSet) abortStart(started map[*Proxy]bool) {
+	for _, p := range r.proxies {
+		var err error
+		if started[p] {
+			err = p.stop(true)
+		} else {
+			err = p.ClientListener.Close()
+		}
+		if err != nil {
+			r.Log.Error(err)
+		}
+	}
+	r.proxyToReal = make(map[string]string)
+	r.realToProxy = make(map[string]string)
+	r.proxies = make(map[string]*Proxy)
+}
+
+// stopLoops stops the background loops started by Start.
+func (r *ReplicaSet) stopLoops() {
+	if r.resolveStop != nil {
+		close(r.resolveStop)
+		r.resolveStop = nil
+	}
+	if r.runtimeStatsStop != nil {
+		close(r.runtimeStatsStop)
+		r.runtimeStatsStop = nil
+	}
+}
+
+// checkMaxMembers ensures we aren't about to create more proxies than allowed.
+func (r *ReplicaSet) checkMaxMembers(addrs []string) error {
+	max := r.MaxMembers
+	if max == 0 {
+		max = defaultMaxMembers
+	}
+	if uint(len(addrs)) > max {
+		return fmt.Errorf(
+			"dvara: discovered %d members which is more than the maximum of %d: %v",
+			len(addrs),
+			max,
+			addrs,
+		)
+	}
+	return nil
+}
+
+// validateOpTimeouts ensures the OpTimeouts overrides are for known operations
+// and have usable values.
+func validateOpTimeouts(opTimeouts map[OpCode]time.Duration) error {
+	for op, timeout := range opTimeouts {
+		if op.String() == "UNKNOWN" {
+			return fmt.Errorf("dvara: unknown OpCode %d in OpTimeouts", int32(op))
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("dvara: OpTimeouts for %s must be positive, got %s", op, timeout)
+		}
+	}
+	return nil
+}
+
+// Tunables are the ReplicaSet settings that can be changed while it is
+// running using SetTunables. Other settings, like the addresses and port range,
+// require a restart to change.
+type Tunables struct {
+	MessageTimeout      time.Duration
+	ClientIdleTimeout   time.Duration
+	GetLastErrorTimeout time.Duration
+	OpTimeouts          map[OpCode]time.Duration
+	WireDump            WireDump
+}
+
+// SetTunables changes the tunables for a running ReplicaSet. Existing
+// connections are not dropped and pick up the new values with their next
+// message.
+func (r *ReplicaSet) SetTunables(t Tunables) error {
+	if err := validateOpTimeouts(t.OpTimeouts); err != nil {
+		return err
+	}
+	if !t.WireDump.valid() {
+		return fmt.Errorf("dvara: unknown WireDump %q", t.WireDump)
+	}
+	r.tunablesMutex.Lock()
+	defer r.tunablesMutex.Unlock()
+	r.Log.Infof(
+		"setting tunables MessageTimeout=%s ClientIdleTimeout=%s "+
+			"GetLastErrorTimeout=%s OpTimeouts=%v WireDump=%q",
+		t.MessageTimeout,
+		t.ClientIdleTimeout,
+		t.GetLastErrorTimeout,
+		t.OpTimeouts,
+		t.WireDump,
+	)
+	r.MessageTimeout = t.MessageTimeout
+	r.ClientIdleTimeout = t.ClientIdleTimeout
+	r.GetLastErrorTimeout = t.GetLastErrorTimeout
+	r.OpTimeouts = t.OpTimeouts
+	r.WireDump = t.WireDump
+	return nil
+}
+
+// Tunables returns the current tunables.
+func (r *ReplicaSet) Tunables() Tunables {
+	r.tunablesMutex.RLock()
+	defer r.tunablesMutex.RUnlock()
+	return Tunables{
+		MessageTimeout:      r.MessageTimeout,
+		ClientIdleTimeout:   r.ClientIdleTimeout,
+		GetLastErrorTimeout: r.GetLastErrorTimeout,
+		OpTimeouts:          r.OpTimeouts,
+		WireDump:            r.WireDump,
+	}
+}
+
+// ConfigSnapshot is a serializable snapshot of the ReplicaSet configuration,
+// including the policies of its ProxyQuery. Durations are formatted as strings
+// like "1m0s".
+type ConfigSnapshot struct {
+	Addrs                    string            `json:"addrs"`
+	Name                     string            `json:"name,omitempty"`
+	PortStart                int               `json:"port_start"`
+	PortEnd                  int               `json:"port_end"`
+	MaxMembers               uint              `json:"max_members"`
+	MaxConnections           uint              `json:"max_connections"`
+	DatabaseMaxConnections   map[string]uint   `json:"database_max_connections,omitempty"`
+	MaxConcurrentDials       uint              `json:"max_concurrent_dials"`
+	MaxConcurrentGetMore     uint              `json:"max_concurrent_get_more"`
+	MinIdleConnections       uint              `json:"min_idle_connections"`
+	ServerIdleTimeout        string            `json:"server_idle_timeout"`
+	ServerConnMaxLifetime    string            `json:"server_conn_max_lifetime"`
+	NoTimeoutCursorLifetime  string            `json:"no_timeout_cursor_lifetime"`
+	ServerKeepAliveInterval  string            `json:"server_keep_alive_interval"`
+	ServerClosePoolSize      uint              `json:"server_close_pool_size"`
+	AcceptConcurrency        uint              `json:"accept_concurrency"`
+	AcceptDrainTimeout       string            `json:"accept_drain_timeout"`
+	ClientLinger             string            `json:"client_linger"`
+	ClientKeepAliveInterval  string            `json:"client_keep_alive_interval"`
+	ClientKeepAliveCount     int               `json:"client_keep_alive_count"`
+	MaxPerClientConnections  uint              `json:"max_per_client_connections"`
+	StickyClientSessions     bool              `json:"sticky_client_sessions"`
+	MaxConnectionsPerSecond  uint              `json:"max_connections_per_second"`
+	MessageTimeout           string            `json:"message_timeout"`
+	ClientIdleTimeout        string            `json:"client_idle_timeout"`
+	GetLastErrorTimeout      string            `json:"get_last_error_timeout"`
+	DisableGetLastErrorCache bool              `json:"disable_get_last_error_cache"`
+	ReadOnly                 bool              `json:"read_only"`
+	OpTimeouts               map[string]string `json:"op_timeouts,omitempty"`
+	SlowMessageThreshold     string            `json:"slow_message_threshold"`
+	MaxMessageReadTime       string            `json:"max_message_read_time"`
+	ClientWriteTimeout       string            `json:"client_write_timeout"`
+	ResolveInterval          string            `json:"resolve_interval"`
+	StartupTimeout           string            `json:"startup_timeout"`
+	RuntimeStatsInterval     string            `json:"runtime_stats_interval"`
+	ProbeOnStart             bool              `json:"probe_on_start"`
+	DirectConnection         bool              `json:"direct_connection"`
+	ExcludeDelayedMembers    bool              `json:"exclude_delayed_members"`
+	ExcludeNonVotingMembers  bool              `json:"exclude_non_voting_members"`
+	WireDump                 string            `json:"wire_dump,omitempty"`
+	HostnameFallback         string            `json:"hostname_fallback,omitempty"`
+	MaintenanceMode          bool              `json:"maintenance_mode"`
+	Audit                    bool              `json:"audit"`
+
+	// The ProxyQuery policies, left empty without a ProxyQuery.
+	DeniedCommands                []string `json:"denied_commands,omitempty"`
+	AllowedDatabases              []string `json:"allowed_databases,omitempty"`
+	TailableCursorTimeout         string   `json:"tailable_cursor_timeout,omitempty"`
+	DisableCompressionNegotiation bool     `json:"disable_compression_negotiation"`
+	MaxQueryDocSize               int      `json:"max_query_doc_size"`
+	TagAppName                    bool     `json:"tag_app_name"`
+	RestartOnStaleTopology        bool     `json:"restart_on_stale_topology"`
+	MaxReplyDocs                  int      `json:"max_reply_docs"`
+	MaxReplyBytes                 int      `json:"max_reply_bytes"`
+}
+
+// Config returns a snapshot of the current configuration, suitable for
+// auditing.
+func (r *ReplicaSet) Config() ConfigSnapshot {
+	t := r.Tunables()
+	var opTimeouts map[string]string
+	if len(t.OpTimeouts) > 0 {
+		opTimeouts = make(map[string]string, len(t.OpTimeouts))
+		for op, timeout := range t.OpTimeouts {
+			opTimeouts[op.String()] = timeout.String()
+		}
+	}
+	c := ConfigSnapshot{
+		Addrs:                    r.Addrs,
+		Name:                     r.Name,
+		PortStart:                r.PortStart,
+		PortEnd:                  r.PortEnd,
+		MaxMembers:               r.MaxMembers,
+		MaxConnections:           r.MaxConnections,
+		DatabaseMaxConnections:   r.DatabaseMaxConnections,
+		MaxConcurrentDials:       r.MaxConcurrentDials,
+		MaxConcurrentGetMore:     r.MaxConcurrentGetMore,
+		MinIdleConnections:       r.MinIdleConnections,
+		ServerIdleTimeout:        r.ServerIdleTimeout.String(),
+		ServerConnMaxLifetime:    r.ServerConnMaxLifetime.String(),
+		NoTimeoutCursorLifetime:  r.NoTimeoutCursorLifetime.String(),
+		ServerKeepAliveInterval:  r.ServerKeepAliveInterval.String(),
+		ServerClosePoolSize:      r.ServerClosePoolSize,
+		AcceptConcurrency:        r.AcceptConcurrency,
+		AcceptDrainTimeout:       r.AcceptDrainTimeout.String(),
+		ClientLinger:             r.ClientLinger.String(),
+		ClientKeepAliveInterval:  r.ClientKeepAliveInterval.String(),
+		ClientKeepAliveCount:     r.ClientKeepAliveCount,
+		MaxPerClientConnections:  r.MaxPerClientConnections,
+		StickyClientSessions:     r.StickyClientSessions,
+		MaxConnectionsPerSecond:  r.MaxConnectionsPerSecond,
+		MessageTimeout:           t.MessageTimeout.String(),
+		ClientIdleTimeout:        t.ClientIdleTimeout.String(),
+		GetLastErrorTimeout:      t.GetLastErrorTimeout.String(),
+		DisableGetLastErrorCache: r.DisableGetLastErrorCache,
+		ReadOnly:                 r.ReadOnly,
+		OpTimeouts:               opTimeouts,
+		SlowMessageThreshold:     r.SlowMessageThreshold.String(),
+		MaxMessageReadTime:       r.MaxMessageReadTime.String(),
+		ClientWriteTimeout:       r.ClientWriteTimeout.String(),
+		ResolveInterval:          r.ResolveInterval.String(),
+		StartupTimeout:           r.StartupTimeout.String(),
+		RuntimeStatsInterval:     r.RuntimeStatsInterval.String(),
+		ProbeOnStart:             r.ProbeOnStart,
+		DirectConnection:         r.DirectConnection,
+		ExcludeDelayedMembers:    r.ExcludeDelayedMembers,
+		ExcludeNonVotingMembers:  r.ExcludeNonVotingMembers,
+		WireDump:                 string(t.WireDump),
+		HostnameFallback:         string(r.HostnameFallback),
+		MaintenanceMode:          r.InMaintenanceMode(),
+		Audit:                    r.AuditWriter != nil,
+	}
+	if pq := r.ProxyQuery; pq != nil {
+		c.DeniedCommands = pq.DeniedCommands
+		c.AllowedDatabases = pq.AllowedDatabases
+		c.TailableCursorTimeout = pq.TailableCursorTimeout.String()
+		c.DisableCompressionNegotiation = pq.DisableCompressionNegotiation
+		c.MaxQueryDocSize = pq.MaxQueryDocSize
+		c.TagAppName = pq.TagAppName
+		c.RestartOnStaleTopology = pq.RestartOnStaleTopology
+		c.MaxReplyDocs = pq.MaxReplyDocs
+		c.MaxReplyBytes = pq.MaxReplyBytes
+	}
+	return c
+}
+
+// proxiedAddrs returns the addresses of the healthy members that should be
+// proxied, leaving out the excluded ones.
+func (r *ReplicaSet) proxiedAddrs() []string {
+	if r.lastState.lastRS == nil || (!r.ExcludeDelayedMembers && !r.ExcludeNonVotingMembers) {
+		return r.lastState.Addrs()
+	}
+	var addrs []string
+	for i := range r.lastState.lastRS.Members {
+		m := &r.lastState.lastRS.Members[i]
+		if m.State != ReplicaStatePrimary && m.State != ReplicaStateSecondary {
+			continue
+		}
+		if r.ExcludeDelayedMembers && m.IsDelayed() {
+			r.Log.Infof("excluding delayed member %s", m.Name)
+			continue
+		}
+		if r.ExcludeNonVotingMembers && !m.IsVotingMember() {
+			r.Log.Infof("excluding non voting member %s", m.Name)
+			continue
+		}
+		addrs = append(addrs, m.Name)
+	}
+	return addrs
+}
+
+// messageTimeout returns the timeout for proxying a single message with the
+// given OpCode.
+func (r *ReplicaSet) messageTimeout(op OpCode) time.Duration {
+	t := r.Tunables()
+	if timeout, ok := t.OpTimeouts[op]; ok {
+		return timeout
+	}
+	return t.MessageTimeout
+}
+
+// NotReadyError is returned from Start when ProbeOnStart is enabled and none
+// of the members could be connected to.
+type NotReadyError struct {
+	Unready []string
+}
+
+func (e *NotReadyError) Error() string {
+	return fmt.Sprintf("dvara: could not connect to any members: %v", e.Unready)
+}
+
+// PartiallyReadyError is returned by the probe when some but not all of the
+// members could be connected to. Start logs it and serves the others.
+type PartiallyReadyError struct {
+	Unready []string
+}
+
+func (e *PartiallyReadyError) Error() string {
+	return fmt.Sprintf("dvara: could not connect to members: %v", e.Unready)
+}
+
+// probe connects to each member once to confirm the proxies are ready to
+// serve. It returns a NotReadyError if none are, and a PartiallyReadyError
+// listing the unready members if only some are.
+func (r *ReplicaSet) probe() error {
+	var unready []string
+	for _, p := range r.proxies {
+		c, err := p.dialServer()
+		if err != nil {
+			r.Log.Errorf("probe of %s failed: %s", p.MongoAddr, err)
+			unready = append(unready, p.MongoAddr)
+			continue
+		}
+		if err := c.Close(); err != nil {
+			r.Log.Error(err)
+		}
+	}
+	sort.Strings(unready)
+	stats.BumpAvg(r.Stats, "mongoproxy.members.unready", float64(len(unready)))
+	if len(unready) == len(r.proxies) {
+		return &NotReadyError{Unready: unready}
+	}
+	if len(unready) > 0 {
+		return &PartiallyReadyError{Unready: unready}
+	}
+	return nil
+}
+
+// Ping runs isMaster through each proxy until one succeeds, confirming dvara
+// can round trip to mongo and not just accept connections. It returns an error
+// if none of them succeed.
+func (r *ReplicaSet) Ping(ctx context.Context) error {
+	// The proxies are copied so a Restart isn't held up by the pings.
+	r.lifecycleMutex.Lock()
+	proxies := make([]*Proxy, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		proxies = append(proxies, p)
+	}
+	r.lifecycleMutex.Unlock()
+
+	var errs []string
+	for _, p := range proxies {
+		err := p.ping(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", p, err))
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("dvara: ping failed for all proxies: %s", strings.Join(errs, ", "))
 }
 
 // Stop stops all the associated proxies for this ReplicaSet.
 func (r *ReplicaSet) Stop() error {
-	return r.stop(false)
+	r.stopMutex.Lock()
+	defer r.stopMutex.Unlock()
+	r.stopping = true
+	return r.stop(r.beginStop(), false)
 }
 
-func (r *ReplicaSet) stop(hard bool) error {
-	var wg sync.WaitGroup
-	wg.Add(len(r.proxies))
-	errch := make(chan error, len(r.proxies))
+// beginStop stops the loops and returns the proxies to stop. They are copied so
+// lifecycleMutex isn't held while they drain.
+func (r *ReplicaSet) beginStop() []*Proxy {
+	r.lifecycleMutex.Lock()
+	defer r.lifecycleMutex.Unlock()
+	r.stopLoops()
+	r.recordProxiesServing(0)
+	proxies := make([]*Proxy, 0, len(r.proxies))
 	for _, p := range r.proxies {
+		proxies = append(proxies, p)
+	}
+	return proxies
+}
+
+func (r *ReplicaSet) stop(proxies []*Proxy, hard bool) error {
+	var wg sync.WaitGroup
+	wg.Add(len(proxies))
+	errch := make(chan error, len(proxies))
+	for _, p := range proxies {
 		go func(p *Proxy) {
 			defer wg.Done()
 			if err := p.stop(hard); err != nil {
@@ -201,6 +899,52 @@ func (r *ReplicaSet) stop(hard bool) error {
 		}(p)
 	}
 	wg.Wait()
+	r.closeAuditor()
+	select {
+	default:
+		return nil
+	case err := <-errch:
+		return err
+	}
+}
+
+// closeAuditor writes the pending audit records and stops the auditor. It is
+// called once the proxies are stopped so in flight operations are recorded.
+func (r *ReplicaSet) closeAuditor() {
+	if r.auditor != nil {
+		r.auditor.close()
+		r.auditor = nil
+	}
+}
+
+// StopWithTimeout stops the ReplicaSet waiting up to timeout for clients to
+// finish. Clients still connected after the timeout are disconnected.
+func (r *ReplicaSet) StopWithTimeout(timeout time.Duration) error {
+	r.stopMutex.Lock()
+	defer r.stopMutex.Unlock()
+	r.stopping = true
+	proxies := r.beginStop()
+
+	var wg sync.WaitGroup
+	var forced int32
+	wg.Add(len(proxies))
+	errch := make(chan error, len(proxies))
+	for _, p := range proxies {
+		go func(p *Proxy) {
+			defer wg.Done()
+			n, err := p.stopWithTimeout(timeout)
+			atomic.AddInt32(&forced, int32(n))
+			if err != nil {
+				r.Log.Error(err)
+				errch <- stackerr.Wrap(err)
+			}
+		}(p)
+	}
+	wg.Wait()
+	if forced > 0 {
+		r.Log.Warnf("forcibly closed %d client connections after %s", forced, timeout)
+	}
+	r.closeAuditor()
 	select {
 	default:
 		return nil
@@ -212,16 +956,29 @@ func (r *ReplicaSet) stop(hard bool) error {
 // Restart stops all the proxies and restarts them. This is used when we detect
 // an RS config change, like when an election happens.
 func (r *ReplicaSet) Restart() {
-	r.restarter.Do(func() {
+	r.restartMutex.Lock()
+	restarter := r.restarter
+	r.restartMutex.Unlock()
+	restarter.Do(func() {
+		// A Stop waits for the restart to finish, and a restart after a Stop
+		// does nothing.
+		r.stopMutex.Lock()
+		defer r.stopMutex.Unlock()
+		if r.stopping {
+			r.Log.Info("restart skipped since stopping")
+			return
+		}
 		r.Log.Info("restart triggered")
-		if err := r.stop(*hardRestart); err != nil {
+		if err := r.stop(r.beginStop(), *hardRestart); err != nil {
 			// We log and ignore this hoping for a successful start anyways.
 			r.Log.Errorf("stop failed for restart: %s", err)
 		} else {
 			r.Log.Info("successfully stopped for restart")
 		}
 
-		if err := r.Start(); err != nil {
+		r.lifecycleMutex.Lock()
+		defer r.lifecycleMutex.Unlock()
+		if err := r.start(false); err != nil {
 			// We panic here because we can't repair from here and are pretty much
 			// fucked.
 			panic(fmt.Errorf("start failed for restart: %s", err))
@@ -231,36 +988,202 @@ func (r *ReplicaSet) Restart() {
 	})
 }
 
-func (r *ReplicaSet) proxyAddr(l net.Listener) string {
+// keepAliveConfig is a TCP keep-alive configuration. A zero Interval or Count
+// is left at the system default.
+type keepAliveConfig struct {
+	Idle     time.Duration
+	Interval time.Duration
+	Count    int
+}
+
+// clientKeepAliveConfig returns the TCP keep-alive configuration for client
+// connections.
+func (r *ReplicaSet) clientKeepAliveConfig() keepAliveConfig {
+	config := keepAliveConfig{Idle: 2 * time.Minute}
+	if r.ClientKeepAliveInterval > 0 {
+		config.Interval = r.ClientKeepAliveInterval
+	}
+	if r.ClientKeepAliveCount > 0 {
+		config.Count = r.ClientKeepAliveCount
+	}
+	return config
+}
+
+// setKeepAlive turns on TCP keep-alive for the connection with the config.
+func setKeepAlive(c *net.TCPConn, config keepAliveConfig) error {
+	if err := c.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := c.SetKeepAlivePeriod(config.Idle); err != nil {
+		return err
+	}
+	return setKeepAliveProbes(c, config.Interval, config.Count)
+}
+
+// clock returns the Clock, defaulting to the real clock.
+func (r *ReplicaSet) clock() clock.Clock {
+	if r.Clock == nil {
+		return clock.New()
+	}
+	return r.Clock
+}
+
+// recordProxiesServing records the number of proxies currently serving. Along
+// with the expected number of members this indicates a degraded cluster.
+func (r *ReplicaSet) recordProxiesServing(n int) {
+	stats.BumpAvg(r.Stats, "mongoproxy.proxies.serving", float64(n))
+}
+
+// runtimeStatsLoop periodically records the runtime stats.
+func (r *ReplicaSet) runtimeStatsLoop(stop chan struct{}) {
+	ticker := r.clock().Ticker(r.RuntimeStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.recordRuntimeStats()
+		}
+	}
+}
+
+// recordRuntimeStats records the number of goroutines and the memory obtained
+// from the OS. A steadily climbing goroutine count indicates a leak.
+func (r *ReplicaSet) recordRuntimeStats() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats.BumpAvg(r.Stats, "mongoproxy.runtime.goroutines", float64(runtime.NumGoroutine()))
+	stats.BumpAvg(r.Stats, "mongoproxy.runtime.memory.sys", float64(m.Sys))
+	stats.BumpAvg(r.Stats, "mongoproxy.runtime.memory.heap", float64(m.HeapAlloc))
+}
+
+// resolveLoop periodically resolves the member hostnames and resets the server
+// connections of the members that now resolve to different addresses.
+func (r *ReplicaSet) resolveLoop(stop chan struct{}) {
+	ticker := r.clock().Ticker(r.ResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// The lock keeps the proxies from being replaced by a Restart
+			// meanwhile, which stops this loop first.
+			r.lifecycleMutex.Lock()
+			select {
+			case <-stop:
+				r.lifecycleMutex.Unlock()
+				return
+			default:
+			}
+			for _, mongoAddr := range r.resolveChanged() {
+				if p, ok := r.proxies[r.realToProxy[mongoAddr]]; ok {
+					p.resetServerConns()
+				}
+			}
+			r.lifecycleMutex.Unlock()
+		}
+	}
+}
+
+// resolveChanged resolves the member hostnames and returns the members that
+// resolved to a different set of addresses than the last time. Members that
+// fail to resolve keep their previous addresses.
+func (r *ReplicaSet) resolveChanged() []string {
+	lookupHost := r.LookupHost
+	if lookupHost == nil {
+		lookupHost = net.LookupHost
+	}
+	if r.resolved == nil {
+		r.resolved = make(map[string][]string)
+	}
+
+	var changed []string
+	for mongoAddr := range r.realToProxy {
+		host, _, err := net.SplitHostPort(mongoAddr)
+		if err != nil {
+			host = mongoAddr
+		}
+		addrs, err := lookupHost(host)
+		if err != nil {
+			r.Log.Errorf("error resolving %s: %s", host, err)
+			continue
+		}
+		addrs = append([]string(nil), addrs...)
+		sort.Strings(addrs)
+
+		last, ok := r.resolved[mongoAddr]
+		r.resolved[mongoAddr] = addrs
+		if ok && strings.Join(last, ",") != strings.Join(addrs, ",") {
+			r.Log.Warnf("member %s resolved to %v, previously %v", mongoAddr, addrs, last)
+			changed = append(changed, mongoAddr)
+		}
+	}
+	return changed
+}
+
+func proxyAddr(hostname string, l net.Listener) string {
 	_, port, err := net.SplitHostPort(l.Addr().String())
 	if err != nil {
 		panic(err)
 	}
 
-	return fmt.Sprintf("%s:%s", r.proxyHostname(), port)
+	return fmt.Sprintf("%s:%s", hostname, port)
+}
+
+// HostnameFallback controls the advertised proxy address when the hostname
+// doesn't resolve to the current host.
+type HostnameFallback string
+
+const (
+	// HostnameFallbackLoopback advertises 127.0.0.1, which only works for local
+	// clients.
+	HostnameFallbackLoopback = HostnameFallback("loopback")
+
+	// HostnameFallbackFail makes Start fail.
+	HostnameFallbackFail = HostnameFallback("fail")
+
+	// HostnameFallbackAdvertise advertises the hostname regardless.
+	HostnameFallbackAdvertise = HostnameFallback("advertise-anyway")
+)
+
+func (f HostnameFallback) valid() bool {
+	return f == "" ||
+		f == HostnameFallbackLoopback ||
+		f == HostnameFallbackFail ||
+		f == HostnameFallbackAdvertise
 }
 
-func (r *ReplicaSet) proxyHostname() string {
-	const home = "127.0.0.1"
+// loopbackHost is advertised when the hostname can't be used.
+const loopbackHost = "127.0.0.1"
 
+func (r *ReplicaSet) proxyHostname() (string, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
+		if r.HostnameFallback == HostnameFallbackFail {
+			return "", stackerr.Wrap(err)
+		}
+		// Without a hostname there is nothing else to advertise.
 		r.Log.Error(err)
-		return home
+		return loopbackHost, nil
+	}
+
+	lookupHost := r.LookupHost
+	if lookupHost == nil {
+		lookupHost = net.LookupHost
 	}
 
 	// The follow logic ensures that the hostname resolves to a local address.
 	// If it doesn't we don't use it since it probably wont work anyways.
-	hostnameAddrs, err := net.LookupHost(hostname)
+	hostnameAddrs, err := lookupHost(hostname)
 	if err != nil {
-		r.Log.Error(err)
-		return home
+		return r.hostnameFallback(hostname, err)
 	}
 
 	interfaceAddrs, err := net.InterfaceAddrs()
 	if err != nil {
-		r.Log.Error(err)
-		return home
+		return r.hostnameFallback(hostname, err)
 	}
 
 	for _, ia := range interfaceAddrs {
@@ -268,12 +1191,28 @@ func (r *ReplicaSet) proxyHostname() string {
 		for _, ha := range hostnameAddrs {
 			// check for an exact match or a match ignoring the suffix bits
 			if sa == ha || strings.HasPrefix(sa, ha+"/") {
-				return hostname
+				return hostname, nil
 			}
 		}
 	}
-	r.Log.Warnf("hostname %s doesn't resolve to the current host", hostname)
-	return home
+	return r.hostnameFallback(
+		hostname,
+		fmt.Errorf("hostname %s doesn't resolve to the current host", hostname),
+	)
+}
+
+// hostnameFallback returns the proxy hostname to use, or an error, according
+// to the HostnameFallback when the hostname couldn't be verified as local.
+func (r *ReplicaSet) hostnameFallback(hostname string, err error) (string, error) {
+	switch r.HostnameFallback {
+	case HostnameFallbackFail:
+		return "", stackerr.Wrap(err)
+	case HostnameFallbackAdvertise:
+		r.Log.Warnf("%s, advertising it anyway", err)
+		return hostname, nil
+	}
+	r.Log.Warnf("%s, falling back to %s", err, loopbackHost)
+	return loopbackHost, nil
 }
 
 func (r *ReplicaSet) newListener() (net.Listener, error) {
@@ -330,6 +1269,53 @@ func (r *ReplicaSet) ProxyMembers() []string {
 	return members
 }
 
+// SetMaintenanceMode toggles maintenance mode. While in maintenance mode
+// existing clients continue to be served, but new clients get an error reply
+// to their first message and are disconnected.
+func (r *ReplicaSet) SetMaintenanceMode(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&r.maintenance, v)
+	r.Log.Infof("maintenance mode set to %v", enabled)
+}
+
+// InMaintenanceMode returns true if the ReplicaSet is in maintenance mode.
+func (r *ReplicaSet) InMaintenanceMode() bool {
+	return atomic.LoadInt32(&r.maintenance) == 1
+}
+
+// SetMaxPerClientConnections changes the maximum number of connections per
+// client IP for all the running proxies, and for those started on restart.
+func (r *ReplicaSet) SetMaxPerClientConnections(max uint) error {
+	if max == 0 {
+		return errZeroMaxPerClientConnections
+	}
+	r.Log.Infof("setting MaxPerClientConnections=%d", max)
+	r.lifecycleMutex.Lock()
+	defer r.lifecycleMutex.Unlock()
+	r.MaxPerClientConnections = max
+	for _, p := range r.proxies {
+		if err := p.SetMaxPerClientConnections(max); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TotalActiveConnections returns the number of clients currently connected
+// across all the proxies in this ReplicaSet.
+func (r *ReplicaSet) TotalActiveConnections() int {
+	r.lifecycleMutex.Lock()
+	defer r.lifecycleMutex.Unlock()
+	var total int
+	for _, p := range r.proxies {
+		total += p.ActiveConnections()
+	}
+	return total
+}
+
 // SameRS checks if the given replSetGetStatusResponse is the same as the last
 // state.
 func (r *ReplicaSet) SameRS(o *replSetGetStatusResponse) bool {
@@ -352,6 +1338,86 @@ func (p *ProxyMapperError) Error() string {
 	return fmt.Sprintf("error mapping host %s in state %s", p.RealHost, p.State)
 }
 
+// discover probes the seed addresses for the replica set state, giving up
+// after StartupTimeout if set.
+func (r *ReplicaSet) discover(addrs []string) (*ReplicaSetState, error) {
+	if r.DirectConnection {
+		if len(addrs) != 1 {
+			return nil, errDirectConnectionAddrs
+		}
+		return &ReplicaSetState{singleAddr: addrs[0]}, nil
+	}
+	defer stats.BumpTime(r.Stats, "mongoproxy.discovery.time").End()
+	if r.StartupTimeout <= 0 {
+		return r.ReplicaSetStateCreator.FromAddrs(addrs, r.Name)
+	}
+
+	type result struct {
+		state *ReplicaSetState
+		err   error
+	}
+	// The probes can't be interrupted, so on timeout they finish in the
+	// background and the buffered result is dropped.
+	done := make(chan result, 1)
+	go func() {
+		state, err := r.ReplicaSetStateCreator.FromAddrs(addrs, r.Name)
+		done <- result{state: state, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.state, res.err
+	case <-r.clock().After(r.StartupTimeout):
+		stats.BumpSum(r.Stats, "mongoproxy.discovery.timeout", 1)
+		return nil, fmt.Errorf(
+			"dvara: discovery did not complete within %s: %s",
+			r.StartupTimeout,
+			strings.Join(addrs, ","),
+		)
+	}
+}
+
+// seed is a single entry in ReplicaSet.Addrs.
+type seed struct {
+	// Entry is the entry as given, including any hints.
+	Entry string
+
+	// Addr is the mongo address.
+	Addr string
+
+	// Arbiter is true if the entry is annotated with role=arbiter.
+	Arbiter bool
+}
+
+// parseSeeds parses the comma separated seed list. Each entry is either a
+// plain address or an address followed by hints as query parameters.
+func parseSeeds(addrs string) ([]seed, error) {
+	var seeds []seed
+	for _, entry := range strings.Split(addrs, ",") {
+		s := seed{Entry: entry, Addr: entry}
+		i := strings.IndexByte(entry, '?')
+		if i == -1 {
+			seeds = append(seeds, s)
+			continue
+		}
+		s.Addr = entry[:i]
+		hints, err := url.ParseQuery(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("dvara: invalid hints in seed %q: %s", entry, err)
+		}
+		for key, values := range hints {
+			if key != "role" {
+				return nil, fmt.Errorf("dvara: unknown hint %q in seed %q", key, entry)
+			}
+			if len(values) != 1 || values[0] != "arbiter" {
+				return nil, fmt.Errorf("dvara: invalid role %q in seed %q", strings.Join(values, ","), entry)
+			}
+			s.Arbiter = true
+		}
+		seeds = append(seeds, s)
+	}
+	return seeds, nil
+}
+
 // uniq takes a slice of strings and returns a new slice with duplicates
 // removed.
 func uniq(set []string) []string {
@@ -1,9 +1,24 @@
 package dvara
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
 	"github.com/facebookgo/subset"
 
 	"gopkg.in/mgo.v2"
@@ -140,3 +155,988 @@ func TestNewListenerError(t *testing.T) {
 		t.Fatalf("did not get expected error, got: %s", err)
 	}
 }
+
+func TestResolveChanged(t *testing.T) {
+	t.Parallel()
+	calls := 0
+	r := &ReplicaSet{
+		Log: &tLogger{TB: t},
+		LookupHost: func(host string) ([]string, error) {
+			if host != "mongo.example.com" {
+				t.Fatalf("unexpected host %s", host)
+			}
+			calls++
+			if calls < 3 {
+				return []string{"10.0.0.2", "10.0.0.1"}, nil
+			}
+			return []string{"10.0.0.3"}, nil
+		},
+		realToProxy: map[string]string{"mongo.example.com:27017": "proxy:6000"},
+	}
+	if changed := r.resolveChanged(); len(changed) != 0 {
+		t.Fatalf("first resolution should not be a change: %v", changed)
+	}
+	if changed := r.resolveChanged(); len(changed) != 0 {
+		t.Fatalf("same addresses should not be a change: %v", changed)
+	}
+	ensure.DeepEqual(t, r.resolveChanged(), []string{"mongo.example.com:27017"})
+	if changed := r.resolveChanged(); len(changed) != 0 {
+		t.Fatalf("changed addresses should be remembered: %v", changed)
+	}
+}
+
+func TestResolveLoopResetsChangedMember(t *testing.T) {
+	t.Parallel()
+	creator := &fakeStateCreator{states: []*ReplicaSetState{{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+				{Name: "localhost:667", State: ReplicaStateSecondary},
+			},
+		},
+	}}}
+	var mutex sync.Mutex
+	lookups := 0
+	clk := clock.NewMock()
+	r := &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		Addrs:                   "127.0.0.1:666",
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		ReplicaSetStateCreator:  creator,
+		Clock:                   clk,
+		ResolveInterval:         time.Minute,
+		LookupHost: func(host string) ([]string, error) {
+			if host != "127.0.0.1" {
+				return []string{"10.0.0.1"}, nil
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			lookups++
+			if lookups == 1 {
+				return []string{"10.0.0.2"}, nil
+			}
+			return []string{"10.0.0.3"}, nil
+		},
+	}
+	ensure.Nil(t, r.Start())
+	defer r.Stop()
+
+	changed := r.proxies[r.realToProxy["127.0.0.1:666"]]
+	unchanged := r.proxies[r.realToProxy["localhost:667"]]
+	// The loop may not be waiting on its ticker yet, and later ticks resolve
+	// the same addresses.
+	for i := 0; atomic.LoadInt32(&changed.serverConnGeneration) == 0; i++ {
+		if i == 100 {
+			t.Fatal("server connections were not reset")
+		}
+		clk.Add(time.Minute)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if generation := atomic.LoadInt32(&changed.serverConnGeneration); generation != 1 {
+		t.Fatalf("expected 1 reset got %d", generation)
+	}
+	if generation := atomic.LoadInt32(&unchanged.serverConnGeneration); generation != 0 {
+		t.Fatalf("unchanged member was reset %d times", generation)
+	}
+	creator.mu.Lock()
+	defer creator.mu.Unlock()
+	if creator.calls != 1 {
+		t.Fatalf("expected no restart got %d discoveries", creator.calls)
+	}
+}
+
+func TestResolveChangedLookupError(t *testing.T) {
+	t.Parallel()
+	fail := false
+	r := &ReplicaSet{
+		Log: &tLogger{TB: t},
+		LookupHost: func(host string) ([]string, error) {
+			if fail {
+				return nil, errors.New("lookup failed")
+			}
+			return []string{"10.0.0.1"}, nil
+		},
+		realToProxy: map[string]string{"mongo.example.com:27017": "proxy:6000"},
+	}
+	r.resolveChanged()
+	fail = true
+	if changed := r.resolveChanged(); len(changed) != 0 {
+		t.Fatalf("lookup failure should not be a change: %v", changed)
+	}
+	if addrs := r.resolved["mongo.example.com:27017"]; len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Fatalf("unexpected resolved addresses %v", addrs)
+	}
+}
+
+func TestMaxMembers(t *testing.T) {
+	t.Parallel()
+	state := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "a", State: ReplicaStatePrimary},
+				{Name: "b", State: ReplicaStateSecondary},
+				{Name: "c", State: ReplicaStateSecondary},
+			},
+		},
+	}
+	r := &ReplicaSet{MaxMembers: 3}
+	if err := r.checkMaxMembers(state.Addrs()); err != nil {
+		t.Fatal(err)
+	}
+	r.MaxMembers = 2
+	err := r.checkMaxMembers(state.Addrs())
+	expected := "dvara: discovered 3 members which is more than the maximum of 2: [a b c]"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("did not get expected error, got: %s", err)
+	}
+}
+
+func TestMaxMembersDefault(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{}
+	addrs := make([]string, defaultMaxMembers+1)
+	if err := r.checkMaxMembers(addrs[:defaultMaxMembers]); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.checkMaxMembers(addrs); err == nil {
+		t.Fatal("was expecting an error")
+	}
+}
+
+func TestSetTunables(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		Log:            &tLogger{TB: t},
+		MessageTimeout: time.Minute,
+	}
+	if timeout := r.messageTimeout(OpQuery); timeout != time.Minute {
+		t.Fatalf("unexpected timeout %s", timeout)
+	}
+	err := r.SetTunables(Tunables{
+		MessageTimeout: time.Second,
+		OpTimeouts:     map[OpCode]time.Duration{OpInsert: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout := r.messageTimeout(OpQuery); timeout != time.Second {
+		t.Fatalf("unexpected timeout %s", timeout)
+	}
+	if timeout := r.messageTimeout(OpInsert); timeout != time.Hour {
+		t.Fatalf("unexpected timeout %s", timeout)
+	}
+
+	err = r.SetTunables(Tunables{
+		OpTimeouts: map[OpCode]time.Duration{OpInsert: -time.Second},
+	})
+	if err == nil {
+		t.Fatal("was expecting an error")
+	}
+	if timeout := r.messageTimeout(OpQuery); timeout != time.Second {
+		t.Fatalf("invalid tunables were applied, got timeout %s", timeout)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	reachable := listener.Addr().String()
+	r := &ReplicaSet{
+		Log: &tLogger{TB: t},
+		Dial: func(network, address string) (net.Conn, error) {
+			if address != reachable {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial(network, address)
+		},
+	}
+	r.proxies = map[string]*Proxy{
+		"1": {ReplicaSet: r, MongoAddr: reachable},
+		"2": {ReplicaSet: r, MongoAddr: "127.0.0.1:666"},
+	}
+	err = r.probe()
+	pre, ok := err.(*PartiallyReadyError)
+	if !ok {
+		t.Fatalf("did not get expected error, got: %s", err)
+	}
+	if len(pre.Unready) != 1 || pre.Unready[0] != "127.0.0.1:666" {
+		t.Fatalf("unexpected unready members %v", pre.Unready)
+	}
+
+	delete(r.proxies, "1")
+	err = r.probe()
+	nre, ok := err.(*NotReadyError)
+	if !ok {
+		t.Fatalf("did not get expected error, got: %s", err)
+	}
+	if len(nre.Unready) != 1 || nre.Unready[0] != "127.0.0.1:666" {
+		t.Fatalf("unexpected unready members %v", nre.Unready)
+	}
+}
+
+// addedLogger records the proxies added to a ReplicaSet.
+type addedLogger struct {
+	*tLogger
+	added []*Proxy
+}
+
+func (l *addedLogger) Infof(format string, args ...interface{}) {
+	if format == "added %s" {
+		l.added = append(l.added, args[0].(*Proxy))
+	}
+}
+
+func TestProbeOnStart(t *testing.T) {
+	t.Parallel()
+	state := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+				{Name: "127.0.0.1:667", State: ReplicaStateSecondary},
+			},
+		},
+	}
+	for _, reachable := range []string{"", "127.0.0.1:667"} {
+		var unready float64
+		log := &addedLogger{tLogger: &tLogger{TB: t}}
+		r := &ReplicaSet{
+			Log:                     log,
+			Addrs:                   "127.0.0.1:666",
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ProbeOnStart:            true,
+			ReplicaSetStateCreator:  &fakeStateCreator{states: []*ReplicaSetState{state}},
+			Dial: func(network, address string) (net.Conn, error) {
+				if address != reachable {
+					return nil, errors.New("connection refused")
+				}
+				client, server := net.Pipe()
+				server.Close()
+				return client, nil
+			},
+			Stats: &stats.HookClient{
+				BumpAvgHook: func(key string, n float64) {
+					if key == "mongoproxy.members.unready" {
+						unready = n
+					}
+				},
+			},
+		}
+		err := r.Start()
+		if reachable != "" {
+			ensure.Nil(t, err)
+			ensure.Nil(t, r.Stop())
+			ensure.DeepEqual(t, unready, float64(1))
+			continue
+		}
+		if _, ok := err.(*NotReadyError); !ok {
+			t.Fatalf("did not get expected error, got: %v", err)
+		}
+		ensure.DeepEqual(t, unready, float64(2))
+		ensure.DeepEqual(t, len(r.proxies), 0)
+		ensure.DeepEqual(t, len(log.added), 2)
+		for _, p := range log.added {
+			if c, err := net.Dial("tcp", p.ProxyAddr); err == nil {
+				c.Close()
+				t.Fatalf("proxy %s still listening after failed probe", p)
+			}
+		}
+	}
+}
+
+func TestStartFailureDropsProxies(t *testing.T) {
+	t.Parallel()
+	log := &addedLogger{tLogger: &tLogger{TB: t}}
+	r := &ReplicaSet{
+		Log:                     log,
+		Addrs:                   "127.0.0.1:666",
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		DatabaseMaxConnections:  map[string]uint{"test": 0},
+		ReplicaSetStateCreator: &fakeStateCreator{states: []*ReplicaSetState{{
+			lastRS: &replSetGetStatusResponse{
+				Members: []statusMember{
+					{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+					{Name: "127.0.0.1:667", State: ReplicaStateSecondary},
+				},
+			},
+		}}},
+	}
+	const expected = "dvara: DatabaseMaxConnections for test cannot be 0"
+	if err := r.Start(); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("did not get expected error, got: %v", err)
+	}
+	ensure.DeepEqual(t, len(r.proxies), 0)
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 0)
+	ensure.DeepEqual(t, len(log.added), 2)
+	for _, p := range log.added {
+		if c, err := net.Dial("tcp", p.ProxyAddr); err == nil {
+			c.Close()
+			t.Fatalf("proxy %s still listening after failed start", p)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		Addrs:                   "a:27017,b:27017",
+		PortStart:               6000,
+		PortEnd:                 6010,
+		MaxConnections:          100,
+		MaxPerClientConnections: 10,
+		MessageTimeout:          2 * time.Minute,
+		ClientIdleTimeout:       time.Hour,
+		OpTimeouts:              map[OpCode]time.Duration{OpInsert: 5 * time.Minute},
+		ProxyQuery: &ProxyQuery{
+			DeniedCommands:   []string{"shutdown"},
+			AllowedDatabases: []string{"test"},
+			MaxQueryDocSize:  1024,
+			MaxReplyDocs:     10,
+		},
+	}
+	r.SetMaintenanceMode(true)
+	b, err := json.Marshal(r.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual map[string]interface{}
+	if err := json.Unmarshal(b, &actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"addrs":                      "a:27017,b:27017",
+		"port_start":                 6000.0,
+		"port_end":                   6010.0,
+		"max_connections":            100.0,
+		"max_per_client_connections": 10.0,
+		"message_timeout":            "2m0s",
+		"client_idle_timeout":        "1h0m0s",
+		"get_last_error_timeout":     "0s",
+		"op_timeouts":                map[string]interface{}{"INSERT": "5m0s"},
+		"maintenance_mode":           true,
+		"denied_commands":            []interface{}{"shutdown"},
+		"allowed_databases":          []interface{}{"test"},
+		"max_query_doc_size":         1024.0,
+		"max_reply_docs":             10.0,
+		"max_reply_bytes":            0.0,
+	}
+	for k, v := range expected {
+		if !reflect.DeepEqual(actual[k], v) {
+			t.Fatalf("expected %s to be %v got %v", k, v, actual[k])
+		}
+	}
+}
+
+func TestExcludeMembers(t *testing.T) {
+	t.Parallel()
+	zero := 0
+	status := &replSetGetStatusResponse{
+		Members: []statusMember{
+			{Name: "a", State: ReplicaStatePrimary},
+			{Name: "b", State: ReplicaStateSecondary},
+			{Name: "c", State: ReplicaStateSecondary},
+			{Name: "d", State: ReplicaStateSecondary},
+		},
+	}
+	config := &replSetGetConfigResponse{}
+	config.Config.Members = []memberConfig{
+		{Host: "a"},
+		{Host: "b"},
+		{Host: "c", SlaveDelay: 3600},
+		{Host: "d", Votes: &zero},
+	}
+	status.applyConfig(config)
+
+	cases := []struct {
+		Name      string
+		Delayed   bool
+		NonVoting bool
+		Expected  []string
+	}{
+		{Name: "default", Expected: []string{"a", "b", "c", "d"}},
+		{Name: "delayed", Delayed: true, Expected: []string{"a", "b", "d"}},
+		{Name: "non voting", NonVoting: true, Expected: []string{"a", "b", "c"}},
+		{Name: "both", Delayed: true, NonVoting: true, Expected: []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		r := &ReplicaSet{
+			Log:                     &tLogger{TB: t},
+			ExcludeDelayedMembers:   c.Delayed,
+			ExcludeNonVotingMembers: c.NonVoting,
+			lastState:               &ReplicaSetState{lastRS: status},
+		}
+		if addrs := r.proxiedAddrs(); !reflect.DeepEqual(addrs, c.Expected) {
+			t.Fatalf("%s: expected %v got %v", c.Name, c.Expected, addrs)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name  string
+		Up    bool
+		Error string
+	}{
+		{Name: "mongo up", Up: true},
+		{Name: "mongo down", Error: "dvara: ping failed for all proxies"},
+	}
+	for _, c := range cases {
+		up := c.Up
+		log := &tLogger{TB: t}
+		r := &ReplicaSet{
+			Log:                     log,
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ClientIdleTimeout:       time.Minute,
+			MessageTimeout:          time.Second,
+			ProxyQuery: &ProxyQuery{
+				Log: log,
+				IsMasterResponseRewriter: &IsMasterResponseRewriter{
+					Log:                 log,
+					ProxyMapper:         fakeProxyMapper{},
+					ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true},
+					ReplyRW:             &ReplyRW{Log: log},
+				},
+			},
+			Dial: func(network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				if !up {
+					server.Close()
+					return client, nil
+				}
+				go func() {
+					defer server.Close()
+					h, err := readHeader(server)
+					if err != nil {
+						return
+					}
+					io.CopyN(ioutil.Discard, server, int64(h.MessageLength-headerLen))
+					io.Copy(server, fakeSingleDocReply(bson.M{"ismaster": true, "ok": 1}))
+				}()
+				return client, nil
+			},
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		ensure.Nil(t, err)
+		p := &Proxy{
+			Log:            log,
+			ReplicaSet:     r,
+			ClientListener: listener,
+			ProxyAddr:      listener.Addr().String(),
+			MongoAddr:      "fake:27017",
+		}
+		r.proxies = map[string]*Proxy{p.ProxyAddr: p}
+		ensure.Nil(t, p.Start())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = r.Ping(ctx)
+		cancel()
+		p.Stop()
+		if c.Error == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected error %s", c.Name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.Error) {
+			t.Fatalf("%s: expected error %q got %v", c.Name, c.Error, err)
+		}
+	}
+}
+
+func TestRecordRuntimeStats(t *testing.T) {
+	// Not parallel since it counts the goroutines in the process.
+	goroutines := func() float64 {
+		var n float64
+		r := &ReplicaSet{
+			Stats: &stats.HookClient{
+				BumpAvgHook: func(key string, val float64) {
+					if key == "mongoproxy.runtime.goroutines" {
+						n = val
+					}
+				},
+			},
+		}
+		r.recordRuntimeStats()
+		return n
+	}
+
+	before := goroutines()
+	const spawned = 50
+	stop := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(spawned)
+	for i := 0; i < spawned; i++ {
+		go func() {
+			started.Done()
+			<-stop
+		}()
+	}
+	started.Wait()
+	during := goroutines()
+	close(stop)
+	if during < before+spawned {
+		t.Fatalf("expected at least %v goroutines got %v", before+spawned, during)
+	}
+}
+
+func TestStartWithNoHealthyMembers(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	r := &ReplicaSet{
+		Log:   log,
+		Addrs: "a,b",
+		ReplicaSetStateCreator: &ReplicaSetStateCreator{
+			Log: log,
+			newState: func(addr string) (*ReplicaSetState, error) {
+				return &ReplicaSetState{
+					lastRS: &replSetGetStatusResponse{
+						Members: []statusMember{
+							{Name: "a", State: ReplicaState("RECOVERING")},
+							{Name: "b", State: ReplicaState("RECOVERING")},
+						},
+					},
+				}, nil
+			},
+		},
+	}
+	err := r.Start()
+	if err == nil || !strings.Contains(err.Error(), "no healthy primaries or secondaries") {
+		t.Fatalf("did not get expected error, got: %v", err)
+	}
+	if len(r.proxies) != 0 {
+		t.Fatalf("unexpected proxies: %v", r.proxies)
+	}
+}
+
+func TestHostnameFallback(t *testing.T) {
+	t.Parallel()
+	hostname, err := os.Hostname()
+	ensure.Nil(t, err)
+
+	cases := []struct {
+		Fallback HostnameFallback
+		Expected string
+		Err      bool
+	}{
+		{Fallback: "", Expected: loopbackHost},
+		{Fallback: HostnameFallbackLoopback, Expected: loopbackHost},
+		{Fallback: HostnameFallbackAdvertise, Expected: hostname},
+		{Fallback: HostnameFallbackFail, Err: true},
+	}
+	for _, c := range cases {
+		r := &ReplicaSet{
+			Log:              &tLogger{TB: t},
+			HostnameFallback: c.Fallback,
+			LookupHost: func(host string) ([]string, error) {
+				// A documentation address, never assigned to a local interface.
+				return []string{"192.0.2.1"}, nil
+			},
+		}
+		actual, err := r.proxyHostname()
+		if c.Err {
+			if err == nil || !strings.Contains(err.Error(), "doesn't resolve to the current host") {
+				t.Fatalf("%q: did not get expected error, got: %v", c.Fallback, err)
+			}
+			continue
+		}
+		ensure.Nil(t, err)
+		if actual != c.Expected {
+			t.Fatalf("%q: expected %s got %s", c.Fallback, c.Expected, actual)
+		}
+	}
+}
+
+func TestProxiesServing(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	var serving []float64
+	r := &ReplicaSet{
+		Log:                     log,
+		Addrs:                   "a",
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		Stats: &stats.HookClient{
+			BumpAvgHook: func(key string, val float64) {
+				if key == "mongoproxy.proxies.serving" {
+					serving = append(serving, val)
+				}
+			},
+		},
+		ReplicaSetStateCreator: &ReplicaSetStateCreator{
+			Log: log,
+			newState: func(addr string) (*ReplicaSetState, error) {
+				return &ReplicaSetState{
+					lastRS: &replSetGetStatusResponse{
+						Members: []statusMember{
+							{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+							{Name: "127.0.0.1:667", State: ReplicaStateSecondary},
+							{Name: "127.0.0.1:668", State: ReplicaState("RECOVERING")},
+						},
+					},
+				}, nil
+			},
+		},
+	}
+	ensure.Nil(t, r.Start())
+	ensure.Nil(t, r.Stop())
+	if !reflect.DeepEqual(serving, []float64{2, 0}) {
+		t.Fatalf("unexpected proxies serving %v", serving)
+	}
+}
+
+func TestParseSeeds(t *testing.T) {
+	t.Parallel()
+	seeds, err := parseSeeds("a:1,b:2?role=arbiter,c:3")
+	ensure.Nil(t, err)
+	expected := []seed{
+		{Entry: "a:1", Addr: "a:1"},
+		{Entry: "b:2?role=arbiter", Addr: "b:2", Arbiter: true},
+		{Entry: "c:3", Addr: "c:3"},
+	}
+	if !reflect.DeepEqual(seeds, expected) {
+		t.Fatalf("expected %v got %v", expected, seeds)
+	}
+}
+
+func TestParseSeedsInvalid(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Addrs string
+		Err   string
+	}{
+		{
+			Addrs: "a:1,b:2?priority=1",
+			Err:   `dvara: unknown hint "priority" in seed "b:2?priority=1"`,
+		},
+		{
+			Addrs: "a:1?role=hidden",
+			Err:   `dvara: invalid role "hidden" in seed "a:1?role=hidden"`,
+		},
+		{
+			Addrs: "a:1?role=arbiter&role=arbiter",
+			Err:   `dvara: invalid role "arbiter,arbiter" in seed "a:1?role=arbiter&role=arbiter"`,
+		},
+		{
+			Addrs: "a:1?role=%zz",
+			Err:   `dvara: invalid hints in seed "a:1?role=%zz": invalid URL escape "%zz"`,
+		},
+	}
+	for _, c := range cases {
+		_, err := parseSeeds(c.Addrs)
+		if err == nil || err.Error() != c.Err {
+			t.Fatalf("%s: expected error %q got %v", c.Addrs, c.Err, err)
+		}
+	}
+}
+
+func TestArbiterSeedNotProbed(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	r := &ReplicaSet{
+		Log:                     log,
+		Addrs:                   "127.0.0.1:666,127.0.0.1:667?role=arbiter",
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		ReplicaSetStateCreator: &ReplicaSetStateCreator{
+			Log: log,
+			newState: func(addr string) (*ReplicaSetState, error) {
+				if addr != "127.0.0.1:666" {
+					t.Errorf("unexpected probe of %s", addr)
+				}
+				return &ReplicaSetState{
+					lastRS: &replSetGetStatusResponse{
+						Members: []statusMember{
+							{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+						},
+					},
+				}, nil
+			},
+		},
+	}
+	ensure.Nil(t, r.Start())
+	defer r.Stop()
+	_, err := r.Proxy("127.0.0.1:667")
+	pme, ok := err.(*ProxyMapperError)
+	if !ok || pme.State != ReplicaStateArbiter {
+		t.Fatalf("expected arbiter to be ignored, got %v", err)
+	}
+}
+
+func TestStartupTimeout(t *testing.T) {
+	t.Parallel()
+	log := &tLogger{TB: t}
+	// Never released, so the probe outlives the test without logging.
+	release := make(chan struct{})
+	r := &ReplicaSet{
+		Log:            log,
+		Addrs:          "a",
+		StartupTimeout: 10 * time.Millisecond,
+		ReplicaSetStateCreator: &ReplicaSetStateCreator{
+			Log: log,
+			newState: func(addr string) (*ReplicaSetState, error) {
+				<-release
+				return nil, errors.New("too late")
+			},
+		},
+	}
+	const expected = "dvara: discovery did not complete within 10ms: a"
+	if err := r.Start(); err == nil || err.Error() != expected {
+		t.Fatalf("did not get expected error, got: %v", err)
+	}
+}
+
+// fakeStateCreator returns the canned states in order, one per FromAddrs call,
+// repeating the last one once they run out.
+type fakeStateCreator struct {
+	mu     sync.Mutex
+	states []*ReplicaSetState
+	calls  int
+}
+
+func (f *fakeStateCreator) FromAddrs(addrs []string, replicaSetName string) (*ReplicaSetState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := f.calls
+	if i >= len(f.states) {
+		i = len(f.states) - 1
+	}
+	f.calls++
+	return f.states[i], nil
+}
+
+func TestRestartWithFakeStateCreator(t *testing.T) {
+	t.Parallel()
+	before := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+				{Name: "127.0.0.1:667", State: ReplicaStateSecondary},
+			},
+		},
+	}
+	after := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "127.0.0.1:666", State: ReplicaStateSecondary},
+				{Name: "127.0.0.1:667", State: ReplicaStatePrimary},
+				{Name: "127.0.0.1:668", State: ReplicaStateSecondary},
+			},
+		},
+	}
+	creator := &fakeStateCreator{states: []*ReplicaSetState{before, after}}
+	r := &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		Addrs:                   "127.0.0.1:666",
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		ReplicaSetStateCreator:  creator,
+	}
+	ensure.Nil(t, r.Start())
+	defer r.Stop()
+	if len(r.proxies) != 2 {
+		t.Fatalf("expected 2 proxies got %d", len(r.proxies))
+	}
+
+	r.Restart()
+	if creator.calls != 2 {
+		t.Fatalf("expected 2 discoveries got %d", creator.calls)
+	}
+	if len(r.proxies) != 3 {
+		t.Fatalf("expected 3 proxies after restart got %d", len(r.proxies))
+	}
+	if _, err := r.Proxy("127.0.0.1:668"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRestartsCoalesce(t *testing.T) {
+	t.Parallel()
+	state := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+			},
+		},
+	}
+	creator := &fakeStateCreator{states: []*ReplicaSetState{state}}
+	r := &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		Addrs:                   "127.0.0.1:666",
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		ReplicaSetStateCreator:  creator,
+	}
+	ensure.Nil(t, r.Start())
+	defer r.Stop()
+
+	// Hold up the restart so all the callers are waiting on it.
+	r.stopMutex.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Restart()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	r.stopMutex.Unlock()
+	wg.Wait()
+
+	creator.mu.Lock()
+	defer creator.mu.Unlock()
+	if creator.calls != 2 {
+		t.Fatalf("expected 1 restart got %d", creator.calls-1)
+	}
+}
+
+func TestStopDuringRestart(t *testing.T) {
+	t.Parallel()
+	state := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+			},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		r := &ReplicaSet{
+			Log:                     &tLogger{TB: t},
+			Addrs:                   "127.0.0.1:666",
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ReplicaSetStateCreator:  &fakeStateCreator{states: []*ReplicaSetState{state}},
+		}
+		ensure.Nil(t, r.Start())
+
+		restarted := make(chan struct{})
+		go func() {
+			defer close(restarted)
+			r.Restart()
+		}()
+		ensure.Nil(t, r.Stop())
+		<-restarted
+
+		// Whichever ran first, nothing may be left listening.
+		r.lifecycleMutex.Lock()
+		for _, p := range r.proxies {
+			if c, err := net.Dial("tcp", p.ProxyAddr); err == nil {
+				c.Close()
+				t.Fatalf("proxy %s still listening after stop", p)
+			}
+		}
+		r.lifecycleMutex.Unlock()
+	}
+}
+
+func TestInspectWhileStopping(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	r := &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		ClientIdleTimeout:       time.Minute,
+		MessageTimeout:          time.Minute,
+		// The server reads the message but never replies.
+		Dial: func(network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go io.Copy(ioutil.Discard, server)
+			return client, nil
+		},
+	}
+	p := &Proxy{
+		Log:            &tLogger{TB: t},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		MongoAddr:      "fake:27017",
+		ReplicaSet:     r,
+	}
+	r.proxies = map[string]*Proxy{p.ProxyAddr: p}
+	ensure.Nil(t, p.Start())
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	h := messageHeader{OpCode: OpGetMore, MessageLength: headerLen + 4}
+	_, err = c.Write(append(h.ToWire(), 0, 0, 0, 0))
+	ensure.Nil(t, err)
+	for i := 0; p.ActiveConnections() != 1; i++ {
+		if i == 100 {
+			t.Fatal("client never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The stuck client holds up the stop until the timeout, meanwhile the
+	// proxies can still be inspected.
+	stopped := make(chan error)
+	go func() {
+		stopped <- r.StopWithTimeout(time.Second)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if n := r.TotalActiveConnections(); n != 1 {
+		t.Fatalf("expected 1 active connection got %d", n)
+	}
+	ensure.Nil(t, r.SetMaxPerClientConnections(2))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("blocked for %s while stopping", elapsed)
+	}
+	ensure.Nil(t, <-stopped)
+}
+
+func TestDirectConnection(t *testing.T) {
+	t.Parallel()
+	creator := &fakeStateCreator{states: []*ReplicaSetState{{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "127.0.0.1:666", State: ReplicaStatePrimary},
+				{Name: "127.0.0.1:667", State: ReplicaStateSecondary},
+			},
+		},
+	}}}
+	r := &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		Addrs:                   "127.0.0.1:667",
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		DirectConnection:        true,
+		ReplicaSetStateCreator:  creator,
+	}
+	ensure.Nil(t, r.Start())
+	defer r.Stop()
+	if creator.calls != 0 {
+		t.Fatalf("expected no discovery got %d", creator.calls)
+	}
+	if len(r.proxies) != 1 {
+		t.Fatalf("expected 1 proxy got %d", len(r.proxies))
+	}
+	if _, err := r.Proxy("127.0.0.1:667"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Proxy("127.0.0.1:666"); err == nil {
+		t.Fatal("primary was proxied")
+	}
+
+	r2 := &ReplicaSet{
+		Log:                    &tLogger{TB: t},
+		Addrs:                  "127.0.0.1:666,127.0.0.1:667",
+		DirectConnection:       true,
+		ReplicaSetStateCreator: creator,
+	}
+	if err := r2.Start(); err != errDirectConnectionAddrs {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
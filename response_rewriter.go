@@ -7,9 +7,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/stats"
 
 	"gopkg.in/mgo.v2/bson"
 )
@@ -31,6 +36,274 @@ type ProxyQuery struct {
 	GetLastErrorRewriter             *GetLastErrorRewriter             `inject:""`
 	IsMasterResponseRewriter         *IsMasterResponseRewriter         `inject:""`
 	ReplSetGetStatusResponseRewriter *ReplSetGetStatusResponseRewriter `inject:""`
+	BuildInfoResponseRewriter        *BuildInfoResponseRewriter        `inject:""`
+	Stats                            stats.Client                      `inject:""`
+
+	// ReplicaSet is the replica set the queries are proxied for, whose ReadOnly
+	// setting applies to commands. It's set by ReplicaSet.Start.
+	ReplicaSet *ReplicaSet
+
+	// DeniedCommands are commands that will be rejected with an error instead
+	// of being proxied, for example "shutdown". They are matched case
+	// insensitively.
+	DeniedCommands []string
+
+	// AllowedDatabases if not empty restricts queries, commands, inserts,
+	// updates, deletes and getMores to these databases. The handshake commands
+	// on the admin database are always allowed.
+	AllowedDatabases []string
+
+	// TailableCursorTimeout if non zero replaces the message timeout for
+	// queries with the tailable or awaitData flags, which may legitimately wait
+	// on the server for a long time. Such queries also pin the client's server
+	// connection until it disconnects, so the cursor's getMores and any
+	// getLastError calls use the connection that opened it.
+	TailableCursorTimeout time.Duration
+
+	// DisableCompressionNegotiation if true removes the compression field from
+	// handshakes, so the server agrees to no compression and all traffic stays
+	// uncompressed and rewritable. Otherwise only the compressors the proxy
+	// implements are left in handshakes.
+	DisableCompressionNegotiation bool
+
+	// MaxQueryDocSize if non zero is the largest query or command document in
+	// bytes that will be proxied. Larger documents are rejected with an error
+	// instead of reaching mongo. Only the length of query documents that aren't
+	// otherwise inspected is read. The document sequences of an OpMsg count
+	// towards the size of its command.
+	MaxQueryDocSize int
+
+	// TagAppName if true appends the client IP to the application name in the
+	// client metadata sent with handshakes, so the server side connections
+	// can be attributed to the clients. Handshakes without client metadata are
+	// left alone, since mongo only accepts it on the first handshake.
+	TagAppName bool
+
+	// RestartOnStaleTopology if true checks command replies for not master and
+	// node is recovering errors, and restarts the replica set to rediscover it
+	// when one is seen instead of waiting for the next topology check. The
+	// reply is still passed on to the client, which keeps its connection.
+	RestartOnStaleTopology bool
+
+	// MaxReplyDocs and MaxReplyBytes if non zero limit the number of documents
+	// and bytes of documents relayed in a single query or getMore reply. Larger
+	// replies are truncated and their cursor closed. Command replies are not
+	// limited, except for find and getMore sent as OpMsg.
+	MaxReplyDocs  int
+	MaxReplyBytes int
+
+	// DirectConnection if true passes isMaster, hello and replSetGetStatus
+	// replies through without rewriting the members, for use with
+	// ReplicaSet.DirectConnection where only one member is proxied.
+	DirectConnection bool
+}
+
+// readOnlyCommands are the commands besides the handshakeCommands allowed
+// when ReplicaSet.ReadOnly is set. mongo has many commands that write, so
+// anything not known to only read is rejected.
+var readOnlyCommands = []string{
+	"find",
+	"getMore",
+	"killCursors",
+	"count",
+	"distinct",
+	"group",
+	"geoNear",
+	"geoSearch",
+	"parallelCollectionScan",
+	"aggregate",
+	"mapReduce",
+	"explain",
+	"listCollections",
+	"listIndexes",
+	"listDatabases",
+	"listCommands",
+	"collStats",
+	"dbStats",
+	"dataSize",
+	"serverStatus",
+	"hostInfo",
+	"connectionStatus",
+	"getCmdLineOpts",
+	"getParameter",
+	"getPrevError",
+	"usersInfo",
+	"rolesInfo",
+	"logout",
+	"startSession",
+	"endSessions",
+}
+
+// readOnlyAllowed checks if the command document only reads. aggregate and
+// mapReduce are allowed unless they write their results to a collection, and
+// explain if the command it explains is allowed.
+func readOnlyAllowed(cmd bson.D) bool {
+	if len(cmd) == 0 {
+		return false
+	}
+	name := cmd[0].Name
+	if isHandshake(name) {
+		return true
+	}
+	allowed := false
+	for _, c := range readOnlyCommands {
+		if strings.EqualFold(name, c) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	switch strings.ToLower(name) {
+	case "aggregate":
+		for _, e := range cmd {
+			if e.Name != "pipeline" {
+				continue
+			}
+			stages, _ := e.Value.([]interface{})
+			for _, stage := range stages {
+				if s, ok := stage.(bson.D); ok && len(s) > 0 && (s[0].Name == "$out" || s[0].Name == "$merge") {
+					return false
+				}
+			}
+		}
+	case "mapreduce":
+		for _, e := range cmd {
+			if e.Name != "out" {
+				continue
+			}
+			out, ok := e.Value.(bson.D)
+			if !ok || len(out) == 0 || out[0].Name != "inline" {
+				return false
+			}
+		}
+	case "explain":
+		explained, ok := cmd[0].Value.(bson.D)
+		return ok && readOnlyAllowed(explained)
+	}
+	return true
+}
+
+// errReadOnly is the error reported for writes rejected in read-only mode.
+const errReadOnly = "proxy is read-only"
+
+// readOnly returns true if the ReplicaSet is read-only, in which case commands
+// that aren't known to only read are rejected. See readOnlyAllowed.
+func (p *ProxyQuery) readOnly() bool {
+	return p.ReplicaSet != nil && p.ReplicaSet.ReadOnly
+}
+
+// maxAppNameLen is the longest application name mongo accepts.
+const maxAppNameLen = 128
+
+// appNameTag returns the tag identifying the client in application names.
+func appNameTag(client io.ReadWriter) string {
+	if c, ok := client.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		if host, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil && host != "" {
+			return "dvara " + host
+		}
+	}
+	return "dvara"
+}
+
+// tagAppName appends the tag to client.application.name in the handshake and
+// returns true if there was client metadata to tag.
+func tagAppName(q bson.D, tag string) bool {
+	for i := range q {
+		if !strings.EqualFold(q[i].Name, "client") {
+			continue
+		}
+		client, ok := q[i].Value.(bson.D)
+		if !ok {
+			return false
+		}
+		for j := range client {
+			if client[j].Name != "application" {
+				continue
+			}
+			application, ok := client[j].Value.(bson.D)
+			if !ok {
+				return false
+			}
+			for k := range application {
+				if application[k].Name == "name" {
+					name, _ := application[k].Value.(string)
+					application[k].Value = appendAppNameTag(name, tag)
+					return true
+				}
+			}
+			client[j].Value = append(application, bson.DocElem{Name: "name", Value: tag})
+			return true
+		}
+		q[i].Value = append(client, bson.DocElem{
+			Name:  "application",
+			Value: bson.D{{Name: "name", Value: tag}},
+		})
+		return true
+	}
+	return false
+}
+
+// appendAppNameTag appends the tag to the name, truncating the name to keep
+// within maxAppNameLen.
+func appendAppNameTag(name, tag string) string {
+	if name == "" {
+		return tag
+	}
+	tag = " via " + tag
+	if max := maxAppNameLen - len(tag); len(name) > max {
+		if max < 0 {
+			max = 0
+		}
+		name = name[:max]
+	}
+	return name + tag
+}
+
+// withoutUnsupportedCompressors removes the compressors that aren't
+// negotiableCompressors from the compression field of the handshake, and
+// returns true if any were removed.
+func withoutUnsupportedCompressors(q bson.D) bool {
+	for i := range q {
+		if !strings.EqualFold(q[i].Name, "compression") {
+			continue
+		}
+		compressors, ok := q[i].Value.([]interface{})
+		if !ok {
+			return false
+		}
+		supported := make([]interface{}, 0, len(compressors))
+		for _, c := range compressors {
+			name, _ := c.(string)
+			for _, n := range negotiableCompressors {
+				if name == n {
+					supported = append(supported, c)
+				}
+			}
+		}
+		if len(supported) == len(compressors) {
+			return false
+		}
+		q[i].Value = supported
+		return true
+	}
+	return false
+}
+
+// OpQuery flags.
+const (
+	queryFlagTailableCursor  = 1 << 1
+	queryFlagNoCursorTimeout = 1 << 4
+	queryFlagAwaitData       = 1 << 5
+)
+
+// deadliner is implemented by net.Conn.
+type deadliner interface {
+	SetDeadline(t time.Time) error
 }
 
 // Proxy proxies an OpQuery and a corresponding response.
@@ -49,6 +322,10 @@ func (p *ProxyQuery) Proxy(
 
 	parts := [][]byte{h.ToWire()}
 
+	// grown is the number of bytes the buffered parts grew by when rewriting the
+	// query, which isn't reflected in the header read from the client.
+	var grown int
+
 	var flags [4]byte
 	if _, err := io.ReadFull(client, flags[:]); err != nil {
 		p.Log.Error(err)
@@ -56,6 +333,16 @@ func (p *ProxyQuery) Proxy(
 	}
 	parts = append(parts, flags[:])
 
+	if p.TailableCursorTimeout != 0 &&
+		getInt32(flags[:], 0)&(queryFlagTailableCursor|queryFlagAwaitData) != 0 {
+		deadline := p.clock().Now().Add(p.TailableCursorTimeout)
+		for _, c := range []io.ReadWriter{client, server} {
+			if d, ok := c.(deadliner); ok {
+				d.SetDeadline(deadline)
+			}
+		}
+	}
+
 	fullCollectionName, err := readCString(client)
 	if err != nil {
 		p.Log.Error(err)
@@ -63,6 +350,14 @@ func (p *ProxyQuery) Proxy(
 	}
 	parts = append(parts, fullCollectionName)
 
+	db := databaseName(fullCollectionName)
+	dbAllowed := p.databaseAllowed(db)
+	dbDeniedMsg := fmt.Sprintf("database %s not allowed by proxy", db)
+	if !dbAllowed && !bytes.Equal(adminCollectionName, fullCollectionName) {
+		stats.BumpSum(p.Stats, "mongoproxy.database.denied", 1)
+		return p.reject(h, parts, client, errCodeUnauthorized, dbDeniedMsg)
+	}
+
 	var rewriter responseRewriter
 	if *proxyAllQueries || bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
 		var twoInt32 [8]byte
@@ -72,11 +367,31 @@ func (p *ProxyQuery) Proxy(
 		}
 		parts = append(parts, twoInt32[:])
 
-		queryDoc, err := readDocument(client)
+		// The length of the query document is checked before it's buffered.
+		var sizeRaw [4]byte
+		if _, err := io.ReadFull(client, sizeRaw[:]); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		if size := int(getInt32(sizeRaw[:], 0)); p.MaxQueryDocSize > 0 && size > p.MaxQueryDocSize {
+			stats.BumpSum(p.Stats, "mongoproxy.query.too.large", 1)
+			return p.reject(h, append(parts, sizeRaw[:]), client, errCodeObjectTooLarge, fmt.Sprintf(
+				"query document of %d bytes exceeds the proxy limit of %d bytes",
+				size,
+				p.MaxQueryDocSize,
+			))
+		}
+
+		// The buffer is returned once the query has been proxied. Nothing keeps
+		// a reference to it, the getLastError cache holds the server's reply.
+		docBuf := getDocBuffer()
+		defer putDocBuffer(docBuf)
+		queryDoc, err := readDocumentInto(io.MultiReader(bytes.NewReader(sizeRaw[:]), client), docBuf.b)
 		if err != nil {
 			p.Log.Error(err)
 			return err
 		}
+		docBuf.b = queryDoc
 		parts = append(parts, queryDoc)
 
 		var q bson.D
@@ -91,6 +406,31 @@ func (p *ProxyQuery) Proxy(
 			spew.Sdump(q),
 		)
 
+		// cmdDoc is the command mongo will run, empty for queries on
+		// collections.
+		var cmdDoc bson.D
+		var cmd string
+		if bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
+			if cmdDoc = queryCommand(q); len(cmdDoc) > 0 {
+				cmd = cmdDoc[0].Name
+			}
+		}
+
+		if !dbAllowed && !isHandshake(cmd) {
+			stats.BumpSum(p.Stats, "mongoproxy.database.denied", 1)
+			return p.reject(h, parts, client, errCodeUnauthorized, dbDeniedMsg)
+		}
+
+		if denied, ok := p.commandDenied(cmd); ok {
+			stats.BumpSum(p.Stats, "mongoproxy.command.denied", 1)
+			return p.reject(h, parts, client, errCodeUnauthorized, fmt.Sprintf("command %s denied by proxy", denied))
+		}
+
+		if p.readOnly() && cmdDoc != nil && !readOnlyAllowed(cmdDoc) {
+			stats.BumpSum(p.Stats, "mongoproxy.write.rejected", 1)
+			return p.reject(h, parts, client, errCodeUnauthorized, errReadOnly)
+		}
+
 		if hasKey(q, "getLastError") {
 			return p.GetLastErrorRewriter.Rewrite(
 				h,
@@ -101,11 +441,37 @@ func (p *ProxyQuery) Proxy(
 			)
 		}
 
-		if hasKey(q, "isMaster") {
-			rewriter = p.IsMasterResponseRewriter
+		if hasKey(q, "isMaster") || hasKey(q, "hello") {
+			var rewritten bool
+			if q, rewritten = p.rewriteHandshake(q, client); rewritten {
+				newDoc, err := bson.Marshal(q)
+				if err != nil {
+					p.Log.Error(err)
+					return err
+				}
+				grown = len(newDoc) - len(queryDoc)
+				newH := *h
+				newH.MessageLength += int32(grown)
+				parts[0] = newH.ToWire()
+				parts[len(parts)-1] = newDoc
+			}
+		}
+
+		// isMaster and hello are answered the same on every database's $cmd, and
+		// drivers send them to the database they connect to as well as admin.
+		// replSetGetStatus is only valid against admin.
+		if !p.DirectConnection {
+			if hasKey(q, "isMaster") || hasKey(q, "hello") {
+				rewriter = p.IsMasterResponseRewriter
+			}
+			if bytes.Equal(adminCollectionName, fullCollectionName) && hasKey(q, "replSetGetStatus") {
+				rewriter = p.ReplSetGetStatusResponseRewriter
+			}
 		}
-		if bytes.Equal(adminCollectionName, fullCollectionName) && hasKey(q, "replSetGetStatus") {
-			rewriter = p.ReplSetGetStatusResponseRewriter
+		if p.BuildInfoResponseRewriter != nil &&
+			p.BuildInfoResponseRewriter.BuildInfoOverride != "" &&
+			hasKey(q, "buildInfo") {
+			rewriter = p.BuildInfoResponseRewriter
 		}
 
 		if rewriter != nil {
@@ -113,6 +479,23 @@ func (p *ProxyQuery) Proxy(
 			// comment above around resetLastError for details.
 			resetLastError = hasKey(q, "forShell")
 		}
+	} else if p.MaxQueryDocSize > 0 {
+		// numberToSkip and numberToReturn followed by the length of the query
+		// document, the rest of which is streamed.
+		var prefix [12]byte
+		if _, err := io.ReadFull(client, prefix[:]); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		parts = append(parts, prefix[:])
+		if size := int(getInt32(prefix[:], 8)); size > p.MaxQueryDocSize {
+			stats.BumpSum(p.Stats, "mongoproxy.query.too.large", 1)
+			return p.reject(h, parts, client, errCodeObjectTooLarge, fmt.Sprintf(
+				"query document of %d bytes exceeds the proxy limit of %d bytes",
+				size,
+				p.MaxQueryDocSize,
+			))
+		}
 	}
 
 	if resetLastError && lastError.Exists() {
@@ -120,34 +503,418 @@ func (p *ProxyQuery) Proxy(
 		lastError.Reset()
 	}
 
-	var written int
+	// Coalesce the buffered parts into a single write.
+	var buf bytes.Buffer
 	for _, b := range parts {
-		n, err := server.Write(b)
-		if err != nil {
+		buf.Write(b)
+	}
+	written, err := server.Write(buf.Bytes())
+	if err != nil {
+		p.Log.Error(err)
+		return err
+	}
+
+	pending := int64(h.MessageLength) - int64(written) + int64(grown)
+	if _, err := io.CopyN(server, client, pending); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+
+	if rewriter != nil {
+		return p.rewriteErr(rewriter.Rewrite(client, server))
+	}
+
+	if p.RestartOnStaleTopology && bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
+		var reply bytes.Buffer
+		if err := copyReplyMessage(client, io.TeeReader(server, &reply)); err != nil {
 			p.Log.Error(err)
 			return err
 		}
-		written += n
+		// The client already has the reply and keeps its connection, only the
+		// replica set is rediscovered.
+		if staleTopologyReply(reply.Bytes()) {
+			stats.BumpSum(p.Stats, "mongoproxy.stale.topology", 1)
+			p.Log.Warn("server replied it is not the primary, restarting the replica set")
+			if p.ReplicaSet != nil {
+				go p.ReplicaSet.Restart()
+			}
+		}
+		return nil
 	}
 
-	pending := int64(h.MessageLength) - int64(written)
-	if _, err := io.CopyN(server, client, pending); err != nil {
+	if !bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
+		return p.copyReply(client, server)
+	}
+
+	if err := copyReplyMessage(client, server); err != nil {
 		p.Log.Error(err)
 		return err
 	}
 
-	if rewriter != nil {
-		if err := rewriter.Rewrite(client, server); err != nil {
+	return nil
+}
+
+// rewriteErr returns the error of a reply rewriter. errPrimaryUnmappable
+// means the reply was relayed without the primary during an election, and the
+// replica set is restarted to rediscover it while the client stays connected.
+func (p *ProxyQuery) rewriteErr(err error) error {
+	if err != errPrimaryUnmappable {
+		return err
+	}
+	if p.ReplicaSet != nil {
+		go p.ReplicaSet.Restart()
+	}
+	return nil
+}
+
+// clock returns the ReplicaSet's Clock, defaulting to the real clock.
+func (p *ProxyQuery) clock() clock.Clock {
+	if p.ReplicaSet == nil {
+		return clock.New()
+	}
+	return p.ReplicaSet.clock()
+}
+
+// negotiableCompressors are the compressors clients may negotiate with the
+// server, those the proxy can decompress.
+var negotiableCompressors = []string{"zlib"}
+
+// rewriteHandshake applies DisableCompressionNegotiation and TagAppName to the
+// isMaster or hello command, and returns true if it was changed.
+func (p *ProxyQuery) rewriteHandshake(q bson.D, client io.ReadWriter) (bson.D, bool) {
+	rewritten := false
+	if p.DisableCompressionNegotiation && hasKey(q, "compression") {
+		q = withoutKey(q, "compression")
+		rewritten = true
+		stats.BumpSum(p.Stats, "mongoproxy.compression.stripped", 1)
+	} else if withoutUnsupportedCompressors(q) {
+		rewritten = true
+		stats.BumpSum(p.Stats, "mongoproxy.compressors.unsupported", 1)
+	}
+	if p.TagAppName && tagAppName(q, appNameTag(client)) {
+		rewritten = true
+	}
+	return q, rewritten
+}
+
+// ProxyMsg proxies an OpMsg and its reply, given the start of the message
+// read with readOpMsgHead. The command is checked like OpQuery commands are,
+// and isMaster and hello replies are rewritten. Only handshakes and messages
+// with the exhaust flag are buffered, the rest of other messages is streamed
+// to the server.
+func (p *ProxyQuery) ProxyMsg(
+	h *messageHeader,
+	head *opMsgHead,
+	client io.ReadWriter,
+	server io.ReadWriter,
+) error {
+
+	pending := int64(h.MessageLength) - headerLen - int64(len(head.raw))
+	cmd := commandName(head.Body)
+
+	var q bson.D
+	if len(p.AllowedDatabases) > 0 || p.readOnly() {
+		if err := bson.Unmarshal(head.Body, &q); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+	}
+
+	if len(p.AllowedDatabases) > 0 {
+		var db string
+		for _, e := range q {
+			if e.Name == "$db" {
+				db, _ = e.Value.(string)
+			}
+		}
+		if !p.databaseAllowed(db) && !(db == "admin" && isHandshake(cmd)) {
+			stats.BumpSum(p.Stats, "mongoproxy.database.denied", 1)
+			return p.rejectMsg(h, head, pending, client, errCodeUnauthorized, fmt.Sprintf("database %s not allowed by proxy", db))
+		}
+	}
+
+	// The document sequences are counted since they'd be part of the command
+	// document if it was sent as an OpQuery.
+	if size := int(h.MessageLength) - headerLen - 4; p.MaxQueryDocSize > 0 && size > p.MaxQueryDocSize {
+		stats.BumpSum(p.Stats, "mongoproxy.query.too.large", 1)
+		return p.rejectMsg(h, head, pending, client, errCodeObjectTooLarge, fmt.Sprintf(
+			"command of %d bytes exceeds the proxy limit of %d bytes",
+			size,
+			p.MaxQueryDocSize,
+		))
+	}
+
+	if denied, ok := p.commandDenied(cmd); ok {
+		stats.BumpSum(p.Stats, "mongoproxy.command.denied", 1)
+		return p.rejectMsg(h, head, pending, client, errCodeUnauthorized, fmt.Sprintf("command %s denied by proxy", denied))
+	}
+
+	if p.readOnly() && !readOnlyAllowed(q) {
+		stats.BumpSum(p.Stats, "mongoproxy.write.rejected", 1)
+		return p.rejectMsg(h, head, pending, client, errCodeUnauthorized, errReadOnly)
+	}
+
+	handshake := strings.EqualFold(cmd, "isMaster") || strings.EqualFold(cmd, "hello")
+	if handshake || head.Flags&opMsgExhaustAllowed != 0 {
+		b := make([]byte, int64(len(head.raw))+pending)
+		copy(b, head.raw)
+		if _, err := io.ReadFull(client, b[len(head.raw):]); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		m, err := parseOpMsg(b)
+		if err != nil {
+			p.Log.Error(err)
+			return err
+		}
+
+		// The server keeps sending exhaust replies until it's done, which for an
+		// awaitable hello is never, but the server connection is only held for a
+		// single reply. Without the flag the server replies once and the driver
+		// sends another request when it wants more.
+		if m.Flags&opMsgExhaustAllowed != 0 {
+			m.Flags &^= opMsgExhaustAllowed
+			stats.BumpSum(p.Stats, "mongoproxy.exhaust.disabled", 1)
+		}
+
+		if handshake {
+			if q == nil {
+				if err := bson.Unmarshal(head.Body, &q); err != nil {
+					p.Log.Error(err)
+					return err
+				}
+			}
+			if q, rewritten := p.rewriteHandshake(q, client); rewritten {
+				newDoc, err := bson.Marshal(q)
+				if err != nil {
+					p.Log.Error(err)
+					return err
+				}
+				m.SetBody(newDoc)
+			}
+		}
+
+		if err := writeOpMsg(server, h, m); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+	} else {
+		if _, err := server.Write(append(h.ToWire(), head.raw...)); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		if _, err := io.CopyN(server, client, pending); err != nil {
+			p.Log.Error(err)
 			return err
 		}
+	}
+	if head.Flags&opMsgMoreToCome != 0 {
 		return nil
 	}
 
-	if err := copyMessage(client, server); err != nil {
+	if handshake && !p.DirectConnection {
+		return p.rewriteErr(p.IsMasterResponseRewriter.RewriteMsg(client, server))
+	}
+	if (p.MaxReplyDocs != 0 || p.MaxReplyBytes != 0) &&
+		(strings.EqualFold(cmd, "find") || strings.EqualFold(cmd, "getMore")) {
+		return p.copyMsgReply(client, server)
+	}
+	if err := copyOpMsgReplies(client, server); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// rejectMsg discards the rest of the OpMsg from the client and responds with
+// an error reply instead of proxying it, unless the client expects no reply.
+func (p *ProxyQuery) rejectMsg(
+	h *messageHeader,
+	head *opMsgHead,
+	pending int64,
+	client io.ReadWriter,
+	code int,
+	msg string,
+) error {
+
+	p.Log.Errorf("rejecting command: %s", msg)
+	if _, err := io.CopyN(ioutil.Discard, client, pending); err != nil {
 		p.Log.Error(err)
 		return err
 	}
+	if head.Flags&opMsgMoreToCome != 0 {
+		return nil
+	}
+	if err := writeMsgErrorReply(client, h.RequestID, code, msg); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	return nil
+}
 
+// copyMsgReply copies a find or getMore OpMsg reply to the client, applying
+// the MaxReplyDocs and MaxReplyBytes limits to its batch. The cursor of a
+// truncated batch is killed on the server.
+func (p *ProxyQuery) copyMsgReply(client io.Writer, server io.ReadWriter) error {
+	h, m, err := readOpMsgReply(server)
+	if err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	doc, cursorID, ns, err := limitCursorBatch(m.Body(), p.MaxReplyDocs, p.MaxReplyBytes)
+	if err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	if doc != nil {
+		stats.BumpSum(p.Stats, "mongoproxy.reply.truncated", 1)
+		p.Log.Warnf("truncated reply over the limit of %d documents and %d bytes", p.MaxReplyDocs, p.MaxReplyBytes)
+		m.SetBody(doc)
+	}
+	writeErr := writeOpMsg(client, h, m)
+	if cursorID != 0 {
+		if err := writeKillCursorsMsg(server, ns, cursorID); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		if err := copyOpMsgReplies(ioutil.Discard, server); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+	}
+	if writeErr != nil {
+		p.Log.Error(writeErr)
+		return writeErr
+	}
+	return nil
+}
+
+// copyReply copies a query or getMore reply to the client, applying the
+// MaxReplyDocs and MaxReplyBytes limits.
+func (p *ProxyQuery) copyReply(client io.Writer, server io.ReadWriter) error {
+	if p.MaxReplyDocs == 0 && p.MaxReplyBytes == 0 {
+		if err := copyReplyMessage(client, server); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		return nil
+	}
+	truncated, cursorID, err := copyReplyLimited(client, server, p.MaxReplyDocs, p.MaxReplyBytes)
+	if truncated {
+		stats.BumpSum(p.Stats, "mongoproxy.reply.truncated", 1)
+		p.Log.Warnf("truncated reply over the limit of %d documents and %d bytes", p.MaxReplyDocs, p.MaxReplyBytes)
+	}
+	if cursorID != nil {
+		if err := writeKillCursors(server, cursorID); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+	}
+	if err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// commandDenied checks if the command is one of the DeniedCommands, and
+// returns the matching entry.
+func (p *ProxyQuery) commandDenied(cmd string) (string, bool) {
+	if cmd == "" {
+		return "", false
+	}
+	for _, denied := range p.DeniedCommands {
+		if strings.EqualFold(cmd, denied) {
+			return denied, true
+		}
+	}
+	return "", false
+}
+
+// databaseAllowed checks if queries against the given database are allowed.
+func (p *ProxyQuery) databaseAllowed(db string) bool {
+	if len(p.AllowedDatabases) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedDatabases {
+		if allowed == db {
+			return true
+		}
+	}
+	return false
+}
+
+// databaseName returns the database name from a null terminated full
+// collection name like "db.collection".
+func databaseName(fullCollectionName []byte) string {
+	name := bytes.TrimSuffix(fullCollectionName, []byte{x00})
+	if i := bytes.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	return string(name)
+}
+
+// handshakeCommands are the admin commands drivers need to connect.
+var handshakeCommands = []string{
+	"isMaster",
+	"hello",
+	"ping",
+	"buildInfo",
+	"getnonce",
+	"saslStart",
+	"saslContinue",
+	"authenticate",
+	"whatsmyuri",
+	"getLastError",
+	"replSetGetStatus",
+}
+
+// isHandshake checks if the command is one of the handshakeCommands.
+func isHandshake(cmd string) bool {
+	for _, handshake := range handshakeCommands {
+		if strings.EqualFold(cmd, handshake) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryCommand returns the command document an OpQuery against a $cmd
+// collection runs, unwrapping commands sent as a $query with query modifiers
+// like $readPreference. mongo runs the command named by its first key.
+func queryCommand(q bson.D) bson.D {
+	if len(q) > 0 && (q[0].Name == "$query" || q[0].Name == "query") {
+		if wrapped, ok := q[0].Value.(bson.D); ok {
+			return wrapped
+		}
+	}
+	return q
+}
+
+// reject discards the rest of the query from the client and responds with an
+// error reply instead of proxying it.
+func (p *ProxyQuery) reject(
+	h *messageHeader,
+	parts [][]byte,
+	client io.ReadWriter,
+	code int,
+	msg string,
+) error {
+
+	p.Log.Errorf("rejecting query: %s", msg)
+	var read int
+	for _, b := range parts {
+		read += len(b)
+	}
+	pending := int64(h.MessageLength) - int64(read)
+	if _, err := io.CopyN(ioutil.Discard, client, pending); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	if err := writeErrorReply(client, h.RequestID, code, msg); err != nil {
+		p.Log.Error(err)
+		return err
+	}
 	return nil
 }
 
@@ -155,6 +922,10 @@ func (p *ProxyQuery) Proxy(
 type LastError struct {
 	header *messageHeader
 	rest   bytes.Buffer
+
+	// local is true if the error was generated by the proxy rather than cached
+	// from the server, so it must be replayed even with caching disabled.
+	local bool
 }
 
 // Exists returns true if this instance contains a cached error.
@@ -166,6 +937,22 @@ func (l *LastError) Exists() bool {
 func (l *LastError) Reset() {
 	l.header = nil
 	l.rest.Reset()
+	l.local = false
+}
+
+// setLocal replaces the last error with an error reply generated by the proxy.
+func (l *LastError) setLocal(code int, msg string) error {
+	l.Reset()
+	if err := writeErrorReply(&l.rest, 0, code, msg); err != nil {
+		return err
+	}
+	h, err := readHeader(&l.rest)
+	if err != nil {
+		return err
+	}
+	l.header = h
+	l.local = true
+	return nil
 }
 
 // GetLastErrorRewriter handles getLastError requests and proxies, caches or
@@ -207,6 +994,17 @@ func (r *GetLastErrorRewriter) Rewrite(
 			r.Log.Error(err)
 			return err
 		}
+		// Refuse to cache a malformed response, it would be replayed for every
+		// subsequent getLastError call.
+		if lastError.header.MessageLength < headerLen {
+			err := fmt.Errorf(
+				"getLastError: invalid response message length %d",
+				lastError.header.MessageLength,
+			)
+			lastError.Reset()
+			r.Log.Error(err)
+			return err
+		}
 		pending = int64(lastError.header.MessageLength - headerLen)
 		if _, err = io.CopyN(&lastError.rest, server, pending); err != nil {
 			r.Log.Error(err)
@@ -242,7 +1040,63 @@ func (r *GetLastErrorRewriter) Rewrite(
 	return nil
 }
 
-var errRSChanged = errors.New("dvara: replset config changed")
+var (
+	errRSChanged         = errors.New("dvara: replset config changed")
+	errPrimaryUnmappable = errors.New("dvara: primary is not proxied yet")
+)
+
+// staleTopologyCodes are the error codes mongo replies with when a command
+// reached a member that is no longer, or not yet, in the expected state.
+var staleTopologyCodes = []int{
+	10107, // NotMaster
+	13435, // NotMasterNoSlaveOk
+	13436, // NotMasterOrSecondary
+	11602, // InterruptedDueToReplStateChange
+	189,   // PrimarySteppedDown
+}
+
+// staleTopologyReply checks if the raw reply message is a not master or node
+// is recovering error. Replies that can't be parsed aren't.
+func staleTopologyReply(b []byte) bool {
+	r := bytes.NewReader(b)
+	h, err := readHeader(r)
+	if err != nil {
+		return false
+	}
+	if h.OpCode == OpCompressed {
+		var body []byte
+		if h, body, err = decompressMessage(h, r); err != nil {
+			return false
+		}
+		r = bytes.NewReader(body)
+	}
+	if h.OpCode != OpReply {
+		return false
+	}
+	var prefix replyPrefix
+	if _, err := io.ReadFull(r, prefix[:]); err != nil || getInt32(prefix[:], 16) != 1 {
+		return false
+	}
+	doc, err := readDocument(r)
+	if err != nil {
+		return false
+	}
+	var reply struct {
+		OK     float64 `bson:"ok"`
+		Code   int     `bson:"code"`
+		ErrMsg string  `bson:"errmsg"`
+	}
+	if err := bson.Unmarshal(doc, &reply); err != nil || reply.OK != 0 {
+		return false
+	}
+	for _, code := range staleTopologyCodes {
+		if reply.Code == code {
+			return true
+		}
+	}
+	msg := strings.ToLower(reply.ErrMsg)
+	return strings.Contains(msg, "not master") || strings.Contains(msg, "node is recovering")
+}
 
 // ProxyMapper maps real mongo addresses to their corresponding proxy
 // addresses.
@@ -250,6 +1104,22 @@ type ProxyMapper interface {
 	Proxy(h string) (string, error)
 }
 
+// StaticProxyMapper is a ProxyMapper using a fixed mapping of real mongo
+// addresses to proxy addresses. It can be used instead of the ReplicaSet when
+// the mapping is known ahead of time, for example when fronted by a load
+// balancer. Provide it by setting the ProxyMapper on the rewriters before
+// populating the graph.
+type StaticProxyMapper map[string]string
+
+// Proxy returns the proxy address for the given real mongo address.
+func (s StaticProxyMapper) Proxy(h string) (string, error) {
+	p, ok := s[h]
+	if !ok {
+		return "", fmt.Errorf("mongo %s is not in StaticProxyMapper", h)
+	}
+	return p, nil
+}
+
 // ReplicaStateCompare provides the last ReplicaSetState and allows for
 // checking if it has changed as we rewrite/proxy the isMaster &
 // replSetGetStatus queries.
@@ -272,43 +1142,54 @@ type ReplyRW struct {
 }
 
 // ReadOne reads a 1 document response, from the server, unmarshals it into v
-// and returns the various parts.
-func (r *ReplyRW) ReadOne(server io.Reader, v interface{}) (*messageHeader, replyPrefix, int32, error) {
+// and returns the various parts. The raw document is returned as read so it
+// can be forwarded or logged as is.
+func (r *ReplyRW) ReadOne(server io.Reader, v interface{}) (*messageHeader, replyPrefix, []byte, error) {
 	h, err := readHeader(server)
 	if err != nil {
 		r.Log.Error(err)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, nil, err
+	}
+
+	// Compressed replies are decompressed here and compressed again with the
+	// same compressor in WriteOne.
+	if h.OpCode == OpCompressed {
+		var body []byte
+		if h, body, err = decompressMessage(h, server); err != nil {
+			r.Log.Error(err)
+			return nil, emptyPrefix, nil, err
+		}
+		server = bytes.NewReader(body)
 	}
 
 	if h.OpCode != OpReply {
-		err := fmt.Errorf("readOneReplyDoc: expected op %s, got %s", OpReply, h.OpCode)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, nil, &unexpectedReplyOpCodeError{Expected: OpReply, OpCode: h.OpCode}
 	}
 
 	var prefix replyPrefix
 	if _, err := io.ReadFull(server, prefix[:]); err != nil {
 		r.Log.Error(err)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, nil, err
 	}
 
 	numDocs := getInt32(prefix[:], 16)
 	if numDocs != 1 {
 		err := fmt.Errorf("readOneReplyDoc: can only handle 1 result document, got: %d", numDocs)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, nil, err
 	}
 
 	rawDoc, err := readDocument(server)
 	if err != nil {
 		r.Log.Error(err)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, nil, err
 	}
 
 	if err := bson.Unmarshal(rawDoc, v); err != nil {
 		r.Log.Error(err)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, nil, err
 	}
 
-	return h, prefix, int32(len(rawDoc)), nil
+	return h, prefix, rawDoc, nil
 }
 
 // WriteOne writes a rewritten response to the client.
@@ -317,18 +1198,188 @@ func (r *ReplyRW) WriteOne(client io.Writer, h *messageHeader, prefix replyPrefi
 	if err != nil {
 		return err
 	}
+	return r.writeDoc(client, h, prefix, oldDocLen, newDoc)
+}
+
+// writeOneOrOriginal writes a rewritten response to the client. If the
+// rewritten document can't be marshaled, the original document is written
+// instead since the server reply itself was fine.
+func (r *ReplyRW) writeOneOrOriginal(client io.Writer, h *messageHeader, prefix replyPrefix, rawDoc []byte, v interface{}) error {
+	newDoc, err := bson.Marshal(v)
+	if err != nil {
+		r.Log.Errorf("proxying original reply since the rewritten one failed to marshal: %s", err)
+		newDoc = rawDoc
+	}
+	return r.writeDoc(client, h, prefix, int32(len(rawDoc)), newDoc)
+}
 
+// writeDoc writes the response with the given document replacing the one of
+// length oldDocLen.
+func (r *ReplyRW) writeDoc(client io.Writer, h *messageHeader, prefix replyPrefix, oldDocLen int32, newDoc []byte) error {
+	var err error
 	h.MessageLength = h.MessageLength - oldDocLen + int32(len(newDoc))
 	parts := [][]byte{h.ToWire(), prefix[:], newDoc}
-	for _, p := range parts {
-		if _, err := client.Write(p); err != nil {
+	if h.compressed {
+		body := append(prefix[:], newDoc...)
+		if parts, err = compressMessage(h, body); err != nil {
 			return err
 		}
 	}
 
+	// A *net.TCPConn writes all the parts with a single writev, other writers
+	// get a Write per part.
+	buffers := net.Buffers(parts)
+	if _, err := buffers.WriteTo(client); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// replyFlagQueryFailure is set in an OP_REPLY when the query failed and the
+// single returned document contains the error.
+const replyFlagQueryFailure = 2
+
+// Error codes used in the error replies generated by the proxy.
+const (
+	errCodeUnauthorized       = 13
+	errCodeShutdownInProgress = 91
+	errCodeObjectTooLarge     = 10334
+)
+
+// writeErrorReply writes an OP_REPLY in response to the given request
+// containing the given error. The document has the command error fields as
+// well as $err, which drivers check for failed queries.
+func writeErrorReply(w io.Writer, responseTo int32, code int, msg string) error {
+	doc, err := bson.Marshal(bson.D{
+		{Name: "$err", Value: msg},
+		{Name: "errmsg", Value: msg},
+		{Name: "code", Value: code},
+		{Name: "ok", Value: 0},
+	})
+	if err != nil {
+		return err
+	}
+
+	var prefix replyPrefix
+	setInt32(prefix[:], 0, replyFlagQueryFailure)
+	setInt32(prefix[:], 16, 1) // numberReturned
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(prefix) + len(doc)),
+		ResponseTo:    responseTo,
+		OpCode:        OpReply,
+	}
+	parts := [][]byte{h.ToWire(), prefix[:], doc}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// writeMsgErrorReply writes an OpMsg in response to the given request
+// containing the given command error.
+func writeMsgErrorReply(w io.Writer, responseTo int32, code int, msg string) error {
+	doc, err := bson.Marshal(bson.D{
+		{Name: "errmsg", Value: msg},
+		{Name: "code", Value: code},
+		{Name: "ok", Value: 0},
+	})
+	if err != nil {
+		return err
+	}
+	m := opMsg{Sections: []opMsgSection{{Kind: opMsgSectionBody, Documents: [][]byte{doc}}}}
+	_, err = w.Write(m.Marshal(&messageHeader{ResponseTo: responseTo}))
+	return err
+}
+
+// writeKillCursorsMsg writes a killCursors command for the cursor on the
+// namespace "db.collection" as an OpMsg.
+func writeKillCursorsMsg(w io.Writer, ns string, cursorID int64) error {
+	db, collection := ns, ""
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		db, collection = ns[:i], ns[i+1:]
+	}
+	doc, err := bson.Marshal(bson.D{
+		{Name: "killCursors", Value: collection},
+		{Name: "cursors", Value: []int64{cursorID}},
+		{Name: "$db", Value: db},
+	})
+	if err != nil {
+		return err
+	}
+	m := opMsg{Sections: []opMsgSection{{Kind: opMsgSectionBody, Documents: [][]byte{doc}}}}
+	_, err = w.Write(m.Marshal(&messageHeader{}))
+	return err
+}
+
+// limitCursorBatch returns the find or getMore reply document with the batch
+// truncated to maxDocs documents and maxBytes of documents, zero meaning no
+// limit, and the cursor ID cleared so the client doesn't ask for more. It
+// returns nil if the batch is within the limits. Otherwise the ID and
+// namespace of the cursor left open on the server are returned too.
+func limitCursorBatch(doc []byte, maxDocs, maxBytes int) ([]byte, int64, string, error) {
+	var reply bson.RawD
+	if err := bson.Unmarshal(doc, &reply); err != nil {
+		return nil, 0, "", err
+	}
+	truncated := false
+	var cursorID int64
+	var ns string
+	out := make(bson.D, 0, len(reply))
+	for _, e := range reply {
+		if e.Name != "cursor" {
+			out = append(out, bson.DocElem{Name: e.Name, Value: e.Value})
+			continue
+		}
+		var cursor bson.RawD
+		if err := e.Value.Unmarshal(&cursor); err != nil {
+			return nil, 0, "", err
+		}
+		newCursor := make(bson.D, 0, len(cursor))
+		for _, ce := range cursor {
+			var v interface{} = ce.Value
+			switch ce.Name {
+			case "firstBatch", "nextBatch":
+				var batch []bson.Raw
+				if err := ce.Value.Unmarshal(&batch); err != nil {
+					return nil, 0, "", err
+				}
+				keptLen := 0
+				for i, d := range batch {
+					if (maxDocs != 0 && i >= maxDocs) ||
+						(maxBytes != 0 && keptLen+len(d.Data) > maxBytes) {
+						v = batch[:i]
+						truncated = true
+						break
+					}
+					keptLen += len(d.Data)
+				}
+			case "id":
+				if err := ce.Value.Unmarshal(&cursorID); err != nil {
+					return nil, 0, "", err
+				}
+				v = int64(0)
+			case "ns":
+				if err := ce.Value.Unmarshal(&ns); err != nil {
+					return nil, 0, "", err
+				}
+			}
+			newCursor = append(newCursor, bson.DocElem{Name: ce.Name, Value: v})
+		}
+		out = append(out, bson.DocElem{Name: e.Name, Value: newCursor})
+	}
+	if !truncated {
+		return nil, 0, "", nil
+	}
+	newDoc, err := bson.Marshal(out)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return newDoc, cursorID, ns, nil
+}
+
 type isMasterResponse struct {
 	Hosts   []string `bson:"hosts,omitempty"`
 	Primary string   `bson:"primary,omitempty"`
@@ -336,24 +1387,85 @@ type isMasterResponse struct {
 	Extra   bson.M   `bson:",inline"`
 }
 
-// IsMasterResponseRewriter rewrites the response for the "isMaster" query.
+// IsMasterResponseRewriter rewrites the response for the "isMaster" query,
+// and the equivalent "hello".
 type IsMasterResponseRewriter struct {
 	Log                 Logger              `inject:""`
 	ProxyMapper         ProxyMapper         `inject:""`
 	ReplyRW             *ReplyRW            `inject:""`
 	ReplicaStateCompare ReplicaStateCompare `inject:""`
+	Stats               stats.Client        `inject:""`
 }
 
 // Rewrite rewrites the response for the "isMaster" query.
 func (r *IsMasterResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
 	var err error
 	var q isMasterResponse
-	h, prefix, docLen, err := r.ReplyRW.ReadOne(server, &q)
+	h, prefix, rawDoc, err := r.ReplyRW.ReadOne(server, &q)
 	if err != nil {
 		return err
 	}
-	if !r.ReplicaStateCompare.SameIM(&q) {
-		return errRSChanged
+	d, electing, err := r.rewrite(&q, rawDoc)
+	if err != nil {
+		return err
+	}
+	if err := r.ReplyRW.writeOneOrOriginal(client, h, prefix, rawDoc, d); err != nil {
+		return err
+	}
+	if electing {
+		return errPrimaryUnmappable
+	}
+	return nil
+}
+
+// RewriteMsg rewrites the OpMsg response for the "isMaster" command.
+func (r *IsMasterResponseRewriter) RewriteMsg(client io.Writer, server io.Reader) error {
+	h, m, err := readOpMsgReply(server)
+	if err != nil {
+		r.Log.Error(err)
+		return err
+	}
+	rawDoc := m.Body()
+	var q isMasterResponse
+	if err := bson.Unmarshal(rawDoc, &q); err != nil {
+		r.Log.Error(err)
+		return err
+	}
+	d, electing, err := r.rewrite(&q, rawDoc)
+	if err != nil {
+		return err
+	}
+	newDoc, err := bson.Marshal(d)
+	if err != nil {
+		r.Log.Errorf("proxying original reply since the rewritten one failed to marshal: %s", err)
+		newDoc = rawDoc
+	}
+	m.SetBody(newDoc)
+	if err := writeOpMsg(client, h, m); err != nil {
+		return err
+	}
+	if electing {
+		return errPrimaryUnmappable
+	}
+	return nil
+}
+
+// rewrite returns the isMaster reply document with the members mapped to
+// their proxies. It returns true if an election is in progress, in which case
+// the primary was omitted since it isn't proxied yet.
+func (r *IsMasterResponseRewriter) rewrite(q *isMasterResponse, rawDoc []byte) (bson.D, bool, error) {
+	// A changed primary that can't be mapped is one elected since the replica
+	// set was discovered. The reply is still relayed during the election, any
+	// other change fails it.
+	electing := false
+	if !r.ReplicaStateCompare.SameIM(q) {
+		if q.Primary == "" {
+			return nil, false, errRSChanged
+		}
+		if _, err := r.ProxyMapper.Proxy(q.Primary); err == nil {
+			return nil, false, errRSChanged
+		}
+		electing = true
 	}
 
 	var newHosts []string
@@ -367,25 +1479,76 @@ func (r *IsMasterResponseRewriter) Rewrite(client io.Writer, server io.Reader) e
 				continue
 			}
 			// unknown err
-			return err
+			return nil, false, err
 		}
 		newHosts = append(newHosts, newH)
 	}
 	q.Hosts = newHosts
 
 	if q.Primary != "" {
-		// failure in mapping the primary is fatal
-		if q.Primary, err = r.ProxyMapper.Proxy(q.Primary); err != nil {
-			return err
+		primary, err := r.ProxyMapper.Proxy(q.Primary)
+		if err != nil {
+			// failure in mapping the primary is fatal while the topology is
+			// unchanged
+			if !electing {
+				return nil, false, err
+			}
+			// Omit the primary so the driver polls again.
+			r.Log.Warnf("omitting primary %s during an election: %s", q.Primary, err)
+			stats.BumpSum(r.Stats, "mongoproxy.primary.unmappable", 1)
 		}
+		q.Primary = primary
 	}
 	if q.Me != "" {
-		// failure in mapping me is fatal
-		if q.Me, err = r.ProxyMapper.Proxy(q.Me); err != nil {
-			return err
+		me, err := r.ProxyMapper.Proxy(q.Me)
+		if err != nil {
+			// A member we intentionally aren't proxying to has no proxy address to
+			// report, so omit it rather than failing the client.
+			pme, ok := err.(*ProxyMapperError)
+			if !ok {
+				// failure in mapping an unknown me is fatal
+				return nil, false, err
+			}
+			r.Log.Warnf("omitting me %s in state %s", q.Me, pme.State)
 		}
+		q.Me = me
 	}
-	return r.ReplyRW.WriteOne(client, h, prefix, docLen, q)
+
+	// Some legacy drivers depend on the order of the fields, so the rewritten
+	// members replace the originals in place.
+	var d bson.D
+	if err := bson.Unmarshal(rawDoc, &d); err != nil {
+		return nil, false, err
+	}
+	return withIMMembers(d, q), electing, nil
+}
+
+// withIMMembers returns the isMaster reply with the hosts, primary and me
+// fields replaced by those in q, keeping the order of the fields. Fields empty
+// in q are removed.
+func withIMMembers(d bson.D, q *isMasterResponse) bson.D {
+	out := d[:0]
+	for _, e := range d {
+		switch e.Name {
+		case "hosts":
+			if len(q.Hosts) == 0 {
+				continue
+			}
+			e.Value = q.Hosts
+		case "primary":
+			if q.Primary == "" {
+				continue
+			}
+			e.Value = q.Primary
+		case "me":
+			if q.Me == "" {
+				continue
+			}
+			e.Value = q.Me
+		}
+		out = append(out, e)
+	}
+	return out
 }
 
 type statusMember struct {
@@ -393,6 +1556,68 @@ type statusMember struct {
 	State ReplicaState `bson:"stateStr,omitempty"`
 	Self  bool         `bson:"self,omitempty"`
 	Extra bson.M       `bson:",inline"`
+
+	// StateCode is the numeric state. Some replies only have this, in which
+	// case State is derived from it.
+	StateCode *int `bson:"state,omitempty"`
+
+	// Config is the replica set configuration for the member, if available. It
+	// is not part of the replSetGetStatus response.
+	Config *memberConfig `bson:"-"`
+
+	// stateFromCode is true if State was derived from StateCode, and so is
+	// left out when the member is marshaled again.
+	stateFromCode bool
+}
+
+// rawStatusMember has the fields of a statusMember, without its methods.
+type rawStatusMember statusMember
+
+// SetBSON unmarshals the member, deriving the State from the StateCode if the
+// stateStr is missing.
+func (m *statusMember) SetBSON(raw bson.Raw) error {
+	var rm rawStatusMember
+	if err := raw.Unmarshal(&rm); err != nil {
+		return err
+	}
+	*m = statusMember(rm)
+	if m.State == "" && m.StateCode != nil {
+		m.State = replicaStateFromCode(*m.StateCode)
+		m.stateFromCode = true
+	}
+	return nil
+}
+
+// GetBSON marshals the member as it was unmarshaled.
+func (m statusMember) GetBSON() (interface{}, error) {
+	if m.stateFromCode {
+		m.State = ""
+	}
+	return rawStatusMember(m), nil
+}
+
+// IsVotingMember returns false if the member is configured to not vote.
+func (m *statusMember) IsVotingMember() bool {
+	return m.Config == nil || m.Config.Votes == nil || *m.Config.Votes > 0
+}
+
+// IsDelayed returns true if the member is configured as a delayed secondary.
+func (m *statusMember) IsDelayed() bool {
+	return m.Config != nil && m.Config.SlaveDelay > 0
+}
+
+// memberConfig is a member entry from the replica set configuration.
+type memberConfig struct {
+	Host       string   `bson:"host"`
+	Votes      *int     `bson:"votes"`
+	Priority   *float64 `bson:"priority"`
+	SlaveDelay int64    `bson:"slaveDelay"` // in seconds
+}
+
+type replSetGetConfigResponse struct {
+	Config struct {
+		Members []memberConfig `bson:"members"`
+	} `bson:"config"`
 }
 
 type replSetGetStatusResponse struct {
@@ -413,7 +1638,7 @@ type ReplSetGetStatusResponseRewriter struct {
 func (r *ReplSetGetStatusResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
 	var err error
 	var q replSetGetStatusResponse
-	h, prefix, docLen, err := r.ReplyRW.ReadOne(server, &q)
+	h, prefix, rawDoc, err := r.ReplyRW.ReadOne(server, &q)
 	if err != nil {
 		return err
 	}
@@ -438,7 +1663,82 @@ func (r *ReplSetGetStatusResponseRewriter) Rewrite(client io.Writer, server io.R
 		newMembers = append(newMembers, m)
 	}
 	q.Members = newMembers
-	return r.ReplyRW.WriteOne(client, h, prefix, docLen, q)
+	return r.ReplyRW.writeOneOrOriginal(client, h, prefix, rawDoc, q)
+}
+
+type buildInfoResponse struct {
+	Version      string `bson:"version"`
+	VersionArray []int  `bson:"versionArray"`
+	Extra        bson.M `bson:",inline"`
+}
+
+// BuildInfoResponseRewriter rewrites the "buildInfo" response to report a
+// different version. This is useful for drivers that refuse to talk to newer
+// servers than they know about.
+type BuildInfoResponseRewriter struct {
+	Log     Logger   `inject:""`
+	ReplyRW *ReplyRW `inject:""`
+
+	// BuildInfoOverride is the version that will be reported, for example
+	// "2.6.5". If empty buildInfo responses are proxied unmodified.
+	BuildInfoOverride string
+
+	versionArray []int
+}
+
+// Start validates the BuildInfoOverride.
+func (r *BuildInfoResponseRewriter) Start() error {
+	if r.BuildInfoOverride == "" {
+		return nil
+	}
+	versionArray, err := parseVersionArray(r.BuildInfoOverride)
+	if err != nil {
+		return fmt.Errorf("dvara: BuildInfoOverride: %s", err)
+	}
+	r.versionArray = versionArray
+	return nil
+}
+
+// Rewrite rewrites the "buildInfo" response.
+func (r *BuildInfoResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
+	var q buildInfoResponse
+	h, prefix, rawDoc, err := r.ReplyRW.ReadOne(server, &q)
+	if err != nil {
+		return err
+	}
+	q.Version = r.BuildInfoOverride
+	q.VersionArray = r.versionArray
+	return r.ReplyRW.writeOneOrOriginal(client, h, prefix, rawDoc, q)
+}
+
+// parseVersionArray converts a version like "2.6.5" into the 4 element
+// versionArray mongo reports, [2, 6, 5, 0] in this case.
+func parseVersionArray(v string) ([]int, error) {
+	parts := strings.Split(v, ".")
+	if len(parts) > 4 {
+		return nil, fmt.Errorf("invalid version %q", v)
+	}
+	versionArray := make([]int, 4)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %s", v, err)
+		}
+		versionArray[i] = n
+	}
+	return versionArray, nil
+}
+
+// withoutKey returns a copy of d without the key k, matched case
+// insensitively like hasKey.
+func withoutKey(d bson.D, k string) bson.D {
+	out := make(bson.D, 0, len(d))
+	for _, v := range d {
+		if !strings.EqualFold(v.Name, k) {
+			out = append(out, v)
+		}
+	}
+	return out
 }
 
 // case insensitive check for the specified key name in the top level.
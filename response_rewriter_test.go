@@ -3,15 +3,22 @@ package dvara
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/facebookgo/ensure"
 	"github.com/facebookgo/inject"
 	"github.com/facebookgo/startstop"
+	"github.com/facebookgo/stats"
 
 	"gopkg.in/mgo.v2/bson"
 )
@@ -27,7 +34,8 @@ func (i invalidBSON) GetBSON() (interface{}, error) {
 var errProxyNotFound = errors.New("proxy not found")
 
 type fakeProxyMapper struct {
-	m map[string]string
+	m       map[string]string
+	ignored map[string]ReplicaState
 }
 
 func (t fakeProxyMapper) Proxy(h string) (string, error) {
@@ -36,6 +44,9 @@ func (t fakeProxyMapper) Proxy(h string) (string, error) {
 			return r, nil
 		}
 	}
+	if s, ok := t.ignored[h]; ok {
+		return "", &ProxyMapperError{RealHost: h, State: s}
+	}
 	return "", errProxyNotFound
 }
 
@@ -157,6 +168,20 @@ func TestResponseRWReadOne(t *testing.T) {
 	}
 }
 
+func TestResponseRWReadOneRawDoc(t *testing.T) {
+	t.Parallel()
+	doc := bson.D{{Name: "ok", Value: 1}, {Name: "msg", Value: "hello"}}
+	expected, err := bson.Marshal(doc)
+	ensure.Nil(t, err)
+	r := &ReplyRW{Log: &tLogger{TB: t}}
+	var q bson.M
+	_, _, rawDoc, err := r.ReadOne(fakeSingleDocReply(doc), &q)
+	ensure.Nil(t, err)
+	if !bytes.Equal(rawDoc, expected) {
+		t.Fatalf("expected raw doc %v got %v", expected, rawDoc)
+	}
+}
+
 func TestResponseRWWriteOne(t *testing.T) {
 	errWrite := errors.New("write error")
 	t.Parallel()
@@ -198,6 +223,22 @@ func TestResponseRWWriteOne(t *testing.T) {
 	}
 }
 
+func TestResponseRWWriteOneFallsBackToOriginal(t *testing.T) {
+	t.Parallel()
+	original, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	r := &ReplyRW{Log: &tLogger{TB: t}}
+	var q bson.M
+	h, prefix, rawDoc, err := r.ReadOne(bytes.NewReader(original), &q)
+	ensure.Nil(t, err)
+	var client bytes.Buffer
+	err = r.writeOneOrOriginal(&client, h, prefix, rawDoc, invalidBSON(0))
+	ensure.Nil(t, err)
+	if !bytes.Equal(client.Bytes(), original) {
+		t.Fatalf("expected original reply %v got %v", original, client.Bytes())
+	}
+}
+
 func TestIsMasterResponseRewriterFailures(t *testing.T) {
 	t.Parallel()
 	cases := []struct {
@@ -319,6 +360,370 @@ func TestIsMasterResponseRewriterSuccess(t *testing.T) {
 	}
 }
 
+func BenchmarkIsMasterResponseRewriter(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(b, err)
+	defer listener.Close()
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, c)
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	ensure.Nil(b, err)
+	defer client.Close()
+
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{
+		"hosts":   []interface{}{"a", "b", "c"},
+		"me":      "a",
+		"primary": "b",
+	}))
+	ensure.Nil(b, err)
+	r := &IsMasterResponseRewriter{
+		Log: &tLogger{TB: b},
+		ProxyMapper: fakeProxyMapper{
+			m: map[string]string{"a": "1", "b": "2", "c": "3"},
+		},
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW:             &ReplyRW{Log: &tLogger{TB: b}},
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.Rewrite(client, bytes.NewReader(reply)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func fakeCompressedSingleDocReply(v interface{}) io.Reader {
+	var uncompressed bytes.Buffer
+	if _, err := uncompressed.ReadFrom(fakeSingleDocReply(v)); err != nil {
+		panic(err)
+	}
+	var h messageHeader
+	h.FromWire(uncompressed.Bytes())
+	h.compressorID = compressorZlib
+	parts, err := compressMessage(&h, uncompressed.Bytes()[headerLen:])
+	if err != nil {
+		panic(err)
+	}
+	return bytes.NewReader(bytes.Join(parts, nil))
+}
+
+func TestIsMasterResponseRewriterCompressed(t *testing.T) {
+	t.Parallel()
+	proxyMapper := fakeProxyMapper{
+		m: map[string]string{
+			"a": "1",
+			"b": "2",
+		},
+	}
+	in := bson.M{
+		"hosts":   []interface{}{"a", "b"},
+		"primary": "a",
+	}
+	out := bson.M{
+		"hosts":   []interface{}{"1", "2"},
+		"primary": "1",
+	}
+	replyRW := &ReplyRW{Log: &tLogger{TB: t}}
+	r := &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		ProxyMapper:         proxyMapper,
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW:             replyRW,
+	}
+
+	var client bytes.Buffer
+	if err := r.Rewrite(&client, fakeCompressedSingleDocReply(in)); err != nil {
+		t.Fatal(err)
+	}
+	h, err := readHeader(bytes.NewReader(client.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != OpCompressed || int(h.MessageLength) != client.Len() {
+		t.Fatalf("unexpected header %s for %d bytes", h, client.Len())
+	}
+
+	actualOut := bson.M{}
+	rh, _, _, err := replyRW.ReadOne(&client, &actualOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rh.compressed || rh.compressorID != compressorZlib {
+		t.Fatal("expected zlib compressed reply")
+	}
+	if !reflect.DeepEqual(out, actualOut) {
+		spew.Dump(out)
+		spew.Dump(actualOut)
+		t.Fatal("did not get expected output")
+	}
+}
+
+// TestRewrittenReplyFraming validates the full byte structure of rewritten
+// replies, to ensure rewriters keep the framing drivers expect for these
+// single document command replies.
+func TestRewrittenReplyFraming(t *testing.T) {
+	t.Parallel()
+	proxyMapper := fakeProxyMapper{m: map[string]string{"a": "1"}}
+	replyRW := &ReplyRW{Log: &tLogger{TB: t}}
+	compare := fakeReplicaStateCompare{sameIM: true, sameRS: true}
+	cases := []struct {
+		Name     string
+		Rewriter responseRewriter
+		In       bson.M
+	}{
+		{
+			Name: "isMaster",
+			Rewriter: &IsMasterResponseRewriter{
+				Log:                 &tLogger{TB: t},
+				ProxyMapper:         proxyMapper,
+				ReplicaStateCompare: compare,
+				ReplyRW:             replyRW,
+			},
+			In: bson.M{"hosts": []interface{}{"a"}, "ismaster": true, "ok": 1.0},
+		},
+		{
+			Name: "replSetGetStatus",
+			Rewriter: &ReplSetGetStatusResponseRewriter{
+				Log:                 &tLogger{TB: t},
+				ProxyMapper:         proxyMapper,
+				ReplicaStateCompare: compare,
+				ReplyRW:             replyRW,
+			},
+			In: bson.M{"members": []interface{}{bson.M{"name": "a"}}, "ok": 1.0},
+		},
+	}
+
+	for _, c := range cases {
+		doc, err := bson.Marshal(c.In)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var in bytes.Buffer
+		inHeader := messageHeader{
+			MessageLength: int32(headerLen + len(emptyPrefix) + len(doc)),
+			RequestID:     7,
+			ResponseTo:    42,
+			OpCode:        OpReply,
+		}
+		in.Write(inHeader.ToWire())
+		in.Write([]byte{
+			8, 0, 0, 0, // responseFlags: AwaitCapable
+			0, 0, 0, 0, 0, 0, 0, 0, // cursorID
+			0, 0, 0, 0, // startingFrom
+			1, 0, 0, 0, // numberReturned
+		})
+		in.Write(doc)
+
+		var client bytes.Buffer
+		if err := c.Rewriter.Rewrite(&client, &in); err != nil {
+			t.Fatalf("unexpected error for case %s: %s", c.Name, err)
+		}
+		out := client.Bytes()
+
+		var h messageHeader
+		h.FromWire(out)
+		if int(h.MessageLength) != len(out) {
+			t.Fatalf("case %s: header length %d but reply is %d bytes", c.Name, h.MessageLength, len(out))
+		}
+		if h.OpCode != OpReply || h.RequestID != 7 || h.ResponseTo != 42 {
+			t.Fatalf("case %s: unexpected header %s", c.Name, &h)
+		}
+		prefix := out[headerLen : headerLen+len(emptyPrefix)]
+		if flags := getInt32(prefix, 0); flags != 8 {
+			t.Fatalf("case %s: expected flags 8 got %d", c.Name, flags)
+		}
+		if cursorID := prefix[4:12]; !bytes.Equal(cursorID, make([]byte, 8)) {
+			t.Fatalf("case %s: expected no cursor got %v", c.Name, cursorID)
+		}
+		if startingFrom := getInt32(prefix, 12); startingFrom != 0 {
+			t.Fatalf("case %s: expected startingFrom 0 got %d", c.Name, startingFrom)
+		}
+		if numberReturned := getInt32(prefix, 16); numberReturned != 1 {
+			t.Fatalf("case %s: expected 1 document got %d", c.Name, numberReturned)
+		}
+		rest := out[headerLen+len(emptyPrefix):]
+		if docLen := getInt32(rest, 0); int(docLen) != len(rest) {
+			t.Fatalf("case %s: document length %d but %d bytes remain", c.Name, docLen, len(rest))
+		}
+		var actual bson.M
+		if err := bson.Unmarshal(rest, &actual); err != nil {
+			t.Fatalf("case %s: %s", c.Name, err)
+		}
+	}
+}
+
+func TestIsMasterResponseRewriterStaticProxyMapper(t *testing.T) {
+	t.Parallel()
+	in := bson.M{
+		"hosts":   []interface{}{"a:27017", "b:27017"},
+		"primary": "a:27017",
+	}
+	out := bson.M{
+		"hosts":   []interface{}{"lb-a:6000", "lb-b:6000"},
+		"primary": "lb-a:6000",
+	}
+	r := &IsMasterResponseRewriter{
+		Log: &tLogger{TB: t},
+		ProxyMapper: StaticProxyMapper{
+			"a:27017": "lb-a:6000",
+			"b:27017": "lb-b:6000",
+		},
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW: &ReplyRW{
+			Log: &tLogger{TB: t},
+		},
+	}
+
+	var client bytes.Buffer
+	if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+		t.Fatal(err)
+	}
+	actualOut := bson.M{}
+	doc := client.Bytes()[headerLen+len(emptyPrefix):]
+	if err := bson.Unmarshal(doc, &actualOut); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, actualOut) {
+		spew.Dump(out)
+		spew.Dump(actualOut)
+		t.Fatal("did not get expected output")
+	}
+
+	err := r.Rewrite(&client, fakeSingleDocReply(bson.M{"me": "c:27017"}))
+	const expected = "mongo c:27017 is not in StaticProxyMapper"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("did not get expected error, got: %s", err)
+	}
+}
+
+func TestIsMasterResponseRewriterUnmappablePrimary(t *testing.T) {
+	t.Parallel()
+	proxyMapper := fakeProxyMapper{
+		m: map[string]string{
+			"a": "1",
+		},
+		ignored: map[string]ReplicaState{
+			"b": ReplicaState("RECOVERING"),
+		},
+	}
+	out := bson.M{
+		"hosts": []interface{}{"1"},
+	}
+	// During an election the ignored b and the unknown c are both omitted.
+	for _, primary := range []string{"b", "c"} {
+		in := bson.M{
+			"hosts":   []interface{}{"a", "b"},
+			"primary": primary,
+		}
+		var unmappable float64
+		r := &IsMasterResponseRewriter{
+			Log:                 &tLogger{TB: t},
+			ProxyMapper:         proxyMapper,
+			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: false, sameRS: true},
+			ReplyRW: &ReplyRW{
+				Log: &tLogger{TB: t},
+			},
+			Stats: &stats.HookClient{
+				BumpSumHook: func(key string, val float64) {
+					if key == "mongoproxy.primary.unmappable" {
+						unmappable += val
+					}
+				},
+			},
+		}
+
+		var client bytes.Buffer
+		if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != errPrimaryUnmappable {
+			t.Fatalf("primary %s: expected %s got %v", primary, errPrimaryUnmappable, err)
+		}
+		actualOut := bson.M{}
+		doc := client.Bytes()[headerLen+len(emptyPrefix):]
+		if err := bson.Unmarshal(doc, &actualOut); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, actualOut) {
+			spew.Dump(out)
+			spew.Dump(actualOut)
+			t.Fatalf("primary %s: did not get expected output", primary)
+		}
+		if unmappable != 1 {
+			t.Fatalf("primary %s: expected 1 unmappable primary got %v", primary, unmappable)
+		}
+
+		// With the topology unchanged it's an error.
+		r.ReplicaStateCompare = fakeReplicaStateCompare{sameIM: true, sameRS: true}
+		client.Reset()
+		if err := r.Rewrite(&client, fakeSingleDocReply(in)); err == nil {
+			t.Fatalf("primary %s: expected an error with the topology unchanged", primary)
+		}
+		if client.Len() != 0 {
+			t.Fatalf("primary %s: expected no reply got %v", primary, client.Bytes())
+		}
+	}
+
+	// A changed primary that is proxied still means the replica set changed.
+	r := &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		ProxyMapper:         proxyMapper,
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: false, sameRS: true},
+		ReplyRW:             &ReplyRW{Log: &tLogger{TB: t}},
+	}
+	in := bson.M{"hosts": []interface{}{"a", "b"}, "primary": "a"}
+	if err := r.Rewrite(ioutil.Discard, fakeSingleDocReply(in)); err != errRSChanged {
+		t.Fatalf("expected %s got %v", errRSChanged, err)
+	}
+}
+
+func TestIsMasterResponseRewriterIgnoredArbiter(t *testing.T) {
+	t.Parallel()
+	proxyMapper := fakeProxyMapper{
+		m: map[string]string{
+			"a": "1",
+		},
+		ignored: map[string]ReplicaState{
+			"b": ReplicaStateArbiter,
+		},
+	}
+	in := bson.M{
+		"hosts":   []interface{}{"a", "b"},
+		"primary": "a",
+		"me":      "b",
+	}
+	out := bson.M{
+		"hosts":   []interface{}{"1"},
+		"primary": "1",
+	}
+	r := &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		ProxyMapper:         proxyMapper,
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW: &ReplyRW{
+			Log: &tLogger{TB: t},
+		},
+	}
+
+	var client bytes.Buffer
+	if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+		t.Fatal(err)
+	}
+	actualOut := bson.M{}
+	doc := client.Bytes()[headerLen+len(emptyPrefix):]
+	if err := bson.Unmarshal(doc, &actualOut); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, actualOut) {
+		spew.Dump(out)
+		spew.Dump(actualOut)
+		t.Fatal("did not get expected output")
+	}
+}
+
 func TestReplSetGetStatusResponseRewriterFailures(t *testing.T) {
 	t.Parallel()
 	cases := []struct {
@@ -440,36 +845,618 @@ func TestReplSetGetStatusResponseRewriterSuccess(t *testing.T) {
 	}
 }
 
-func TestProxyQuery(t *testing.T) {
+func TestBuildInfoResponseRewriter(t *testing.T) {
 	t.Parallel()
-	var p ProxyQuery
-	log := tLogger{TB: t}
-	var graph inject.Graph
-	err := graph.Provide(
-		&inject.Object{Value: &fakeProxyMapper{}},
-		&inject.Object{Value: &fakeReplicaStateCompare{}},
-		&inject.Object{Value: &log},
-		&inject.Object{Value: &p},
-	)
-	ensure.Nil(t, err)
-	ensure.Nil(t, graph.Populate())
-	objects := graph.Objects()
-	ensure.Nil(t, startstop.Start(objects, &log))
-	defer startstop.Stop(objects, &log)
+	in := bson.M{
+		"version":      "3.0.4",
+		"versionArray": []interface{}{3, 0, 4, 0},
+		"ok":           1.0,
+	}
+	out := bson.M{
+		"version":      "2.6.5",
+		"versionArray": []interface{}{2, 6, 5, 0},
+		"ok":           1.0,
+	}
+	r := &BuildInfoResponseRewriter{
+		Log:               &tLogger{TB: t},
+		ReplyRW:           &ReplyRW{Log: &tLogger{TB: t}},
+		BuildInfoOverride: "2.6.5",
+	}
+	ensure.Nil(t, r.Start())
 
+	var client bytes.Buffer
+	if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+		t.Fatal(err)
+	}
+	actualOut := bson.M{}
+	doc := client.Bytes()[headerLen+len(emptyPrefix):]
+	if err := bson.Unmarshal(doc, &actualOut); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, actualOut) {
+		spew.Dump(out)
+		spew.Dump(actualOut)
+		t.Fatal("did not get expected output")
+	}
+}
+
+func TestBuildInfoResponseRewriterStartInvalidOverride(t *testing.T) {
+	t.Parallel()
+	r := &BuildInfoResponseRewriter{BuildInfoOverride: "2.6.x"}
+	const expected = `dvara: BuildInfoOverride: invalid version "2.6.x"`
+	if err := r.Start(); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Fatalf("did not get expected error, got: %s", err)
+	}
+	ensure.Nil(t, (&BuildInfoResponseRewriter{}).Start())
+}
+
+func TestParseVersionArray(t *testing.T) {
+	t.Parallel()
 	cases := []struct {
-		Name   string
-		Header *messageHeader
-		Client io.ReadWriter
-		Error  string
+		Version      string
+		VersionArray []int
+		Error        string
 	}{
-		{
-			Name:   "EOF while reading flags from client",
-			Header: &messageHeader{},
-			Client: new(bytes.Buffer),
-			Error:  "EOF",
-		},
-		{
+		{Version: "2.6.5", VersionArray: []int{2, 6, 5, 0}},
+		{Version: "3", VersionArray: []int{3, 0, 0, 0}},
+		{Version: "1.2.3.4.5", Error: `invalid version "1.2.3.4.5"`},
+		{Version: "2.6.x", Error: `invalid version "2.6.x"`},
+		{Version: "", Error: `invalid version ""`},
+	}
+	for _, c := range cases {
+		versionArray, err := parseVersionArray(c.Version)
+		if c.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), c.Error) {
+				t.Fatalf("did not get expected error for %q instead got %s", c.Version, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(versionArray, c.VersionArray) {
+			t.Fatalf("expected %v got %v", c.VersionArray, versionArray)
+		}
+	}
+}
+
+func TestGetLastErrorRewriterShortResponse(t *testing.T) {
+	t.Parallel()
+	r := &GetLastErrorRewriter{Log: &tLogger{TB: t}}
+	h := &messageHeader{OpCode: OpQuery, MessageLength: headerLen}
+	server := fakeReadWriter{
+		Reader: bytes.NewReader((messageHeader{OpCode: OpReply, MessageLength: 4}).ToWire()),
+		Writer: ioutil.Discard,
+	}
+	var client bytes.Buffer
+	var lastError LastError
+	err := r.Rewrite(h, [][]byte{h.ToWire()}, &client, server, &lastError)
+	const expected = "getLastError: invalid response message length 4"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("did not get expected error, got: %s", err)
+	}
+	if lastError.Exists() {
+		t.Fatal("malformed response was cached")
+	}
+	if client.Len() != 0 {
+		t.Fatalf("unexpected response sent to client: %v", client.Bytes())
+	}
+}
+
+// fakeQuery returns an OpQuery message for the given collection and query.
+func fakeQuery(collection string, q interface{}) (*messageHeader, io.Reader) {
+	doc, err := bson.Marshal(q)
+	if err != nil {
+		panic(err)
+	}
+	var body bytes.Buffer
+	body.Write([]byte{0, 0, 0, 0}) // flags
+	body.WriteString(collection)
+	body.WriteByte(0)
+	body.Write([]byte{0, 0, 0, 0, 1, 0, 0, 0}) // skip & return
+	body.Write(doc)
+	h := &messageHeader{
+		MessageLength: int32(headerLen + body.Len()),
+		RequestID:     42,
+		OpCode:        OpQuery,
+	}
+	return h, &body
+}
+
+// assertErrorReply asserts the reply is an error for the given request.
+func assertErrorReply(t testing.TB, reply io.Reader, requestID int32, msg string) {
+	r := &ReplyRW{Log: &tLogger{TB: t}}
+	var doc bson.M
+	h, prefix, _, err := r.ReadOne(reply, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ResponseTo != requestID {
+		t.Fatalf("expected response to %d got %d", requestID, h.ResponseTo)
+	}
+	if getInt32(prefix[:], 0)&replyFlagQueryFailure == 0 {
+		t.Fatal("expected QueryFailure flag to be set")
+	}
+	if doc["$err"] != msg {
+		t.Fatalf("expected error %q got %v", msg, doc)
+	}
+}
+
+func TestProxyQueryDeniedCommand(t *testing.T) {
+	t.Parallel()
+	var denied float64
+	p := &ProxyQuery{
+		Log:            &tLogger{TB: t},
+		DeniedCommands: []string{"shutdown", "dropDatabase"},
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.command.denied" {
+					denied += val
+				}
+			},
+		},
+	}
+	ok, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	cases := []struct {
+		Query  bson.D
+		Denied string
+	}{
+		{bson.D{{Name: "dropdatabase", Value: 1}}, "dropDatabase"},
+		{bson.D{{Name: "dropDatabase", Value: 1}, {Name: "ping", Value: 1}}, "dropDatabase"},
+		{bson.D{{Name: "$query", Value: bson.D{{Name: "shutdown", Value: 1}}}}, "shutdown"},
+		{bson.D{{Name: "ping", Value: 1}, {Name: "dropDatabase", Value: 1}}, ""},
+		{bson.D{{Name: "find", Value: "c"}, {Name: "filter", Value: bson.D{{Name: "shutdown", Value: 1}}}}, ""},
+	}
+	for _, c := range cases {
+		h, query := fakeQuery("test.$cmd", c.Query)
+		var forwarded, reply bytes.Buffer
+		client := fakeReadWriter{Reader: query, Writer: &reply}
+		server := fakeReadWriter{Reader: bytes.NewReader(ok), Writer: &forwarded}
+		ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+		if c.Denied == "" {
+			if forwarded.Len() == 0 {
+				t.Fatalf("%v: allowed command was not forwarded", c.Query)
+			}
+			continue
+		}
+		if forwarded.Len() != 0 {
+			t.Fatalf("%v: denied command reached the server", c.Query)
+		}
+		assertErrorReply(t, &reply, h.RequestID, fmt.Sprintf("command %s denied by proxy", c.Denied))
+	}
+	if denied != 3 {
+		t.Fatalf("expected 3 denied commands got %v", denied)
+	}
+}
+
+func TestProxyQueryMaxQueryDocSize(t *testing.T) {
+	t.Parallel()
+	var tooLarge float64
+	p := &ProxyQuery{
+		Log:             &tLogger{TB: t},
+		MaxQueryDocSize: 64,
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.query.too.large" {
+					tooLarge += val
+				}
+			},
+		},
+	}
+	server := fakeReadWriter{
+		Writer: testWriter{
+			write: func(b []byte) (int, error) {
+				t.Fatal("oversized query reached the server")
+				return 0, nil
+			},
+		},
+	}
+	cases := []struct {
+		Collection string
+		Query      bson.D
+		Error      string
+	}{
+		{
+			Collection: "test.$cmd",
+			Query: bson.D{
+				{Name: "find", Value: "c"},
+				{Name: "filter", Value: bson.M{"_id": bson.M{"$in": make([]int, 100)}}},
+			},
+			Error: "query document of 840 bytes exceeds the proxy limit of 64 bytes",
+		},
+		{
+			// Queries on collections are checked without being parsed.
+			Collection: "test.c",
+			Query:      bson.D{{Name: "_id", Value: bson.M{"$in": make([]int, 100)}}},
+			Error:      "query document of 815 bytes exceeds the proxy limit of 64 bytes",
+		},
+	}
+	for _, c := range cases {
+		h, query := fakeQuery(c.Collection, c.Query)
+		var reply bytes.Buffer
+		client := fakeReadWriter{Reader: query, Writer: &reply}
+		ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+		assertErrorReply(t, &reply, h.RequestID, c.Error)
+	}
+	if tooLarge != 2 {
+		t.Fatalf("expected 2 oversized queries got %v", tooLarge)
+	}
+
+	// Commands are rejected by the length of their document before it's read.
+	h, query := fakeQuery("test.$cmd", bson.D{{Name: "ping", Value: 1}})
+	body, err := ioutil.ReadAll(query)
+	ensure.Nil(t, err)
+	setInt32(body, 4+len("test.$cmd\x00")+8, 1<<30) // after flags, name, skip & return
+	var reply bytes.Buffer
+	client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &reply}
+	ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+	assertErrorReply(t, &reply, h.RequestID, "query document of 1073741824 bytes exceeds the proxy limit of 64 bytes")
+	if tooLarge != 3 {
+		t.Fatalf("expected 3 oversized queries got %v", tooLarge)
+	}
+
+	// Smaller queries on collections are proxied as is.
+	h, query = fakeQuery("test.c", bson.D{{Name: "_id", Value: 1}})
+	body, err = ioutil.ReadAll(query)
+	ensure.Nil(t, err)
+	var forwarded bytes.Buffer
+	client = fakeReadWriter{Reader: bytes.NewReader(body), Writer: ioutil.Discard}
+	server = fakeReadWriter{Reader: fakeSingleDocReply(bson.M{"_id": 1}), Writer: &forwarded}
+	ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+	if expected := append(h.ToWire(), body...); !bytes.Equal(forwarded.Bytes(), expected) {
+		t.Fatalf("expected %v to be proxied got %v", expected, forwarded.Bytes())
+	}
+}
+
+func TestProxyQuerySingleWrite(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{Log: &tLogger{TB: t}}
+	h, query := fakeQuery("test.$cmd", bson.D{{Name: "ping", Value: 1}})
+	body, err := ioutil.ReadAll(query)
+	ensure.Nil(t, err)
+	var writes [][]byte
+	client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: ioutil.Discard}
+	server := fakeReadWriter{
+		Reader: fakeSingleDocReply(bson.M{"ok": 1}),
+		Writer: testWriter{
+			write: func(b []byte) (int, error) {
+				writes = append(writes, append([]byte(nil), b...))
+				return len(b), nil
+			},
+		},
+	}
+	ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+	expected := append(h.ToWire(), body...)
+	if len(writes) != 1 || !bytes.Equal(writes[0], expected) {
+		t.Fatalf("expected a single write of %v got %v", expected, writes)
+	}
+}
+
+// newTestIsMasterResponseRewriter returns a rewriter for handshakes whose
+// replies have no members to map.
+func newTestIsMasterResponseRewriter(t testing.TB) *IsMasterResponseRewriter {
+	return &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		ProxyMapper:         fakeProxyMapper{},
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW:             &ReplyRW{Log: &tLogger{TB: t}},
+	}
+}
+
+func TestDisableCompressionNegotiation(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		Log:                           &tLogger{TB: t},
+		DisableCompressionNegotiation: true,
+		IsMasterResponseRewriter:      newTestIsMasterResponseRewriter(t),
+	}
+	h, query := fakeQuery("admin.$cmd", bson.D{
+		{Name: "hello", Value: 1},
+		{Name: "compression", Value: []string{"zstd", "zlib"}},
+		{Name: "client", Value: bson.M{"driver": "test"}},
+	})
+	body, err := ioutil.ReadAll(query)
+	ensure.Nil(t, err)
+	// A returnFieldsSelector follows the query and must still be proxied.
+	selector, err := bson.Marshal(bson.M{"ok": 1})
+	ensure.Nil(t, err)
+	body = append(body, selector...)
+	h.MessageLength += int32(len(selector))
+
+	var forwarded bytes.Buffer
+	client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: ioutil.Discard}
+	server := fakeReadWriter{
+		Reader: fakeSingleDocReply(bson.M{"ok": 1}),
+		Writer: &forwarded,
+	}
+	ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+
+	out := forwarded.Bytes()
+	forwardedH, err := readHeader(bytes.NewReader(out))
+	ensure.Nil(t, err)
+	if int(forwardedH.MessageLength) != len(out) {
+		t.Fatalf("header length %d does not match %d bytes forwarded", forwardedH.MessageLength, len(out))
+	}
+	rest := bytes.NewReader(out[headerLen+4+len("admin.$cmd")+1+8:])
+	queryDoc, err := readDocument(rest)
+	ensure.Nil(t, err)
+	var q bson.D
+	ensure.Nil(t, bson.Unmarshal(queryDoc, &q))
+	if hasKey(q, "compression") {
+		t.Fatalf("compression was forwarded: %v", q)
+	}
+	if !hasKey(q, "hello") || !hasKey(q, "client") {
+		t.Fatalf("unexpected handshake forwarded: %v", q)
+	}
+	forwardedSelector, err := readDocument(rest)
+	ensure.Nil(t, err)
+	if !bytes.Equal(forwardedSelector, selector) {
+		t.Fatalf("expected selector %v got %v", selector, forwardedSelector)
+	}
+}
+
+func TestUnsupportedCompressorsStripped(t *testing.T) {
+	t.Parallel()
+	var stripped int
+	p := &ProxyQuery{
+		Log: &tLogger{TB: t},
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, n float64) {
+				if key == "mongoproxy.compressors.unsupported" {
+					stripped += int(n)
+				}
+			},
+		},
+		IsMasterResponseRewriter: newTestIsMasterResponseRewriter(t),
+	}
+	h, query := fakeQuery("admin.$cmd", bson.D{
+		{Name: "hello", Value: 1},
+		{Name: "compression", Value: []string{"snappy", "zstd", "zlib"}},
+	})
+	var forwarded bytes.Buffer
+	client := fakeReadWriter{Reader: query, Writer: ioutil.Discard}
+	server := fakeReadWriter{
+		Reader: fakeSingleDocReply(bson.M{"ok": 1}),
+		Writer: &forwarded,
+	}
+	ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+
+	out := forwarded.Bytes()
+	queryDoc, err := readDocument(bytes.NewReader(out[headerLen+4+len("admin.$cmd")+1+8:]))
+	ensure.Nil(t, err)
+	var q struct {
+		Compression []string `bson:"compression"`
+	}
+	ensure.Nil(t, bson.Unmarshal(queryDoc, &q))
+	ensure.DeepEqual(t, q.Compression, []string{"zlib"})
+	ensure.DeepEqual(t, stripped, 1)
+}
+
+func TestTagAppName(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		Log:                      &tLogger{TB: t},
+		TagAppName:               true,
+		IsMasterResponseRewriter: newTestIsMasterResponseRewriter(t),
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	cases := []struct {
+		Name     string
+		Client   interface{}
+		Expected interface{}
+	}{
+		{
+			Name:     "application name",
+			Client:   bson.D{{Name: "application", Value: bson.D{{Name: "name", Value: "myapp"}}}},
+			Expected: bson.D{{Name: "application", Value: bson.D{{Name: "name", Value: "myapp via dvara 10.0.0.1"}}}},
+		},
+		{
+			Name:   "no application",
+			Client: bson.D{{Name: "driver", Value: bson.D{{Name: "name", Value: "mgo"}}}},
+			Expected: bson.D{
+				{Name: "driver", Value: bson.D{{Name: "name", Value: "mgo"}}},
+				{Name: "application", Value: bson.D{{Name: "name", Value: "dvara 10.0.0.1"}}},
+			},
+		},
+		{
+			Name: "no client metadata",
+		},
+	}
+	for _, c := range cases {
+		q := bson.D{{Name: "hello", Value: 1}}
+		if c.Client != nil {
+			q = append(q, bson.DocElem{Name: "client", Value: c.Client})
+		}
+		h, query := fakeQuery("admin.$cmd", q)
+		body, err := ioutil.ReadAll(query)
+		ensure.Nil(t, err)
+		client := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(body)}, addr: addr}
+		server := &recordingConn{deadlineConn: deadlineConn{r: bytes.NewReader(reply)}}
+		ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+
+		out := server.written.Bytes()
+		forwardedH, err := readHeader(bytes.NewReader(out))
+		ensure.Nil(t, err)
+		if int(forwardedH.MessageLength) != len(out) {
+			t.Fatalf("%s: header length %d does not match %d bytes forwarded", c.Name, forwardedH.MessageLength, len(out))
+		}
+		queryDoc, err := readDocument(bytes.NewReader(out[headerLen+4+len("admin.$cmd")+1+8:]))
+		ensure.Nil(t, err)
+		var forwarded bson.D
+		ensure.Nil(t, bson.Unmarshal(queryDoc, &forwarded))
+		var actual interface{}
+		for _, e := range forwarded {
+			if e.Name == "client" {
+				actual = e.Value
+			}
+		}
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Fatalf("%s: expected client %v got %v", c.Name, c.Expected, actual)
+		}
+	}
+}
+
+func TestAppendAppNameTag(t *testing.T) {
+	t.Parallel()
+	long := strings.Repeat("a", maxAppNameLen)
+	actual := appendAppNameTag(long, "dvara 10.0.0.1")
+	if len(actual) != maxAppNameLen || !strings.HasSuffix(actual, "a via dvara 10.0.0.1") {
+		t.Fatalf("unexpected application name %q", actual)
+	}
+}
+
+func BenchmarkProxyQueryCommand(b *testing.B) {
+	p := &ProxyQuery{Log: &tLogger{TB: b}}
+	h, query := fakeQuery("test.$cmd", bson.D{{Name: "ping", Value: 1}})
+	body, err := ioutil.ReadAll(query)
+	ensure.Nil(b, err)
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(b, err)
+	var writes int
+	server := testWriter{
+		write: func(b []byte) (int, error) {
+			writes++
+			return len(b), nil
+		},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: ioutil.Discard}
+		server := fakeReadWriter{Reader: bytes.NewReader(reply), Writer: server}
+		if err := p.Proxy(h, client, server, &LastError{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(writes)/float64(b.N), "server-writes/op")
+}
+
+func TestProxyQueryAllowedDatabases(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name       string
+		Collection string
+		Query      bson.D
+		Error      string
+	}{
+		{
+			Name:       "allowed collection",
+			Collection: "app.users",
+			Query:      bson.D{{Name: "name", Value: "a"}},
+		},
+		{
+			Name:       "allowed command",
+			Collection: "app.$cmd",
+			Query:      bson.D{{Name: "count", Value: "users"}},
+		},
+		{
+			Name:       "admin handshake",
+			Collection: "admin.$cmd",
+			Query:      bson.D{{Name: "ping", Value: 1}},
+		},
+		{
+			Name:       "denied collection",
+			Collection: "other.users",
+			Query:      bson.D{{Name: "name", Value: "a"}},
+			Error:      "database other not allowed by proxy",
+		},
+		{
+			Name:       "denied command",
+			Collection: "other.$cmd",
+			Query:      bson.D{{Name: "count", Value: "users"}},
+			Error:      "database other not allowed by proxy",
+		},
+		{
+			Name:       "denied admin command",
+			Collection: "admin.$cmd",
+			Query:      bson.D{{Name: "listDatabases", Value: 1}},
+			Error:      "database admin not allowed by proxy",
+		},
+		{
+			Name:       "admin handshake with modifiers",
+			Collection: "admin.$cmd",
+			Query: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "ping", Value: 1}}},
+				{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}},
+			},
+		},
+		{
+			Name:       "denied admin command with a handshake key",
+			Collection: "admin.$cmd",
+			Query:      bson.D{{Name: "dropDatabase", Value: 1}, {Name: "ping", Value: 1}},
+			Error:      "database admin not allowed by proxy",
+		},
+		{
+			Name:       "denied admin collection",
+			Collection: "admin.system.users",
+			Query:      bson.D{},
+			Error:      "database admin not allowed by proxy",
+		},
+	}
+
+	for _, c := range cases {
+		p := &ProxyQuery{
+			Log:              &tLogger{TB: t},
+			AllowedDatabases: []string{"app"},
+		}
+		h, query := fakeQuery(c.Collection, c.Query)
+		var reply, forwarded bytes.Buffer
+		client := fakeReadWriter{Reader: query, Writer: &reply}
+		server := fakeReadWriter{
+			Reader: fakeSingleDocReply(bson.M{"ok": 1}),
+			Writer: &forwarded,
+		}
+		if err := p.Proxy(h, client, server, &LastError{}); err != nil {
+			t.Fatalf("unexpected error for case %s: %s", c.Name, err)
+		}
+		if c.Error == "" {
+			if int32(forwarded.Len()) != h.MessageLength {
+				t.Fatalf("case %s: query was not forwarded", c.Name)
+			}
+			continue
+		}
+		if forwarded.Len() != 0 {
+			t.Fatalf("case %s: denied query reached the server", c.Name)
+		}
+		assertErrorReply(t, &reply, h.RequestID, c.Error)
+	}
+}
+
+func TestProxyQuery(t *testing.T) {
+	t.Parallel()
+	var p ProxyQuery
+	log := tLogger{TB: t}
+	var graph inject.Graph
+	err := graph.Provide(
+		&inject.Object{Value: &fakeProxyMapper{}},
+		&inject.Object{Value: &fakeReplicaStateCompare{}},
+		&inject.Object{Value: &log},
+		&inject.Object{Value: &stats.HookClient{}},
+		&inject.Object{Value: &p},
+	)
+	ensure.Nil(t, err)
+	ensure.Nil(t, graph.Populate())
+	objects := graph.Objects()
+	ensure.Nil(t, startstop.Start(objects, &log))
+	defer startstop.Stop(objects, &log)
+
+	cases := []struct {
+		Name   string
+		Header *messageHeader
+		Client io.ReadWriter
+		Error  string
+	}{
+		{
+			Name:   "EOF while reading flags from client",
+			Header: &messageHeader{},
+			Client: new(bytes.Buffer),
+			Error:  "EOF",
+		},
+		{
 			Name:   "EOF while reading collection name",
 			Header: &messageHeader{},
 			Client: fakeReadWriter{
@@ -536,3 +1523,751 @@ func TestProxyQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestProxyQueryIsMasterAnyDatabase(t *testing.T) {
+	t.Parallel()
+	for _, cmd := range []string{"isMaster", "ismaster", "hello"} {
+		p := &ProxyQuery{
+			Log:                      &tLogger{TB: t},
+			IsMasterResponseRewriter: newTestIsMasterResponseRewriter(t),
+		}
+		p.IsMasterResponseRewriter.ProxyMapper = fakeProxyMapper{m: map[string]string{"a": "1", "b": "2"}}
+		h, query := fakeQuery("test.$cmd", bson.D{{Name: cmd, Value: 1}})
+		var reply bytes.Buffer
+		client := fakeReadWriter{Reader: query, Writer: &reply}
+		server := fakeReadWriter{
+			Reader: fakeSingleDocReply(bson.M{"hosts": []string{"a", "b"}, "primary": "a"}),
+			Writer: ioutil.Discard,
+		}
+		ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+
+		var actual isMasterResponse
+		ensure.Nil(t, bson.Unmarshal(reply.Bytes()[headerLen+len(emptyPrefix):], &actual))
+		if !reflect.DeepEqual(actual.Hosts, []string{"1", "2"}) || actual.Primary != "1" {
+			t.Fatalf("%s against test.$cmd was not rewritten: %+v", cmd, actual)
+		}
+	}
+}
+
+func TestStaleTopologyReply(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Reply    bson.M
+		Expected bool
+	}{
+		{"ok", bson.M{"ok": 1}, false},
+		{"other error", bson.M{"ok": 0, "code": 11000, "errmsg": "duplicate key"}, false},
+		{"not master code", bson.M{"ok": 0, "code": 10107}, true},
+		{"not master no slave ok", bson.M{"ok": 0, "code": 13435, "errmsg": "not master and slaveOk=false"}, true},
+		{"recovering message", bson.M{"ok": 0, "errmsg": "node is recovering"}, true},
+		{"message with ok", bson.M{"ok": 1, "errmsg": "not master"}, false},
+	}
+	for _, c := range cases {
+		b, err := ioutil.ReadAll(fakeSingleDocReply(c.Reply))
+		ensure.Nil(t, err)
+		if actual := staleTopologyReply(b); actual != c.Expected {
+			t.Fatalf("%s: expected %v got %v", c.Name, c.Expected, actual)
+		}
+	}
+	if staleTopologyReply([]byte{1, 2, 3}) {
+		t.Fatal("truncated reply was considered stale")
+	}
+}
+
+// restartLogger signals when a Restart is skipped.
+type restartLogger struct {
+	*tLogger
+	skipped chan struct{}
+}
+
+func (l *restartLogger) Info(args ...interface{}) {
+	if fmt.Sprint(args...) == "restart skipped since stopping" {
+		close(l.skipped)
+	}
+}
+
+func TestProxyQueryRestartOnStaleTopology(t *testing.T) {
+	t.Parallel()
+	var stale float64
+	// The replica set is stopping, so the Restart is skipped once triggered.
+	log := &restartLogger{tLogger: &tLogger{TB: t}, skipped: make(chan struct{})}
+	p := &ProxyQuery{
+		Log:                    log,
+		RestartOnStaleTopology: true,
+		ReplicaSet: &ReplicaSet{
+			Log:       log,
+			restarter: new(sync.Once),
+			stopping:  true,
+		},
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.stale.topology" {
+					stale += val
+				}
+			},
+		},
+	}
+
+	// The same client connection is used for a command after the stale reply.
+	var queries, replies bytes.Buffer
+	var headers []*messageHeader
+	for _, r := range []bson.M{
+		{"ok": 0, "code": 10107, "errmsg": "not master"},
+		{"ok": 1, "n": 1},
+	} {
+		reply, err := ioutil.ReadAll(fakeSingleDocReply(r))
+		ensure.Nil(t, err)
+		replies.Write(reply)
+		h, query := fakeQuery("test.$cmd", bson.D{{Name: "insert", Value: "c"}})
+		_, err = io.Copy(&queries, query)
+		ensure.Nil(t, err)
+		headers = append(headers, h)
+	}
+	expected := append([]byte(nil), replies.Bytes()...)
+	var out bytes.Buffer
+	client := fakeReadWriter{Reader: &queries, Writer: &out}
+	server := fakeReadWriter{Reader: &replies, Writer: ioutil.Discard}
+	for _, h := range headers {
+		ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+	}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Fatalf("expected replies %v to be proxied got %v", expected, out.Bytes())
+	}
+	if stale != 1 {
+		t.Fatalf("expected 1 stale topology reply got %v", stale)
+	}
+	select {
+	case <-log.skipped:
+	case <-time.After(time.Minute):
+		t.Fatal("restart was not triggered")
+	}
+}
+
+func TestProxyQueryRewriteErr(t *testing.T) {
+	t.Parallel()
+	log := &restartLogger{tLogger: &tLogger{TB: t}, skipped: make(chan struct{})}
+	p := &ProxyQuery{
+		Log: log,
+		ReplicaSet: &ReplicaSet{
+			Log:       log,
+			restarter: new(sync.Once),
+			stopping:  true,
+		},
+	}
+	if err := p.rewriteErr(errRSChanged); err != errRSChanged {
+		t.Fatalf("expected %s got %v", errRSChanged, err)
+	}
+	ensure.Nil(t, p.rewriteErr(errPrimaryUnmappable))
+	select {
+	case <-log.skipped:
+	case <-time.After(time.Minute):
+		t.Fatal("restart was not triggered")
+	}
+}
+
+func TestProxyQueryReadOnly(t *testing.T) {
+	t.Parallel()
+	var rejected float64
+	p := &ProxyQuery{
+		Log:        &tLogger{TB: t},
+		ReplicaSet: &ReplicaSet{ReadOnly: true},
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.write.rejected" {
+					rejected += val
+				}
+			},
+		},
+	}
+	ok, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{"ok": 1}))
+	ensure.Nil(t, err)
+	cases := []struct {
+		Query    bson.D
+		Rejected bool
+	}{
+		{bson.D{{Name: "insert", Value: "c"}, {Name: "documents", Value: []bson.M{{"_id": 1}}}}, true},
+		{bson.D{{Name: "findandmodify", Value: "c"}, {Name: "remove", Value: true}}, true},
+		{bson.D{{Name: "drop", Value: "c"}}, true},
+		{bson.D{{Name: "applyOps", Value: []bson.M{}}}, true},
+		{bson.D{{Name: "createUser", Value: "u"}}, true},
+		{bson.D{{Name: "$query", Value: bson.D{{Name: "insert", Value: "c"}}}}, true},
+		{bson.D{{Name: "insert", Value: "c"}, {Name: "find", Value: "c"}}, true},
+		{bson.D{
+			{Name: "aggregate", Value: "c"},
+			{Name: "pipeline", Value: []bson.D{{{Name: "$match", Value: bson.M{}}}, {{Name: "$out", Value: "d"}}}},
+		}, true},
+		{bson.D{
+			{Name: "mapReduce", Value: "c"},
+			{Name: "out", Value: "d"},
+		}, true},
+		{bson.D{{Name: "explain", Value: bson.D{{Name: "delete", Value: "c"}}}}, true},
+		{bson.D{{Name: "find", Value: "c"}}, false},
+		{bson.D{{Name: "count", Value: "c"}}, false},
+		{bson.D{{Name: "find", Value: "c"}, {Name: "insert", Value: "c"}}, false},
+		{bson.D{
+			{Name: "aggregate", Value: "c"},
+			{Name: "pipeline", Value: []bson.D{{{Name: "$match", Value: bson.M{}}}}},
+		}, false},
+		{bson.D{
+			{Name: "mapreduce", Value: "c"},
+			{Name: "out", Value: bson.D{{Name: "inline", Value: 1}}},
+		}, false},
+		{bson.D{{Name: "explain", Value: bson.D{{Name: "find", Value: "c"}}}}, false},
+		{bson.D{{Name: "ping", Value: 1}}, false},
+	}
+	for _, c := range cases {
+		h, query := fakeQuery("test.$cmd", c.Query)
+		var forwarded, reply bytes.Buffer
+		client := fakeReadWriter{Reader: query, Writer: &reply}
+		server := fakeReadWriter{Reader: bytes.NewReader(ok), Writer: &forwarded}
+		ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+		if c.Rejected == (forwarded.Len() != 0) {
+			t.Fatalf("%v: expected rejected %v, forwarded %d bytes", c.Query, c.Rejected, forwarded.Len())
+		}
+		if c.Rejected && !bytes.Contains(reply.Bytes(), []byte(errReadOnly)) {
+			t.Fatalf("%v: expected read-only error got %v", c.Query, reply.Bytes())
+		}
+	}
+	if rejected != 10 {
+		t.Fatalf("expected 10 rejected writes got %v", rejected)
+	}
+}
+
+func TestProxyQueryMaxReplyDocs(t *testing.T) {
+	t.Parallel()
+	var truncated float64
+	p := &ProxyQuery{
+		Log:          &tLogger{TB: t},
+		MaxReplyDocs: 1,
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.reply.truncated" {
+					truncated += val
+				}
+			},
+		},
+	}
+	docs := []interface{}{bson.M{"_id": 1}, bson.M{"_id": 2}}
+
+	// A query reply is truncated and its cursor killed.
+	h, query := fakeQuery("test.c", bson.M{})
+	var forwarded, reply bytes.Buffer
+	client := fakeReadWriter{Reader: query, Writer: &reply}
+	server := fakeReadWriter{Reader: bytes.NewReader(fakeReply(t, 7, docs...)), Writer: &forwarded}
+	ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+	if expected := fakeReply(t, 0, docs[:1]...); !bytes.Equal(reply.Bytes(), expected) {
+		t.Fatalf("expected reply %v got %v", expected, reply.Bytes())
+	}
+	_, err := readHeader(&forwarded) // the query
+	ensure.Nil(t, err)
+	forwarded.Next(int(h.MessageLength) - headerLen)
+	killH, err := readHeader(&forwarded)
+	ensure.Nil(t, err)
+	if killH.OpCode != OpKillCursors {
+		t.Fatalf("expected the cursor to be killed got %s", killH)
+	}
+	if expected := []byte{0, 0, 0, 0, 1, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(forwarded.Bytes(), expected) {
+		t.Fatalf("expected kill cursors %v got %v", expected, forwarded.Bytes())
+	}
+
+	// Command replies aren't limited.
+	h, query = fakeQuery("test.$cmd", bson.D{{Name: "count", Value: "c"}})
+	cmdReply := fakeReply(t, 7, docs...)
+	reply.Reset()
+	client = fakeReadWriter{Reader: query, Writer: &reply}
+	server = fakeReadWriter{Reader: bytes.NewReader(cmdReply), Writer: ioutil.Discard}
+	ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+	if !bytes.Equal(reply.Bytes(), cmdReply) {
+		t.Fatalf("expected command reply %v got %v", cmdReply, reply.Bytes())
+	}
+	if truncated != 1 {
+		t.Fatalf("expected 1 truncated reply got %v", truncated)
+	}
+}
+
+func TestWriteErrorReply(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	ensure.Nil(t, writeErrorReply(&out, 42, errCodeUnauthorized, "nope"))
+
+	h, err := readHeader(&out)
+	ensure.Nil(t, err)
+	if h.OpCode != OpReply || h.ResponseTo != 42 {
+		t.Fatalf("unexpected header %s", h)
+	}
+	if int(h.MessageLength) != headerLen+out.Len() {
+		t.Fatalf("header length %d does not match %d bytes", h.MessageLength, headerLen+out.Len())
+	}
+	var prefix replyPrefix
+	_, err = io.ReadFull(&out, prefix[:])
+	ensure.Nil(t, err)
+	if flags := getInt32(prefix[:], 0); flags != replyFlagQueryFailure {
+		t.Fatalf("expected query failure flag got %d", flags)
+	}
+	if n := getInt32(prefix[:], 16); n != 1 {
+		t.Fatalf("expected 1 document got %d", n)
+	}
+	doc, err := readDocument(&out)
+	ensure.Nil(t, err)
+	if out.Len() != 0 {
+		t.Fatalf("%d unexpected trailing bytes", out.Len())
+	}
+	var actual bson.M
+	ensure.Nil(t, bson.Unmarshal(doc, &actual))
+	expected := bson.M{"$err": "nope", "errmsg": "nope", "code": errCodeUnauthorized, "ok": 0}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+}
+
+func TestProxyQueryDirectConnection(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		Log:              &tLogger{TB: t},
+		DirectConnection: true,
+	}
+	for _, cmd := range []string{"isMaster", "hello", "replSetGetStatus"} {
+		reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.M{
+			"hosts":   []string{"a", "b"},
+			"primary": "a",
+			"members": []bson.M{{"name": "a"}},
+		}))
+		ensure.Nil(t, err)
+		h, query := fakeQuery("admin.$cmd", bson.D{{Name: cmd, Value: 1}})
+		var out bytes.Buffer
+		client := fakeReadWriter{Reader: query, Writer: &out}
+		server := fakeReadWriter{Reader: bytes.NewReader(reply), Writer: ioutil.Discard}
+		ensure.Nil(t, p.Proxy(h, client, server, &LastError{}))
+		if !bytes.Equal(out.Bytes(), reply) {
+			t.Fatalf("%s reply was rewritten: %v", cmd, out.Bytes())
+		}
+	}
+}
+
+func TestIsMasterResponseRewriterPreservesOrder(t *testing.T) {
+	t.Parallel()
+	r := &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		ProxyMapper:         fakeProxyMapper{m: map[string]string{"a": "1", "b": "2"}},
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW:             &ReplyRW{Log: &tLogger{TB: t}},
+	}
+	in := bson.D{
+		{Name: "ismaster", Value: true},
+		{Name: "setName", Value: "rs"},
+		{Name: "hosts", Value: []string{"a", "b"}},
+		{Name: "primary", Value: "a"},
+		{Name: "me", Value: "b"},
+		{Name: "maxBsonObjectSize", Value: 16777216},
+		{Name: "ok", Value: 1.0},
+	}
+	var client bytes.Buffer
+	ensure.Nil(t, r.Rewrite(&client, fakeSingleDocReply(in)))
+
+	var actual bson.D
+	ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &actual))
+	expected := bson.D{
+		{Name: "ismaster", Value: true},
+		{Name: "setName", Value: "rs"},
+		{Name: "hosts", Value: []interface{}{"1", "2"}},
+		{Name: "primary", Value: "1"},
+		{Name: "me", Value: "2"},
+		{Name: "maxBsonObjectSize", Value: 16777216},
+		{Name: "ok", Value: 1.0},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+}
+
+// readTestOpMsg reads an OpMsg, decompressing it if needed.
+func readTestOpMsg(t testing.TB, r io.Reader) (*messageHeader, *opMsg) {
+	h, err := readHeader(r)
+	ensure.Nil(t, err)
+	if h.OpCode == OpCompressed {
+		var body []byte
+		h, body, err = decompressMessage(h, r)
+		ensure.Nil(t, err)
+		r = bytes.NewReader(body)
+	}
+	ensure.DeepEqual(t, h.OpCode, OpMsg)
+	m, err := readOpMsg(h, r)
+	ensure.Nil(t, err)
+	return h, m
+}
+
+func TestProxyQueryOpMsgHello(t *testing.T) {
+	t.Parallel()
+	reply := fakeOpMsg(t, 0, bson.D{
+		{Name: "isWritablePrimary", Value: true},
+		{Name: "hosts", Value: []string{"a", "b"}},
+		{Name: "primary", Value: "a"},
+		{Name: "ok", Value: 1.0},
+	})
+	var compressedReply []byte
+	{
+		h, err := readHeader(bytes.NewReader(reply))
+		ensure.Nil(t, err)
+		h.compressorID = compressorZlib
+		parts, err := compressMessage(h, reply[headerLen:])
+		ensure.Nil(t, err)
+		compressedReply = bytes.Join(parts, nil)
+	}
+	cases := []struct {
+		Name       string
+		Cmd        string
+		Reply      []byte
+		Compressed bool
+	}{
+		{Name: "hello", Cmd: "hello", Reply: reply},
+		{Name: "isMaster", Cmd: "isMaster", Reply: reply},
+		{Name: "legacy ismaster", Cmd: "ismaster", Reply: reply},
+		{Name: "compressed", Cmd: "hello", Reply: compressedReply, Compressed: true},
+	}
+	for _, c := range cases {
+		p := &ProxyQuery{
+			Log:                      &tLogger{TB: t},
+			IsMasterResponseRewriter: newTestIsMasterResponseRewriter(t),
+		}
+		p.IsMasterResponseRewriter.ProxyMapper = fakeProxyMapper{m: map[string]string{"a": "1", "b": "2"}}
+		msg := fakeOpMsg(
+			t,
+			opMsgChecksumPresent|opMsgExhaustAllowed,
+			bson.D{{Name: c.Cmd, Value: 1}, {Name: "$db", Value: "admin"}},
+		)
+		r := bytes.NewReader(msg)
+		h, err := readHeader(r)
+		ensure.Nil(t, err)
+		head, err := readOpMsgHead(h, r)
+		ensure.Nil(t, err)
+		var sent, received bytes.Buffer
+		client := fakeReadWriter{Reader: r, Writer: &received}
+		server := fakeReadWriter{Reader: bytes.NewReader(c.Reply), Writer: &sent}
+		ensure.Nil(t, p.ProxyMsg(h, head, client, server))
+
+		// The exhaust flag is cleared and the checksum updated.
+		sentH, sentMsg := readTestOpMsg(t, &sent)
+		if sentMsg.Flags != opMsgChecksumPresent {
+			t.Fatalf("%s: unexpected flags %b sent to the server", c.Name, sentMsg.Flags)
+		}
+		if err := checkOpMsgChecksum(sentMsg.Marshal(sentH)); err != nil {
+			t.Fatalf("%s: %s", c.Name, err)
+		}
+
+		if c.Compressed {
+			replyH, err := readHeader(bytes.NewReader(received.Bytes()))
+			ensure.Nil(t, err)
+			if replyH.OpCode != OpCompressed {
+				t.Fatalf("%s: expected a compressed reply got %s", c.Name, replyH)
+			}
+		}
+		_, replyMsg := readTestOpMsg(t, &received)
+		var actual bson.D
+		ensure.Nil(t, bson.Unmarshal(replyMsg.Body(), &actual))
+		expected := bson.D{
+			{Name: "isWritablePrimary", Value: true},
+			{Name: "hosts", Value: []interface{}{"1", "2"}},
+			{Name: "primary", Value: "1"},
+			{Name: "ok", Value: 1.0},
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("%s: expected %v got %v", c.Name, expected, actual)
+		}
+	}
+}
+
+// checkOpMsgChecksum verifies the checksum of the OpMsg.
+func checkOpMsgChecksum(msg []byte) error {
+	expected := crc32.Checksum(msg[:len(msg)-4], crc32c)
+	if actual := uint32(getInt32(msg, len(msg)-4)); actual != expected {
+		return fmt.Errorf("expected checksum %x got %x", expected, actual)
+	}
+	return nil
+}
+
+func TestProxyQueryOpMsgPassThrough(t *testing.T) {
+	t.Parallel()
+	insert := fakeOpMsg(
+		t,
+		0,
+		bson.D{{Name: "insert", Value: "c"}, {Name: "$db", Value: "test"}},
+		bson.M{"_id": 1},
+		bson.M{"_id": 2},
+	)
+	reply := fakeOpMsg(t, 0, bson.M{"n": 2, "ok": 1})
+	cases := []struct {
+		Name  string
+		Msg   []byte
+		Reply []byte
+	}{
+		{Name: "command", Msg: insert, Reply: reply},
+		{
+			// No reply is expected, so none is read.
+			Name: "more to come",
+			Msg:  fakeOpMsg(t, opMsgMoreToCome, bson.D{{Name: "insert", Value: "c"}}, bson.M{"_id": 1}),
+		},
+		{
+			// The isMaster rewriter isn't involved for other commands.
+			Name:  "hello not the command",
+			Msg:   fakeOpMsg(t, 0, bson.D{{Name: "find", Value: "c"}, {Name: "hello", Value: 1}}),
+			Reply: reply,
+		},
+	}
+	for _, c := range cases {
+		p := &ProxyQuery{Log: &tLogger{TB: t}}
+		r := bytes.NewReader(c.Msg)
+		h, err := readHeader(r)
+		ensure.Nil(t, err)
+		head, err := readOpMsgHead(h, r)
+		ensure.Nil(t, err)
+		var sent, received bytes.Buffer
+		client := fakeReadWriter{Reader: r, Writer: &received}
+		server := fakeReadWriter{Reader: bytes.NewReader(c.Reply), Writer: &sent}
+		ensure.Nil(t, p.ProxyMsg(h, head, client, server))
+		if !bytes.Equal(sent.Bytes(), c.Msg) {
+			t.Fatalf("%s: expected %v sent got %v", c.Name, c.Msg, sent.Bytes())
+		}
+		if !bytes.Equal(received.Bytes(), c.Reply) {
+			t.Fatalf("%s: expected %v received got %v", c.Name, c.Reply, received.Bytes())
+		}
+	}
+}
+
+func TestProxyQueryOpMsgPolicies(t *testing.T) {
+	t.Parallel()
+	ok := fakeOpMsg(t, 0, bson.M{"ok": 1})
+	cmd := func(db string, d ...bson.DocElem) bson.D {
+		return append(bson.D(d), bson.DocElem{Name: "$db", Value: db})
+	}
+	cases := []struct {
+		Name  string
+		Proxy ProxyQuery
+		Msg   []byte
+		Stat  string
+		Error string
+	}{
+		{
+			Name:  "allowed database",
+			Proxy: ProxyQuery{AllowedDatabases: []string{"app"}},
+			Msg:   fakeOpMsg(t, 0, cmd("app", bson.DocElem{Name: "find", Value: "c"})),
+		},
+		{
+			Name:  "admin handshake",
+			Proxy: ProxyQuery{AllowedDatabases: []string{"app"}},
+			Msg:   fakeOpMsg(t, 0, cmd("admin", bson.DocElem{Name: "ping", Value: 1})),
+		},
+		{
+			Name:  "denied database",
+			Proxy: ProxyQuery{AllowedDatabases: []string{"app"}},
+			Msg:   fakeOpMsg(t, 0, cmd("other", bson.DocElem{Name: "find", Value: "c"})),
+			Stat:  "mongoproxy.database.denied",
+			Error: "database other not allowed by proxy",
+		},
+		{
+			Name:  "denied admin command with a handshake key",
+			Proxy: ProxyQuery{AllowedDatabases: []string{"app"}},
+			Msg: fakeOpMsg(t, 0, cmd(
+				"admin",
+				bson.DocElem{Name: "dropDatabase", Value: 1},
+				bson.DocElem{Name: "ping", Value: 1},
+			)),
+			Stat:  "mongoproxy.database.denied",
+			Error: "database admin not allowed by proxy",
+		},
+		{
+			Name:  "denied command",
+			Proxy: ProxyQuery{DeniedCommands: []string{"dropDatabase"}},
+			Msg:   fakeOpMsg(t, 0, cmd("app", bson.DocElem{Name: "dropdatabase", Value: 1})),
+			Stat:  "mongoproxy.command.denied",
+			Error: "command dropDatabase denied by proxy",
+		},
+		{
+			Name:  "read-only insert",
+			Proxy: ProxyQuery{ReplicaSet: &ReplicaSet{ReadOnly: true}},
+			Msg:   fakeOpMsg(t, 0, cmd("app", bson.DocElem{Name: "insert", Value: "c"}), bson.M{"_id": 1}),
+			Stat:  "mongoproxy.write.rejected",
+			Error: errReadOnly,
+		},
+		{
+			Name:  "read-only find",
+			Proxy: ProxyQuery{ReplicaSet: &ReplicaSet{ReadOnly: true}},
+			Msg:   fakeOpMsg(t, 0, cmd("app", bson.DocElem{Name: "find", Value: "c"})),
+		},
+		{
+			// The documents in sequences count towards the size.
+			Name:  "too large",
+			Proxy: ProxyQuery{MaxQueryDocSize: 64},
+			Msg: fakeOpMsg(
+				t,
+				0,
+				cmd("app", bson.DocElem{Name: "insert", Value: "c"}),
+				bson.M{"a": strings.Repeat("x", 64)},
+			),
+			Stat:  "mongoproxy.query.too.large",
+			Error: "command of 125 bytes exceeds the proxy limit of 64 bytes",
+		},
+		{
+			// No reply is expected, so none is sent.
+			Name:  "read-only unacknowledged insert",
+			Proxy: ProxyQuery{ReplicaSet: &ReplicaSet{ReadOnly: true}},
+			Msg: fakeOpMsg(
+				t,
+				opMsgMoreToCome,
+				cmd("app", bson.DocElem{Name: "insert", Value: "c"}),
+				bson.M{"_id": 1},
+			),
+			Stat: "mongoproxy.write.rejected",
+		},
+	}
+	for _, c := range cases {
+		var stat float64
+		p := c.Proxy
+		p.Log = &tLogger{TB: t}
+		p.Stats = &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == c.Stat {
+					stat += val
+				}
+			},
+		}
+		r := bytes.NewReader(c.Msg)
+		h, err := readHeader(r)
+		ensure.Nil(t, err)
+		head, err := readOpMsgHead(h, r)
+		ensure.Nil(t, err)
+		var sent, received bytes.Buffer
+		client := fakeReadWriter{Reader: r, Writer: &received}
+		server := fakeReadWriter{Reader: bytes.NewReader(ok), Writer: &sent}
+		ensure.Nil(t, p.ProxyMsg(h, head, client, server))
+		if r.Len() != 0 {
+			t.Fatalf("%s: %d bytes of the message were left unread", c.Name, r.Len())
+		}
+
+		if c.Stat == "" {
+			if !bytes.Equal(sent.Bytes(), c.Msg) {
+				t.Fatalf("%s: expected %v sent got %v", c.Name, c.Msg, sent.Bytes())
+			}
+			continue
+		}
+		if sent.Len() != 0 {
+			t.Fatalf("%s: rejected command reached the server", c.Name)
+		}
+		if stat != 1 {
+			t.Fatalf("%s: expected %s to be 1 got %v", c.Name, c.Stat, stat)
+		}
+		if c.Error == "" {
+			if received.Len() != 0 {
+				t.Fatalf("%s: unexpected reply %v", c.Name, received.Bytes())
+			}
+			continue
+		}
+		replyH, reply := readTestOpMsg(t, &received)
+		if replyH.ResponseTo != h.RequestID {
+			t.Fatalf("%s: expected response to %d got %d", c.Name, h.RequestID, replyH.ResponseTo)
+		}
+		var actual struct {
+			OK     int    `bson:"ok"`
+			ErrMsg string `bson:"errmsg"`
+		}
+		ensure.Nil(t, bson.Unmarshal(reply.Body(), &actual))
+		if actual.OK != 0 || actual.ErrMsg != c.Error {
+			t.Fatalf("%s: expected error %q got %+v", c.Name, c.Error, actual)
+		}
+	}
+}
+
+func TestProxyQueryOpMsgMaxReplyDocs(t *testing.T) {
+	t.Parallel()
+	batch := []bson.M{{"_id": 1}, {"_id": 2}, {"_id": 3}}
+	cursorReply := func(id int64, docs []bson.M) []byte {
+		return fakeOpMsg(t, 0, bson.D{
+			{Name: "cursor", Value: bson.D{
+				{Name: "firstBatch", Value: docs},
+				{Name: "id", Value: id},
+				{Name: "ns", Value: "test.c"},
+			}},
+			{Name: "ok", Value: 1.0},
+		})
+	}
+	find := fakeOpMsg(t, 0, bson.D{{Name: "find", Value: "c"}, {Name: "$db", Value: "test"}})
+	killed := fakeOpMsg(t, 0, bson.M{"ok": 1})
+
+	cases := []struct {
+		Name    string
+		MaxDocs int
+		Reply   []byte
+		Docs    int
+		Killed  bool
+	}{
+		{Name: "within the limit", MaxDocs: 3, Reply: cursorReply(9, batch), Docs: 3},
+		{Name: "truncated", MaxDocs: 2, Reply: cursorReply(9, batch), Docs: 2, Killed: true},
+		{Name: "truncated last batch", MaxDocs: 2, Reply: cursorReply(0, batch), Docs: 2},
+	}
+	for _, c := range cases {
+		var truncated float64
+		p := &ProxyQuery{
+			Log:          &tLogger{TB: t},
+			MaxReplyDocs: c.MaxDocs,
+			Stats: &stats.HookClient{
+				BumpSumHook: func(key string, val float64) {
+					if key == "mongoproxy.reply.truncated" {
+						truncated += val
+					}
+				},
+			},
+		}
+		r := bytes.NewReader(find)
+		h, err := readHeader(r)
+		ensure.Nil(t, err)
+		head, err := readOpMsgHead(h, r)
+		ensure.Nil(t, err)
+		var sent, received bytes.Buffer
+		client := fakeReadWriter{Reader: r, Writer: &received}
+		server := fakeReadWriter{
+			Reader: bytes.NewReader(append(append([]byte{}, c.Reply...), killed...)),
+			Writer: &sent,
+		}
+		ensure.Nil(t, p.ProxyMsg(h, head, client, server))
+
+		receivedMsg := append([]byte{}, received.Bytes()...)
+		_, reply := readTestOpMsg(t, &received)
+		var actual struct {
+			Cursor struct {
+				FirstBatch []bson.M `bson:"firstBatch"`
+				ID         int64    `bson:"id"`
+				NS         string   `bson:"ns"`
+			} `bson:"cursor"`
+			OK float64 `bson:"ok"`
+		}
+		ensure.Nil(t, bson.Unmarshal(reply.Body(), &actual))
+		ensure.DeepEqual(t, len(actual.Cursor.FirstBatch), c.Docs)
+		ensure.DeepEqual(t, actual.Cursor.NS, "test.c")
+		ensure.DeepEqual(t, actual.OK, 1.0)
+		if c.Docs == len(batch) {
+			ensure.DeepEqual(t, receivedMsg, c.Reply)
+			ensure.DeepEqual(t, truncated, float64(0))
+		} else {
+			ensure.DeepEqual(t, actual.Cursor.ID, int64(0))
+			ensure.DeepEqual(t, truncated, float64(1))
+		}
+
+		sentFind := sent.Next(len(find))
+		ensure.DeepEqual(t, sentFind, find)
+		if !c.Killed {
+			ensure.DeepEqual(t, sent.Len(), 0)
+			continue
+		}
+		_, kill := readTestOpMsg(t, &sent)
+		var killCursors bson.D
+		ensure.Nil(t, bson.Unmarshal(kill.Body(), &killCursors))
+		expected := bson.D{
+			{Name: "killCursors", Value: "c"},
+			{Name: "cursors", Value: []interface{}{int64(9)}},
+			{Name: "$db", Value: "test"},
+		}
+		if !reflect.DeepEqual(killCursors, expected) {
+			t.Fatalf("%s: expected %v got %v", c.Name, expected, killCursors)
+		}
+	}
+}
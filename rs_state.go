@@ -2,7 +2,11 @@ package dvara
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -45,6 +49,14 @@ func NewReplicaSetState(addr string) (*ReplicaSetState, error) {
 		r.singleAddr = addr
 	}
 
+	// The configuration is only used to optionally exclude members, so it isn't
+	// an error if it's not available, for example on older servers.
+	if r.lastRS != nil {
+		if config, err := replSetGetConfig(session); err == nil {
+			r.lastRS.applyConfig(config)
+		}
+	}
+
 	if r.lastIM, err = isMaster(session); err != nil {
 		return nil, err
 	}
@@ -111,39 +123,230 @@ func (r *ReplicaSetState) Addrs() []string {
 	return members
 }
 
+// StateChangeKind is the kind of a StateChange.
+type StateChangeKind string
+
+const (
+	// StateChangePrimary indicates the primary moved.
+	StateChangePrimary = StateChangeKind("primary")
+
+	// StateChangeMemberAdded indicates a member was added.
+	StateChangeMemberAdded = StateChangeKind("added")
+
+	// StateChangeMemberRemoved indicates a member was removed.
+	StateChangeMemberRemoved = StateChangeKind("removed")
+
+	// StateChangeMemberState indicates a member changed state.
+	StateChangeMemberState = StateChangeKind("state")
+)
+
+// StateChange describes a single difference between two ReplicaSetStates.
+type StateChange struct {
+	Kind StateChangeKind
+
+	// Member is the address of the member that changed. It is empty for
+	// StateChangePrimary.
+	Member string
+
+	// From and To are the previous and new values, the member state or for
+	// StateChangePrimary the primary address. They are empty when there was no
+	// previous or new value.
+	From, To string
+}
+
+func (c StateChange) String() string {
+	switch c.Kind {
+	case StateChangePrimary:
+		return fmt.Sprintf("primary moved from %q to %q", c.From, c.To)
+	case StateChangeMemberAdded:
+		return fmt.Sprintf("member %s added in state %s", c.Member, c.To)
+	case StateChangeMemberRemoved:
+		return fmt.Sprintf("member %s removed from state %s", c.Member, c.From)
+	}
+	return fmt.Sprintf("member %s changed from %s to %s", c.Member, c.From, c.To)
+}
+
+// Diff returns the changes from this ReplicaSetState to the given one. The
+// primary change, if any, comes first followed by the member changes ordered
+// by address.
+func (r *ReplicaSetState) Diff(o *ReplicaSetState) []StateChange {
+	var changes []StateChange
+	if from, to := r.primary(), o.primary(); from != to {
+		changes = append(changes, StateChange{Kind: StateChangePrimary, From: from, To: to})
+	}
+
+	from, to := r.memberStates(), o.memberStates()
+	names := make([]string, 0, len(from)+len(to))
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, ok := from[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fromState, inFrom := from[name]
+		toState, inTo := to[name]
+		switch {
+		case !inFrom:
+			changes = append(changes, StateChange{Kind: StateChangeMemberAdded, Member: name, To: toState})
+		case !inTo:
+			changes = append(changes, StateChange{Kind: StateChangeMemberRemoved, Member: name, From: fromState})
+		case fromState != toState:
+			changes = append(changes, StateChange{Kind: StateChangeMemberState, Member: name, From: fromState, To: toState})
+		}
+	}
+	return changes
+}
+
+// primary returns the address of the primary, if any.
+func (r *ReplicaSetState) primary() string {
+	if r.lastRS != nil {
+		for _, m := range r.lastRS.Members {
+			if m.State == ReplicaStatePrimary {
+				return m.Name
+			}
+		}
+	}
+	return ""
+}
+
+// memberStates returns the state of each member by address. In single node
+// mode the one node is returned with an empty state.
+func (r *ReplicaSetState) memberStates() map[string]string {
+	states := make(map[string]string)
+	if r.singleAddr != "" {
+		states[r.singleAddr] = ""
+	}
+	if r.lastRS != nil {
+		for _, m := range r.lastRS.Members {
+			states[m.Name] = string(m.State)
+		}
+	}
+	return states
+}
+
+const defaultMaxConcurrentProbes = 8
+
+// StateCreator creates a ReplicaSetState from a given set of seed addresses.
+// It allows for testing discovery without mongo.
+type StateCreator interface {
+	FromAddrs(addrs []string, replicaSetName string) (*ReplicaSetState, error)
+}
+
 // ReplicaSetStateCreator allows for creating a ReplicaSetState from a given
 // set of seed addresses.
 type ReplicaSetStateCreator struct {
 	Log Logger `inject:""`
+
+	// MaxConcurrentProbes is the number of seed addresses FromAddrs will probe
+	// at the same time. Defaults to 8.
+	MaxConcurrentProbes uint
+
+	// MaxConcurrentDiscoveries if non zero limits the number of FromAddrs calls
+	// in progress at the same time. The creator is shared by all the
+	// ReplicaSets in the process, so this bounds the discovery storm when they
+	// all restart at once. The excess waits for a slot.
+	MaxConcurrentDiscoveries uint
+
+	// newState is used to probe a single address. It defaults to
+	// NewReplicaSetState.
+	newState func(addr string) (*ReplicaSetState, error)
+
+	discoveryLimiterOnce sync.Once
+	discoveryLimiter     chan struct{}
 }
 
 // FromAddrs creates a ReplicaSetState from the given set of see addresses. It
 // requires the addresses to be part of the same Replica Set.
 func (c *ReplicaSetStateCreator) FromAddrs(addrs []string, replicaSetName string) (*ReplicaSetState, error) {
+	c.discoveryLimiterOnce.Do(func() {
+		if c.MaxConcurrentDiscoveries > 0 {
+			c.discoveryLimiter = make(chan struct{}, c.MaxConcurrentDiscoveries)
+		}
+	})
+	if limiter := c.discoveryLimiter; limiter != nil {
+		limiter <- struct{}{}
+		defer func() { <-limiter }()
+	}
+
+	newState := c.newState
+	if newState == nil {
+		newState = NewReplicaSetState
+	}
+
+	// The addresses are independent, so probe them concurrently and then
+	// process the results in order.
+	type result struct {
+		state *ReplicaSetState
+		err   error
+	}
+	results := make([]result, len(addrs))
+	maxConcurrentProbes := c.MaxConcurrentProbes
+	if maxConcurrentProbes == 0 {
+		maxConcurrentProbes = defaultMaxConcurrentProbes
+	}
+	limiter := make(chan struct{}, maxConcurrentProbes)
+	var wg sync.WaitGroup
+	wg.Add(len(addrs))
+	for i, addr := range addrs {
+		go func(i int, addr string) {
+			defer wg.Done()
+			limiter <- struct{}{}
+			defer func() { <-limiter }()
+			results[i].state, results[i].err = newState(addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
 	var r *ReplicaSetState
-	for _, addr := range addrs {
-		ar, err := NewReplicaSetState(addr)
-		if err != nil {
+	var skipped []string
+	errs := make(map[string]error)
+	skip := func(addr string, err error) {
+		reason := classifySeedError(err)
+		switch reason {
+		case seedUnreachable:
+			c.Log.Infof("ignoring unreachable address %s: %s", addr, err)
+		case seedWrongReplicaSet, seedStandalone:
+			c.Log.Warn(err)
+		default:
 			c.Log.Errorf("ignoring failure against address %s: %s", addr, err)
+		}
+		errs[addr] = err
+		skipped = append(skipped, fmt.Sprintf("%s (%s)", addr, reason))
+	}
+	for i, addr := range addrs {
+		ar, err := results[i].state, results[i].err
+		if err != nil {
+			skip(addr, err)
 			continue
 		}
 
 		if replicaSetName != "" {
 			if ar.lastRS == nil {
-				c.Log.Errorf(
-					"ignoring standalone node %q not in expected replset: %q",
-					addr,
-					replicaSetName,
-				)
+				skip(addr, &seedError{
+					reason: seedStandalone,
+					msg: fmt.Sprintf(
+						"ignoring standalone node %q not in expected replset: %q",
+						addr,
+						replicaSetName,
+					),
+				})
 				continue
 			}
 			if ar.lastRS.Name != replicaSetName {
-				c.Log.Errorf(
-					"ignoring node %q not in expected replset: %q vs %q",
-					addr,
-					ar.lastRS.Name,
-					replicaSetName,
-				)
+				skip(addr, &seedError{
+					reason: seedWrongReplicaSet,
+					msg: fmt.Sprintf(
+						"ignoring node %q not in expected replset: %q vs %q",
+						addr,
+						ar.lastRS.Name,
+						replicaSetName,
+					),
+				})
 				continue
 			}
 		}
@@ -160,8 +363,19 @@ func (c *ReplicaSetStateCreator) FromAddrs(addrs []string, replicaSetName string
 		}
 	}
 
+	if len(skipped) == 0 {
+		c.Log.Infof("discovered %d of %d seeds", len(addrs), len(addrs))
+	} else {
+		c.Log.Infof(
+			"discovered %d of %d seeds, skipped: %s",
+			len(addrs)-len(skipped),
+			len(addrs),
+			strings.Join(skipped, ", "),
+		)
+	}
+
 	if r == nil {
-		return nil, fmt.Errorf("could not connect to any provided addresses: %v", addrs)
+		return nil, &ErrAllSeedsUnreachable{Addrs: addrs, Errors: errs}
 	}
 
 	// Check if we're expecting an RS but got a single node.
@@ -177,6 +391,66 @@ func (c *ReplicaSetStateCreator) FromAddrs(addrs []string, replicaSetName string
 	return r, nil
 }
 
+// ErrAllSeedsUnreachable is returned when none of the seed addresses could be
+// used to discover the ReplicaSetState.
+type ErrAllSeedsUnreachable struct {
+	// Addrs are the seed addresses that were tried.
+	Addrs []string
+
+	// Errors contains the reason each of the seed addresses was not used.
+	Errors map[string]error
+}
+
+func (e *ErrAllSeedsUnreachable) Error() string {
+	return fmt.Sprintf("could not connect to any provided addresses: %v", e.Addrs)
+}
+
+// seedSkipReason classifies why a seed address was not used by FromAddrs.
+type seedSkipReason string
+
+const (
+	seedUnreachable     = seedSkipReason("unreachable")
+	seedWrongReplicaSet = seedSkipReason("wrong replset")
+	seedStandalone      = seedSkipReason("standalone")
+	seedAuth            = seedSkipReason("auth")
+	seedOther           = seedSkipReason("other")
+)
+
+// seedError is a seed address that was reachable but not usable.
+type seedError struct {
+	reason seedSkipReason
+	msg    string
+}
+
+func (e *seedError) Error() string {
+	return e.msg
+}
+
+// classifySeedError returns the reason a seed address failed with the given
+// error. Unreachable seeds are expected when a node is down, while the others
+// usually indicate a configuration problem.
+func classifySeedError(err error) seedSkipReason {
+	if se, ok := err.(*seedError); ok {
+		return se.reason
+	}
+	if qe, ok := err.(*mgo.QueryError); ok && (qe.Code == 13 || qe.Code == 18) {
+		return seedAuth
+	}
+	if _, ok := err.(net.Error); ok {
+		return seedUnreachable
+	}
+	msg := err.Error()
+	switch {
+	case msg == "no reachable servers", err == io.EOF:
+		return seedUnreachable
+	case strings.Contains(msg, "not authorized"),
+		strings.Contains(msg, "auth fail"),
+		strings.Contains(msg, "Authentication failed"):
+		return seedAuth
+	}
+	return seedOther
+}
+
 var (
 	replSetGetStatusQuery = bson.D{
 		bson.DocElem{Name: "replSetGetStatus", Value: 1},
@@ -184,6 +458,9 @@ var (
 	isMasterQuery = bson.D{
 		bson.DocElem{Name: "isMaster", Value: 1},
 	}
+	replSetGetConfigQuery = bson.D{
+		bson.DocElem{Name: "replSetGetConfig", Value: 1},
+	}
 )
 
 func replSetGetStatus(s *mgo.Session) (*replSetGetStatusResponse, error) {
@@ -194,6 +471,27 @@ func replSetGetStatus(s *mgo.Session) (*replSetGetStatusResponse, error) {
 	return &res, nil
 }
 
+func replSetGetConfig(s *mgo.Session) (*replSetGetConfigResponse, error) {
+	var res replSetGetConfigResponse
+	if err := s.Run(replSetGetConfigQuery, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// applyConfig sets the Config for the members found in the given
+// configuration.
+func (r *replSetGetStatusResponse) applyConfig(c *replSetGetConfigResponse) {
+	for i := range c.Config.Members {
+		mc := &c.Config.Members[i]
+		for j := range r.Members {
+			if r.Members[j].Name == mc.Host {
+				r.Members[j].Config = mc
+			}
+		}
+	}
+}
+
 func isMaster(s *mgo.Session) (*isMasterResponse, error) {
 	var res isMasterResponse
 	if err := s.Run(isMasterQuery, &res); err != nil {
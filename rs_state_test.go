@@ -1,9 +1,17 @@
 package dvara
 
 import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/facebookgo/ensure"
 	"github.com/facebookgo/mgotest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestSameRSMembers(t *testing.T) {
@@ -316,3 +324,224 @@ func TestIgnoreMismatchingReplicaSets(t *testing.T) {
 		t.Fatalf("missing expected error: %s", err)
 	}
 }
+
+func TestFromAddrsAllSeedsUnreachable(t *testing.T) {
+	t.Parallel()
+	mgo := mgotest.NewStartedServer(t)
+	mgo.Stop()
+	creator := ReplicaSetStateCreator{
+		Log: &tLogger{TB: t},
+	}
+	addrs := []string{mgo.URL()}
+	_, err := creator.FromAddrs(addrs, "")
+	unreachable, ok := err.(*ErrAllSeedsUnreachable)
+	if !ok {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(unreachable.Addrs, addrs) {
+		t.Fatalf("unexpected addrs %v", unreachable.Addrs)
+	}
+	if addrErr := unreachable.Errors[mgo.URL()]; addrErr == nil || addrErr.Error() != "no reachable servers" {
+		t.Fatalf("unexpected error for %s: %s", mgo.URL(), addrErr)
+	}
+}
+
+func TestFromAddrsProbesConcurrently(t *testing.T) {
+	t.Parallel()
+	const probeTime = 100 * time.Millisecond
+	addrs := []string{"a", "b", "c", "d"}
+	cases := []struct {
+		Name                string
+		MaxConcurrentProbes uint
+		Min, Max            time.Duration
+	}{
+		{Name: "default", Min: probeTime, Max: 2 * probeTime},
+		{Name: "serial", MaxConcurrentProbes: 1, Min: 4 * probeTime, Max: 5 * probeTime},
+		{Name: "pairs", MaxConcurrentProbes: 2, Min: 2 * probeTime, Max: 3 * probeTime},
+	}
+	for _, c := range cases {
+		creator := ReplicaSetStateCreator{
+			Log:                 &tLogger{TB: t},
+			MaxConcurrentProbes: c.MaxConcurrentProbes,
+			newState: func(addr string) (*ReplicaSetState, error) {
+				time.Sleep(probeTime)
+				var members []statusMember
+				for _, a := range addrs {
+					members = append(members, statusMember{Name: a, State: ReplicaStateSecondary})
+				}
+				return &ReplicaSetState{
+					lastRS: &replSetGetStatusResponse{Name: "rs", Members: members},
+				}, nil
+			},
+		}
+		start := time.Now()
+		state, err := creator.FromAddrs(addrs, "rs")
+		ensure.Nil(t, err)
+		if elapsed := time.Since(start); elapsed < c.Min || elapsed >= c.Max {
+			t.Fatalf("%s: expected probes to take between %s and %s but took %s", c.Name, c.Min, c.Max, elapsed)
+		}
+		if actual := state.Addrs(); !reflect.DeepEqual(actual, addrs) {
+			t.Fatalf("%s: unexpected addrs %v", c.Name, actual)
+		}
+	}
+}
+
+func TestNumericMemberState(t *testing.T) {
+	t.Parallel()
+	in := bson.M{
+		"set": "rs",
+		"members": []interface{}{
+			bson.M{"name": "a", "state": 1},
+			bson.M{"name": "b", "state": 2, "stateStr": "SECONDARY"},
+			bson.M{"name": "c", "state": 7},
+			bson.M{"name": "d", "state": 42},
+			bson.M{"name": "e"},
+		},
+	}
+	raw, err := bson.Marshal(in)
+	ensure.Nil(t, err)
+	var status replSetGetStatusResponse
+	ensure.Nil(t, bson.Unmarshal(raw, &status))
+
+	expected := []ReplicaState{
+		ReplicaStatePrimary,
+		ReplicaStateSecondary,
+		ReplicaStateArbiter,
+		ReplicaState("UNKNOWN"),
+		ReplicaState(""),
+	}
+	for i, m := range status.Members {
+		if m.State != expected[i] {
+			t.Fatalf("expected %s to be %s got %s", m.Name, expected[i], m.State)
+		}
+	}
+	state := &ReplicaSetState{lastRS: &status}
+	if actual := state.Addrs(); !reflect.DeepEqual(actual, []string{"a", "b"}) {
+		t.Fatalf("unexpected addrs %v", actual)
+	}
+
+	// The derived states aren't added when marshaling.
+	expectedOut := bson.M{}
+	ensure.Nil(t, bson.Unmarshal(raw, &expectedOut))
+	raw, err = bson.Marshal(status)
+	ensure.Nil(t, err)
+	out := bson.M{}
+	ensure.Nil(t, bson.Unmarshal(raw, &out))
+	if !reflect.DeepEqual(out, expectedOut) {
+		t.Fatalf("expected %v got %v", expectedOut, out)
+	}
+}
+
+func TestFromAddrsMaxConcurrentDiscoveries(t *testing.T) {
+	t.Parallel()
+	const (
+		discoveries = 10
+		max         = 3
+	)
+	var inFlight, maxInFlight int32
+	creator := ReplicaSetStateCreator{
+		Log:                      &tLogger{TB: t},
+		MaxConcurrentDiscoveries: max,
+		newState: func(addr string) (*ReplicaSetState, error) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return &ReplicaSetState{singleAddr: addr}, nil
+		},
+	}
+	var wg sync.WaitGroup
+	wg.Add(discoveries)
+	for i := 0; i < discoveries; i++ {
+		go func() {
+			defer wg.Done()
+			_, err := creator.FromAddrs([]string{"a"}, "")
+			ensure.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != max {
+		t.Fatalf("expected %d discoveries in flight got %d", max, maxInFlight)
+	}
+}
+
+func TestFromAddrsSkipReasons(t *testing.T) {
+	t.Parallel()
+	creator := ReplicaSetStateCreator{
+		Log: &tLogger{TB: t},
+		newState: func(addr string) (*ReplicaSetState, error) {
+			switch addr {
+			case "down":
+				return nil, errors.New("no reachable servers")
+			case "other-rs":
+				return &ReplicaSetState{lastRS: &replSetGetStatusResponse{Name: "other"}}, nil
+			case "standalone":
+				return &ReplicaSetState{singleAddr: addr}, nil
+			case "auth":
+				return nil, &mgo.QueryError{Code: 13, Message: "not authorized on admin to execute command"}
+			}
+			return nil, errors.New("unexpected")
+		},
+	}
+	_, err := creator.FromAddrs([]string{"down", "other-rs", "standalone", "auth", "boom"}, "rs")
+	unreachable, ok := err.(*ErrAllSeedsUnreachable)
+	if !ok {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]seedSkipReason{
+		"down":       seedUnreachable,
+		"other-rs":   seedWrongReplicaSet,
+		"standalone": seedStandalone,
+		"auth":       seedAuth,
+		"boom":       seedOther,
+	}
+	for addr, reason := range expected {
+		if actual := classifySeedError(unreachable.Errors[addr]); actual != reason {
+			t.Fatalf("expected %s to be skipped as %s got %s", addr, reason, actual)
+		}
+	}
+}
+
+func TestReplicaSetStateDiff(t *testing.T) {
+	t.Parallel()
+	from := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "a", State: ReplicaStatePrimary},
+				{Name: "b", State: ReplicaStateSecondary},
+				{Name: "c", State: ReplicaStateSecondary},
+			},
+		},
+	}
+	to := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "a", State: ReplicaStateSecondary},
+				{Name: "b", State: ReplicaStatePrimary},
+				{Name: "d", State: ReplicaStateSecondary},
+			},
+		},
+	}
+	expected := []StateChange{
+		{Kind: StateChangePrimary, From: "a", To: "b"},
+		{Kind: StateChangeMemberState, Member: "a", From: "PRIMARY", To: "SECONDARY"},
+		{Kind: StateChangeMemberState, Member: "b", From: "SECONDARY", To: "PRIMARY"},
+		{Kind: StateChangeMemberRemoved, Member: "c", From: "SECONDARY"},
+		{Kind: StateChangeMemberAdded, Member: "d", To: "SECONDARY"},
+	}
+	if actual := from.Diff(to); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+	if actual := from.Diff(from); len(actual) != 0 {
+		t.Fatalf("expected no changes got %v", actual)
+	}
+	const msg = `primary moved from "a" to "b"`
+	if actual := expected[0].String(); actual != msg {
+		t.Fatalf("expected %q got %q", msg, actual)
+	}
+}
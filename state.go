@@ -13,3 +13,27 @@ const (
 	// ReplicaStateArbiter indicates the node is an arbiter.
 	ReplicaStateArbiter = ReplicaState("ARBITER")
 )
+
+// replicaStateCodes maps the numeric member states to their names:
+// http://docs.mongodb.org/manual/reference/replica-states/
+var replicaStateCodes = map[int]ReplicaState{
+	0:  ReplicaState("STARTUP"),
+	1:  ReplicaStatePrimary,
+	2:  ReplicaStateSecondary,
+	3:  ReplicaState("RECOVERING"),
+	5:  ReplicaState("STARTUP2"),
+	6:  ReplicaState("UNKNOWN"),
+	7:  ReplicaStateArbiter,
+	8:  ReplicaState("DOWN"),
+	9:  ReplicaState("ROLLBACK"),
+	10: ReplicaState("REMOVED"),
+}
+
+// replicaStateFromCode returns the ReplicaState for the numeric state, or
+// UNKNOWN for codes we don't know about.
+func replicaStateFromCode(code int) ReplicaState {
+	if s, ok := replicaStateCodes[code]; ok {
+		return s
+	}
+	return ReplicaState("UNKNOWN")
+}
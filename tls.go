@@ -0,0 +1,66 @@
+package dvara
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// MinTLSVersion is the lowest TLS version allowed by ValidateTLSConfig.
+const MinTLSVersion = tls.VersionTLS12
+
+// ApprovedCipherSuites are the TLS 1.2 cipher suites allowed by
+// ValidateTLSConfig. TLS 1.3 suites are not configurable and always allowed.
+var ApprovedCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// DefaultTLSConfig returns a TLS configuration that satisfies
+// ValidateTLSConfig. Certificates still need to be provided.
+func DefaultTLSConfig() *tls.Config {
+	cipherSuites := make([]uint16, len(ApprovedCipherSuites))
+	copy(cipherSuites, ApprovedCipherSuites)
+	return &tls.Config{
+		MinVersion:   MinTLSVersion,
+		CipherSuites: cipherSuites,
+	}
+}
+
+// ValidateTLSConfig returns an error if the configuration allows a TLS
+// version below MinTLSVersion, a cipher suite not in ApprovedCipherSuites, or
+// skips certificate verification.
+func ValidateTLSConfig(c *tls.Config) error {
+	if c.MinVersion < MinTLSVersion {
+		return fmt.Errorf(
+			"dvara: TLS MinVersion %#04x is below the minimum %#04x",
+			c.MinVersion,
+			MinTLSVersion,
+		)
+	}
+	// An empty list means Go's defaults, which include suites we don't approve.
+	if len(c.CipherSuites) == 0 && c.MinVersion < tls.VersionTLS13 {
+		return fmt.Errorf("dvara: TLS CipherSuites must be set to approved suites")
+	}
+	for _, suite := range c.CipherSuites {
+		if !approvedCipherSuite(suite) {
+			return fmt.Errorf("dvara: TLS cipher suite %s is not approved", tls.CipherSuiteName(suite))
+		}
+	}
+	if c.InsecureSkipVerify {
+		return fmt.Errorf("dvara: TLS InsecureSkipVerify is not allowed")
+	}
+	return nil
+}
+
+func approvedCipherSuite(suite uint16) bool {
+	for _, s := range ApprovedCipherSuites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
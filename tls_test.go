@@ -0,0 +1,80 @@
+package dvara
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestValidateTLSConfig(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name   string
+		Config *tls.Config
+		Error  string
+	}{
+		{
+			Name:   "default",
+			Config: DefaultTLSConfig(),
+		},
+		{
+			Name:   "tls 1.3 only",
+			Config: &tls.Config{MinVersion: tls.VersionTLS13},
+		},
+		{
+			Name:   "old version",
+			Config: &tls.Config{MinVersion: tls.VersionTLS10, CipherSuites: ApprovedCipherSuites},
+			Error:  "dvara: TLS MinVersion 0x0301 is below the minimum 0x0303",
+		},
+		{
+			Name:   "unset version",
+			Config: &tls.Config{CipherSuites: ApprovedCipherSuites},
+			Error:  "is below the minimum",
+		},
+		{
+			Name:   "default suites",
+			Config: &tls.Config{MinVersion: tls.VersionTLS12},
+			Error:  "dvara: TLS CipherSuites must be set to approved suites",
+		},
+		{
+			Name: "weak suite",
+			Config: &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+			},
+			Error: "dvara: TLS cipher suite TLS_RSA_WITH_AES_128_CBC_SHA is not approved",
+		},
+		{
+			Name: "skip verify",
+			Config: &tls.Config{
+				MinVersion:         tls.VersionTLS13,
+				InsecureSkipVerify: true,
+			},
+			Error: "dvara: TLS InsecureSkipVerify is not allowed",
+		},
+	}
+	for _, c := range cases {
+		err := ValidateTLSConfig(c.Config)
+		if c.Error == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected error %s", c.Name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.Error) {
+			t.Fatalf("%s: expected error %q got %v", c.Name, c.Error, err)
+		}
+	}
+}
+
+func TestStartRejectsWeakTLSConfig(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		Addrs:     "localhost:27017",
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS10, CipherSuites: ApprovedCipherSuites},
+	}
+	const expected = "dvara: TLS MinVersion 0x0301 is below the minimum 0x0303"
+	if err := r.Start(); err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q got %v", expected, err)
+	}
+}